@@ -6,7 +6,10 @@ import (
 	encodingjson "encoding/json"
 	flag "flag"
 	fmt "fmt"
+	math "math"
 	http "net/http"
+	os "os"
+	sort "sort"
 	strings "strings"
 	sync "sync"
 	time "time"
@@ -41,6 +44,8 @@ type StatusResp struct {
 }
 
 type JobResult struct {
+	Seq           int
+	TargetRPS     float64
 	URL           string
 	ID            string
 	OK            bool
@@ -62,74 +67,205 @@ type JobResult struct {
 func main() {
 	base := flag.String("base", "http://127.0.0.1:8080", "API base URL")
 	urlIn := flag.String("url", "https://www.youtube.com/watch?v=dQw4w9WgXcQ", "YouTube URL to test")
-	n := flag.Int("n", 20, "number of concurrent requests")
+	n := flag.Int("n", 20, "number of concurrent requests (burst mode)")
 	quality := flag.String("q", "128", "MP3 quality (128/192/256/320)")
 	perIPDelay := flag.Duration("delay", 0, "stagger start delay between jobs (to avoid per-IP limits)")
+	rps := flag.Float64("rps", 0, "launch jobs at this rate per second for -duration instead of a burst of -n")
+	rampTo := flag.Float64("ramp-to", 0, "with -rps, ramp the rate linearly from -rps to this value over -duration")
+	duration := flag.Duration("duration", time.Minute, "how long to keep launching jobs with -rps")
+	jsonOut := flag.Bool("json", false, "print only a machine-readable JSON summary")
 	flag.Parse()
 
 	client := &http.Client{Timeout: 30 * time.Second}
 
-	urls := make([]string, *n)
-	for i := 0; i < *n; i++ {
-		// Make URLs unique for dedup-bypass (YouTube ignores unknown query params)
-		sep := "&"
-		if !strings.Contains(*urlIn, "?") {
-			sep = "?"
-		}
-		urls[i] = fmt.Sprintf("%s%cutm=%d", *urlIn, sep[0], i)
-	}
-
-	results := make([]JobResult, *n)
-	var wg sync.WaitGroup
-	wg.Add(*n)
-
-	for i := 0; i < *n; i++ {
-		i := i
+	var (
+		mu      sync.Mutex
+		results []JobResult
+		wg      sync.WaitGroup
+	)
+	launch := func(i int, rate float64) {
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			res := runOne(client, *base, jobURL(*urlIn, i), *quality)
+			res.Seq, res.TargetRPS = i, rate
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}()
+	}
+
+	start := time.Now()
+	if *rps > 0 {
+		launched := runAtRate(launch, *rps, *rampTo, *duration)
+		if !*jsonOut {
+			fmt.Printf("launched %d jobs in %s\n", launched, *duration)
+		}
+	} else {
+		for i := 0; i < *n; i++ {
 			if *perIPDelay > 0 && i > 0 {
-				time.Sleep(time.Duration(i) * *perIPDelay)
+				time.Sleep(*perIPDelay)
 			}
-			res := runOne(client, *base, urls[i], *quality)
-			results[i] = res
-		}()
+			launch(i, 0)
+		}
 	}
 
 	wg.Wait()
+	elapsed := time.Since(start)
+	sort.Slice(results, func(i, j int) bool { return results[i].Seq < results[j].Seq })
+	sum := summarize(results, elapsed)
+
+	if *jsonOut {
+		enc := encodingjson.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(sum)
+		return
+	}
 
 	// Print per-job summary
 	fmt.Println("\nPer-job summary:")
-	for i, r := range results {
+	for _, r := range results {
 		status := "OK"
 		if !r.OK {
 			status = "FAIL"
 		}
-		fmt.Printf("%2d) %s id=%s status=%s meta=%dms queue_wait=%dms download=%dms convert=%dms total=%dms\n",
-			i+1, r.URL, r.ID, status, r.MetaMs, r.QueueWaitMs, r.DownloadMs, r.ConvertMs, r.TotalMs)
+		rate := ""
+		if r.TargetRPS > 0 {
+			rate = fmt.Sprintf(" rps=%.2f", r.TargetRPS)
+		}
+		fmt.Printf("%2d) %s id=%s status=%s%s meta=%dms queue_wait=%dms download=%dms convert=%dms total=%dms\n",
+			r.Seq+1, r.URL, r.ID, status, rate, r.MetaMs, r.QueueWaitMs, r.DownloadMs, r.ConvertMs, r.TotalMs)
 		if r.Err != "" {
 			fmt.Printf("    error: %s\n", r.Err)
 		}
 	}
 
-	// Aggregate stats (completed only)
-	var c int
-	var metaSum, queueSum, dlSum, cvSum, totSum int64
+	fmt.Printf("\n%d jobs: %d completed, %d failed in %.1fs (%.2f completed/s)\n",
+		sum.Jobs, sum.Completed, sum.Failed, sum.ElapsedSeconds, sum.Throughput)
+	if sum.Completed > 0 {
+		fmt.Printf("\nLatency over %d completed (avg p50 p90 p95 p99):\n", sum.Completed)
+		for _, name := range phaseNames {
+			ph := sum.Phases[name]
+			fmt.Printf("%-10s %7.0fms %6dms %6dms %6dms %6dms\n", name, ph.AvgMs, ph.P50, ph.P90, ph.P95, ph.P99)
+		}
+	}
+	if len(sum.Errors) > 0 {
+		msgs := make([]string, 0, len(sum.Errors))
+		for msg := range sum.Errors {
+			msgs = append(msgs, msg)
+		}
+		sort.Slice(msgs, func(i, j int) bool { return sum.Errors[msgs[i]] > sum.Errors[msgs[j]] })
+		fmt.Println("\nFailures by error:")
+		for _, msg := range msgs {
+			fmt.Printf("%5d  %s\n", sum.Errors[msg], msg)
+		}
+	}
+}
+
+// phaseNames lists the per-job phases in report order.
+var phaseNames = []string{"meta", "queue_wait", "download", "convert", "total"}
+
+// PhaseStats are latency statistics in milliseconds over completed jobs.
+type PhaseStats struct {
+	AvgMs float64 `json:"avg_ms"`
+	P50   int64   `json:"p50_ms"`
+	P90   int64   `json:"p90_ms"`
+	P95   int64   `json:"p95_ms"`
+	P99   int64   `json:"p99_ms"`
+}
+
+// Summary is the aggregate result of a run, printed as JSON with -json.
+type Summary struct {
+	Jobs           int                   `json:"jobs"`
+	Completed      int                   `json:"completed"`
+	Failed         int                   `json:"failed"`
+	ElapsedSeconds float64               `json:"elapsed_seconds"`
+	Throughput     float64               `json:"throughput_per_second"`
+	Phases         map[string]PhaseStats `json:"phases"`
+	Errors         map[string]int        `json:"errors"`
+}
+
+// summarize aggregates results of a run that took elapsed. Latencies cover
+// completed jobs only; failures are counted by error message.
+func summarize(results []JobResult, elapsed time.Duration) Summary {
+	sum := Summary{Jobs: len(results), ElapsedSeconds: elapsed.Seconds(), Phases: map[string]PhaseStats{}, Errors: map[string]int{}}
+	vals := map[string][]int64{}
 	for _, r := range results {
 		if !r.OK {
+			sum.Failed++
+			msg := r.Err
+			if msg == "" {
+				msg = "unknown"
+			}
+			sum.Errors[msg]++
 			continue
 		}
-		c++
-		metaSum += r.MetaMs
-		queueSum += r.QueueWaitMs
-		dlSum += r.DownloadMs
-		cvSum += r.ConvertMs
-		totSum += r.TotalMs
-	}
-	if c > 0 {
-		fmt.Printf("\nAverages over %d completed:\n", c)
-		fmt.Printf("meta=%.0fms queue_wait=%.0fms download=%.0fms convert=%.0fms total=%.0fms\n",
-			float64(metaSum)/float64(c), float64(queueSum)/float64(c), float64(dlSum)/float64(c), float64(cvSum)/float64(c), float64(totSum)/float64(c))
+		sum.Completed++
+		for name, v := range map[string]int64{"meta": r.MetaMs, "queue_wait": r.QueueWaitMs, "download": r.DownloadMs, "convert": r.ConvertMs, "total": r.TotalMs} {
+			vals[name] = append(vals[name], v)
+		}
+	}
+	if elapsed > 0 {
+		sum.Throughput = float64(sum.Completed) / elapsed.Seconds()
+	}
+	for _, name := range phaseNames {
+		v := vals[name]
+		sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+		var total int64
+		for _, x := range v {
+			total += x
+		}
+		ph := PhaseStats{P50: percentile(v, 50), P90: percentile(v, 90), P95: percentile(v, 95), P99: percentile(v, 99)}
+		if len(v) > 0 {
+			ph.AvgMs = float64(total) / float64(len(v))
+		}
+		sum.Phases[name] = ph
+	}
+	return sum
+}
+
+// jobURL makes the i-th job's URL unique to bypass dedup (YouTube ignores
+// unknown query params).
+func jobURL(videoURL string, i int) string {
+	sep := "&"
+	if !strings.Contains(videoURL, "?") {
+		sep = "?"
+	}
+	return fmt.Sprintf("%s%sutm=%d", videoURL, sep, i)
+}
+
+// runAtRate calls launch at rate jobs per second until d has elapsed,
+// returning how many jobs it launched. When rampTo is set the rate moves
+// linearly from rate to rampTo over d, so the point where latency or errors
+// climb shows the service's limit.
+func runAtRate(launch func(i int, rate float64), rate, rampTo float64, d time.Duration) int {
+	start := time.Now()
+	next := start
+	i := 0
+	for next.Sub(start) < d {
+		time.Sleep(time.Until(next))
+		cur := rate
+		if rampTo > 0 {
+			cur = rate + (rampTo-rate)*float64(next.Sub(start))/float64(d)
+		}
+		launch(i, cur)
+		i++
+		next = next.Add(time.Duration(float64(time.Second) / cur))
+	}
+	return i
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted, or 0 when
+// it is empty.
+func percentile(sorted []int64, p float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
 	}
+	return sorted[idx]
 }
 
 func runOne(client *http.Client, base, videoURL, quality string) JobResult {
@@ -7,7 +7,6 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"ytmp3api/internal/server"
 )
@@ -27,10 +26,16 @@ func main() {
 		}
 	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			srv.Reload()
+		}
+	}()
+
 	<-ctx.Done()
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := srv.Stop(shutdownCtx); err != nil {
+	if err := srv.Stop(context.Background()); err != nil {
 		log.Printf("graceful shutdown error: %v", err)
 	}
 	os.Exit(0)
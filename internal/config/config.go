@@ -1,7 +1,12 @@
 package config
 
 import (
+	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -10,21 +15,56 @@ import (
 // Config holds all runtime configuration parsed from environment variables.
 //
 // For each field below, the corresponding environment variable is indicated
-// in parentheses with its default. Values are read once at startup.
+// in parentheses with its default. Values are read at startup, from the
+// process environment and the optional CONFIG_FILE (see LoadEnvFile); on
+// SIGHUP the file is re-read and the fields the API can swap at runtime are
+// applied. Fields holding credentials are tagged `secret:"true"` so Redacted
+// hides them.
 type Config struct {
     // WorkerPoolSize controls the number of goroutines in each worker pool
     // for download and conversion. Higher values increase concurrency at the
     // cost of CPU/IO. (WORKER_POOL_SIZE, default 20)
     WorkerPoolSize int
 
+    // DownloadWorkers and ConvertWorkers size the download and convert pools
+    // independently; downloads are I/O-bound while conversions are CPU-bound.
+    // Both default to WorkerPoolSize. (DOWNLOAD_WORKERS, CONVERT_WORKERS)
+    DownloadWorkers int
+    ConvertWorkers  int
+
     // JobQueueCapacity is the maximum number of pending jobs allowed in each
     // in-memory priority queue. When full, new requests get HTTP 503. (JOB_QUEUE_CAPACITY, default 1000)
     JobQueueCapacity int
 
+    // MaxSessions caps stored sessions; /prepare and /convert/upload get
+    // HTTP 503 once it is reached. 0 disables. (MAX_SESSIONS, default 0)
+    MaxSessions int
+
+    // QueueStrategy orders both job queues: "priority" dequeues higher
+    // priority jobs first, "fifo" strictly by enqueue time. (QUEUE_STRATEGY,
+    // default priority)
+    QueueStrategy string
+
     // MaxJobRetries is the maximum automatic retry attempts per job with
     // exponential backoff before the job is marked failed. (MAX_JOB_RETRIES, default 3)
     MaxJobRetries int
 
+    // JobDeadline is the overall wall-clock budget per job measured from
+    // enqueue, covering retries, waiting for the download and the tool run
+    // itself. Expired jobs are failed instead of processed. 0 disables.
+    // (JOB_DEADLINE, default 0)
+    JobDeadline time.Duration
+
+    // MaxSourceWaits caps how many times a convert job is re-enqueued (every
+    // 5s) while its source is still downloading before it fails with "source
+    // never became ready". 0 disables the cap. (MAX_SOURCE_WAITS, default 360 ≈ 30m)
+    MaxSourceWaits int
+
+    // RetryFailedSessions makes /convert on a failed session retry it (reusing
+    // the source if it is still on disk, else downloading it again) instead
+    // of answering 409. (RETRY_FAILED_SESSIONS, default false)
+    RetryFailedSessions bool
+
     // RequestsPerSecond and BurstSize define a global token bucket limiter
     // across all requests. (REQUESTS_PER_SECOND default 100, BURST_SIZE default 200)
     RequestsPerSecond float64
@@ -38,8 +78,12 @@ type Config struct {
     // Redis connection settings for the optional Redis-backed session store.
     // If RedisAddr is non-empty and reachable, Redis will be used. (REDIS_ADDR, REDIS_PASSWORD, REDIS_DB)
     RedisAddr     string
-    RedisPassword string
+    RedisPassword string `secret:"true"`
     RedisDB       int
+    // RedisKeyPrefix namespaces every key we write; RedisTLS connects over
+    // TLS. (REDIS_KEY_PREFIX, default ""; REDIS_TLS, default false)
+    RedisKeyPrefix string
+    RedisTLS       bool
 
     // YtDLPTimeout caps metadata fallback execution time. FFmpegMin/MaxTimeout
     // bound conversion timeouts. (YTDLP_TIMEOUT default 90s; FFMPEG_MIN_TIMEOUT default 15m; FFMPEG_MAX_TIMEOUT default 60m)
@@ -56,10 +100,30 @@ type Config struct {
     FFmpegVBRQ       int
     FFmpegThreads    int
 
+    // ProcessNice and ProcessIOClass run yt-dlp downloads and ffmpeg under
+    // nice -n ProcessNice and ionice -c ProcessIOClass (2 best-effort or
+    // 3 idle) so the HTTP server stays responsive. 0 disables each; ignored
+    // where the tool is unavailable. (PROCESS_NICE, PROCESS_IONICE_CLASS)
+    ProcessNice    int
+    ProcessIOClass int
+
+    // QualityBitrates maps the public quality labels accepted by /convert to
+    // encoder bitrates in kbps, e.g. "high:256k,low:96k". Labels outside the
+    // map are rejected. (QUALITY_BITRATE_MAP, default
+    // "64:64k,128:128k,192:192k,256:256k,320:320k")
+    QualityBitrates map[string]int
+
+    // DefaultQuality and DefaultFormat apply to convert requests that omit
+    // quality or format. An empty DefaultQuality encodes at FFmpegCBRBitrate.
+    // (DEFAULT_QUALITY, default ""; DEFAULT_FORMAT, default "mp3")
+    DefaultQuality string
+    DefaultFormat  string
+
     // AlwaysDownload forces a fresh download even if a cached asset exists.
     // DownloadThreshold can be used by future logic to decide re-download
-    // after a certain age. YtDLPDownloadConcurrency is reserved for future
-    // parallel segment download strategies. YtDLPDownloadTimeout limits the
+    // after a certain age. YtDLPDownloadConcurrency is the number of
+    // parallel ranged GETs used for large files on DIRECT_DOWNLOAD_HOSTS
+    // (1 fetches them as one stream). YtDLPDownloadTimeout limits the
     // end-to-end download time. (ALWAYS_DOWNLOAD, DOWNLOAD_THRESHOLD, YTDLP_DOWNLOAD_CONCURRENCY, YTDLP_DOWNLOAD_TIMEOUT)
     AlwaysDownload           bool
     DownloadThreshold        time.Duration
@@ -71,43 +135,238 @@ type Config struct {
     // UNCONVERTED_FILE_TTL, CONVERTED_FILE_TTL)
     ConversionsDir     string
     UnconvertedFileTTL time.Duration
+    // PinSources restarts a source's UNCONVERTED_FILE_TTL every time it is
+    // used, so frequently converted sources stay cached and the disk limit
+    // evicts the least recently used ones first. (PIN_SOURCES, default false)
+    PinSources bool
     ConvertedFileTTL   time.Duration
+    // InstanceID names this process in the temp files it writes before
+    // renaming them to their hashed paths, so instances sharing
+    // CONVERSIONS_DIR never write the same file. (INSTANCE_ID, default the
+    // hostname)
+    InstanceID string
+
+    // CleanupInterval is how often the TTL cleanup scans the conversions
+    // directory. (CLEANUP_INTERVAL, default 1m)
+    CleanupInterval time.Duration
+
+    // MaxDiskUsageBytes caps the combined size of streams/ and outputs/. When
+    // exceeded, cleanup deletes the oldest files until usage drops to
+    // DiskLowWaterBytes (default 90% of the max). 0 disables.
+    // (MAX_DISK_USAGE_BYTES, DISK_LOW_WATER_BYTES)
+    MaxDiskUsageBytes int64
+    DiskLowWaterBytes int64
+
+    // MinFreeDiskBytes is the free space the filesystem holding
+    // ConversionsDir must have at startup; /ready fails while it has less.
+    // 0 disables the check. (MIN_FREE_DISK_BYTES, default 512MiB)
+    MinFreeDiskBytes int64
+
+    // DownloadFilenameTemplate builds the Content-Disposition filename for
+    // downloads. Placeholders {title}, {uploader}, {quality}, {id} and
+    // {client_ref} are resolved from the session and sanitized individually;
+    // ".mp3" is appended. (DOWNLOAD_FILENAME_TEMPLATE, default "{title}")
+    DownloadFilenameTemplate string
 
     // API-key and CORS controls. If RequireAPIKey is true, only requests with
     // X-API-Key matching APIKeys are allowed. AllowedOrigins feeds CORS. Admin
-    // credentials are reserved for future admin endpoints. (REQUIRE_API_KEY,
-    // API_KEYS, ALLOWED_ORIGINS, ADMIN_USER, ADMIN_PASS)
+    // credentials guard admin endpoints via basic auth; they stay closed
+    // until ADMIN_PASS is set. (REQUIRE_API_KEY, API_KEYS, ALLOWED_ORIGINS,
+    // ADMIN_USER default admin, ADMIN_PASS default empty)
     RequireAPIKey  bool
-    APIKeys        []string
+    APIKeys        []string `secret:"true"`
     AllowedOrigins []string
     AdminUser      string
-    AdminPass      string
+    AdminPass      string `secret:"true"`
+
+    // JWT bearer auth, accepted alongside X-API-Key. Enabled when a secret
+    // (HS256) or JWKS URL (RS256) is set; issuer/audience are checked when
+    // non-empty. (JWT_SECRET, JWT_JWKS_URL, JWT_ISSUER, JWT_AUDIENCE)
+    JWTSecret   string `secret:"true"`
+    JWTJWKSURL  string
+    JWTIssuer   string
+    JWTAudience string
+
+    // CORS options beyond origins. MaxAge is the preflight cache lifetime in
+    // seconds; 0 lets the browser decide. (CORS_ALLOWED_METHODS, default
+    // "GET,POST,DELETE,OPTIONS"; CORS_ALLOWED_HEADERS, default "*";
+    // CORS_EXPOSE_HEADERS, default "Content-Length,Content-Range,X-Request-ID";
+    // CORS_ALLOW_CREDENTIALS, default false; CORS_MAX_AGE, default 0)
+    CORSAllowedMethods   []string
+    CORSAllowedHeaders   []string
+    CORSExposeHeaders    []string
+    CORSAllowCredentials bool
+    CORSMaxAge           int
+
+    // APIKeyTiers maps API keys to a priority tier ("free" or "premium").
+    // Unlisted keys are "free". (API_KEY_TIERS, e.g. "key1:premium,key2:free")
+    APIKeyTiers map[string]string `secret:"true"`
 
     // External HTTP endpoints used for fast metadata fetch. (OEMBED_ENDPOINT,
     // DURATION_API_ENDPOINT)
     OEmbedEndpoint      string
     DurationAPIEndpoint string
 
+    // MetadataHTTPTimeout bounds each call to the metadata endpoints, which
+    // share one pooled HTTP client. (METADATA_HTTP_TIMEOUT, default 5s)
+    MetadataHTTPTimeout time.Duration
+
+    // Circuit breaker for the metadata endpoints: after BreakerFailures
+    // consecutive failures an endpoint is skipped for BreakerCooldown, then a
+    // single trial call decides whether it closes again. 0 disables.
+    // (BREAKER_FAILURES, default 5; BREAKER_COOLDOWN, default 30s)
+    BreakerFailures int
+    BreakerCooldown time.Duration
+
     // MaxConcurrentDownloads and MaxConcurrentConversions bound the permits in
     // the downloader and converter semaphores. (MAX_CONCURRENT_DOWNLOADS,
     // MAX_CONCURRENT_CONVERSIONS)
     MaxConcurrentDownloads   int
     MaxConcurrentConversions int
+    // MaxConcurrentMetadata bounds concurrent metadata fetches on /prepare;
+    // requests past it wait for a permit. 0 disables the limit.
+    // (MAX_CONCURRENT_METADATA, default 16)
+    MaxConcurrentMetadata int
 
     // AllowedDomains restricts which hostnames are accepted in incoming URLs
     // (e.g., "youtube.com,youtu.be"). (ALLOWED_DOMAINS)
     AllowedDomains []string
 
+    // DirectDownloadHosts lists hosts whose URLs point straight at audio or
+    // video files; those are fetched over HTTP (resuming with Range requests)
+    // instead of through yt-dlp. They must also be in ALLOWED_DOMAINS.
+    // (DIRECT_DOWNLOAD_HOSTS, default empty)
+    DirectDownloadHosts []string
+    // MaxDirectDownloadBytes caps the size of a file fetched from a
+    // DIRECT_DOWNLOAD_HOSTS URL; larger files fail the job. 0 disables the
+    // cap. (MAX_DIRECT_DOWNLOAD_BYTES, default 2 GiB)
+    MaxDirectDownloadBytes int64
+
     // MaxVideoDurationSeconds caps the total video duration. Videos longer than this are rejected. (MAX_VIDEO_DURATION_SECONDS, default 2400 = 40 minutes)
     MaxVideoDurationSeconds int
 
+    // MaxClipSeconds caps the length of the converted clip (end-start, or
+    // duration-start when no end is given). When set, full-video requests for
+    // videos with unknown duration are rejected. 0 disables. (MAX_CLIP_SECONDS,
+    // default 2400 = 40 minutes, matching MAX_VIDEO_DURATION_SECONDS)
+    MaxClipSeconds int
+
+    // MaxChapters caps how many chapters a split_chapters convert may fan
+    // out into; videos with more are rejected. (MAX_CHAPTERS, default 50)
+    MaxChapters int
+
     // IPAllowlist restricts API access to specific client IPs when configured.
     // Leave empty to allow all. (IP_ALLOWLIST)
     IPAllowlist []string
 
+    // TrustedProxyHeader names a header (X-Forwarded-For or X-Real-IP) set by
+    // a fronting proxy to identify the client for rate limiting and the IP
+    // allowlist. Empty uses the connection's RemoteAddr. (TRUSTED_PROXY_HEADER)
+    TrustedProxyHeader string
+
     // ShedQueueThreshold sheds traffic (readiness returns 503) when combined
     // queued jobs exceed this number. 0 disables shedding. (SHED_QUEUE_THRESHOLD)
     ShedQueueThreshold int
+
+    // PrepareDownloadQueueThreshold makes /prepare return 503 while the
+    // download queue holds at least this many jobs, independently of the
+    // convert queue. 0 disables. (PREPARE_DOWNLOAD_QUEUE_THRESHOLD)
+    PrepareDownloadQueueThreshold int
+
+    // ShedLoadPerCPU sheds traffic when the 1-minute load average per CPU
+    // exceeds it, and ShedMemoryPercent when the share of memory in use
+    // does. 0 disables each; both are no-ops outside Linux.
+    // (SHED_LOAD_PER_CPU, SHED_MEMORY_PERCENT)
+    ShedLoadPerCPU    float64
+    ShedMemoryPercent float64
+
+    // MaxQueueWait fails jobs that waited longer than this in the queue
+    // before a worker first picked them up. 0 disables. (MAX_QUEUE_WAIT)
+    MaxQueueWait time.Duration
+
+    // PerKeyMaxConcurrent caps convert jobs running at once for a single API
+    // key or JWT subject; workers skip its queued jobs in favor of others
+    // until one finishes. 0 disables. (PER_KEY_MAX_CONCURRENT)
+    PerKeyMaxConcurrent int
+
+    // ReadyProbeInterval is how often the background prober checks ffmpeg,
+    // yt-dlp, the conversions directory and Redis for /ready.
+    // (READY_PROBE_INTERVAL, default 30s)
+    ReadyProbeInterval time.Duration
+
+    // YtDLPMinVersion is the oldest yt-dlp release (e.g. "2024.08.06") the
+    // prober accepts; older binaries are logged and flagged in /selftest.
+    // With YtDLPMinVersionEnforce, /ready also fails until yt-dlp is
+    // upgraded. (YTDLP_MIN_VERSION, default empty = no check;
+    // YTDLP_MIN_VERSION_ENFORCE, default false)
+    YtDLPMinVersion        string
+    YtDLPMinVersionEnforce bool
+
+    // ShutdownTimeout bounds a graceful shutdown: draining queued and
+    // running jobs, then closing HTTP connections. (SHUTDOWN_TIMEOUT,
+    // default 10s)
+    ShutdownTimeout time.Duration
+
+    // StatsSampleInterval is how often queue lengths, active jobs and the
+    // success rate are sampled for GET /stats/history, which keeps the last
+    // StatsHistorySize samples. A size of 0 disables sampling.
+    // (STATS_SAMPLE_INTERVAL, default 5s; STATS_HISTORY_SIZE, default 720)
+    StatsSampleInterval time.Duration
+    StatsHistorySize    int
+
+    // IdempotencyTTL is how long a response is remembered for a given
+    // Idempotency-Key on /prepare and /convert. (IDEMPOTENCY_TTL, default 24h)
+    IdempotencyTTL time.Duration
+
+    // MaxRequestBodyBytes caps JSON request bodies on POST endpoints; larger
+    // bodies get HTTP 413. (MAX_REQUEST_BODY_BYTES, default 65536)
+    MaxRequestBodyBytes int64
+
+    // MaxUploadBytes caps audio files sent to POST /convert/upload.
+    // (MAX_UPLOAD_BYTES, default 200MiB)
+    MaxUploadBytes int64
+
+    // DevMode enables endpoints meant only for development and tests, such
+    // as POST /metrics/reset. (DEV_MODE, default false)
+    DevMode bool
+
+    // SyncWaitTimeout bounds how long POST /convert?wait=true blocks before
+    // falling back to a 202 response. (SYNC_WAIT_TIMEOUT, default 60s)
+    SyncWaitTimeout time.Duration
+
+    // StoreTimeout bounds each session store call made by the download and
+    // convert workers so a hung Redis cannot block a worker.
+    // (STORE_TIMEOUT, default 5s)
+    StoreTimeout time.Duration
+
+    // ProgressUpdateInterval and ProgressUpdateStep throttle how often a
+    // worker persists download/conversion progress: a write happens once
+    // the interval has passed or progress has advanced by the step
+    // (percent), and 100% is always written.
+    // (PROGRESS_UPDATE_INTERVAL, default 1s; PROGRESS_UPDATE_STEP, default 5)
+    ProgressUpdateInterval time.Duration
+    ProgressUpdateStep     int
+
+    // ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout configure
+    // the HTTP server. The header timeout is what stops slowloris clients;
+    // the read timeout must cover the largest upload. WriteTimeout is off by
+    // default because it would cut long downloads, streams and ?wait=true
+    // responses short. (SERVER_READ_HEADER_TIMEOUT, default 10s;
+    // SERVER_READ_TIMEOUT, default 5m; SERVER_WRITE_TIMEOUT, default 0;
+    // SERVER_IDLE_TIMEOUT, default 120s)
+    ReadHeaderTimeout time.Duration
+    ReadTimeout       time.Duration
+    WriteTimeout      time.Duration
+    IdleTimeout       time.Duration
+
+    // H2C serves HTTP/2 over plaintext (h2c) alongside HTTP/1.1, for running
+    // behind a proxy that speaks HTTP/2 to its backends. (H2C, default false)
+    H2C bool
+
+    // LogLevel is the minimum level of structured logs: debug, info, warn
+    // or error. Unknown values fall back to info. Applied on SIGHUP.
+    // (LOG_LEVEL, default info)
+    LogLevel slog.Level
 }
 
 func getEnv(key, def string) string {
@@ -129,6 +388,18 @@ func getEnvInt(key string, def int) int {
 	return i
 }
 
+func getEnvInt64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def
+	}
+	return i
+}
+
 func getEnvFloat(key string, def float64) float64 {
 	v := os.Getenv(key)
 	if v == "" {
@@ -165,11 +436,24 @@ func getEnvDuration(key string, def time.Duration) time.Duration {
 	return d
 }
 
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "local"
+	}
+	return h
+}
+
 func Load() *Config {
 	cfg := &Config{
 		WorkerPoolSize:   getEnvInt("WORKER_POOL_SIZE", 20),
 		JobQueueCapacity: getEnvInt("JOB_QUEUE_CAPACITY", 1000),
+		MaxSessions:      getEnvInt("MAX_SESSIONS", 0),
+		QueueStrategy:    strings.ToLower(getEnv("QUEUE_STRATEGY", "priority")),
 		MaxJobRetries:    getEnvInt("MAX_JOB_RETRIES", 3),
+		JobDeadline:      getEnvDuration("JOB_DEADLINE", 0),
+		MaxSourceWaits:   getEnvInt("MAX_SOURCE_WAITS", 360),
+		RetryFailedSessions: getEnvBool("RETRY_FAILED_SESSIONS", false),
 
 		RequestsPerSecond: getEnvFloat("REQUESTS_PER_SECOND", 100),
 		BurstSize:         getEnvInt("BURST_SIZE", 200),
@@ -179,6 +463,8 @@ func Load() *Config {
 		RedisAddr:     getEnv("REDIS_ADDR", "localhost:6379"),
 		RedisPassword: getEnv("REDIS_PASSWORD", ""),
 		RedisDB:       getEnvInt("REDIS_DB", 0),
+		RedisKeyPrefix: getEnv("REDIS_KEY_PREFIX", ""),
+		RedisTLS:       getEnvBool("REDIS_TLS", false),
 
 		YtDLPTimeout:     getEnvDuration("YTDLP_TIMEOUT", 90*time.Second),
 		FFmpegMinTimeout: getEnvDuration("FFMPEG_MIN_TIMEOUT", 15*time.Minute),
@@ -187,6 +473,11 @@ func Load() *Config {
 		FFmpegCBRBitrate: getEnv("FFMPEG_CBR_BITRATE", "192k"),
 		FFmpegVBRQ:       getEnvInt("FFMPEG_VBR_Q", 5),
 		FFmpegThreads:    getEnvInt("FFMPEG_THREADS", 0),
+		QualityBitrates:  parseBitrates(getEnv("QUALITY_BITRATE_MAP", "64:64k,128:128k,192:192k,256:256k,320:320k")),
+		ProcessNice:      getEnvInt("PROCESS_NICE", 0),
+		ProcessIOClass:   getEnvInt("PROCESS_IONICE_CLASS", 0),
+		DefaultQuality:   getEnv("DEFAULT_QUALITY", ""),
+		DefaultFormat:    strings.ToLower(getEnv("DEFAULT_FORMAT", "mp3")),
 
 		AlwaysDownload:           getEnvBool("ALWAYS_DOWNLOAD", false),
 		DownloadThreshold:        getEnvDuration("DOWNLOAD_THRESHOLD", 10*time.Minute),
@@ -195,26 +486,103 @@ func Load() *Config {
 
 		ConversionsDir:     getEnv("CONVERSIONS_DIR", "/tmp/conversions"),
 		UnconvertedFileTTL: getEnvDuration("UNCONVERTED_FILE_TTL", 5*time.Minute),
+		PinSources:         getEnvBool("PIN_SOURCES", false),
 		ConvertedFileTTL:   getEnvDuration("CONVERTED_FILE_TTL", 10*time.Minute),
+		InstanceID:         getEnv("INSTANCE_ID", hostname()),
+		CleanupInterval:    getEnvDuration("CLEANUP_INTERVAL", time.Minute),
+		MaxDiskUsageBytes:  getEnvInt64("MAX_DISK_USAGE_BYTES", 0),
+		DiskLowWaterBytes:  getEnvInt64("DISK_LOW_WATER_BYTES", 0),
+		MinFreeDiskBytes:   getEnvInt64("MIN_FREE_DISK_BYTES", 512<<20),
+
+		DownloadFilenameTemplate: getEnv("DOWNLOAD_FILENAME_TEMPLATE", "{title}"),
 
 		RequireAPIKey:  getEnvBool("REQUIRE_API_KEY", false),
 		APIKeys:        splitAndTrim(getEnv("API_KEYS", "")),
 		AllowedOrigins: splitAndTrim(getEnv("ALLOWED_ORIGINS", "*")),
 		AdminUser:      getEnv("ADMIN_USER", "admin"),
-		AdminPass:      getEnv("ADMIN_PASS", "password"),
+		AdminPass:      getEnv("ADMIN_PASS", ""),
+
+		JWTSecret:   getEnv("JWT_SECRET", ""),
+		JWTJWKSURL:  getEnv("JWT_JWKS_URL", ""),
+		JWTIssuer:   getEnv("JWT_ISSUER", ""),
+		JWTAudience: getEnv("JWT_AUDIENCE", ""),
+
+		CORSAllowedMethods:   splitAndTrim(getEnv("CORS_ALLOWED_METHODS", "GET,POST,DELETE,OPTIONS")),
+		CORSAllowedHeaders:   splitAndTrim(getEnv("CORS_ALLOWED_HEADERS", "*")),
+		CORSExposeHeaders:    splitAndTrim(getEnv("CORS_EXPOSE_HEADERS", "Content-Length,Content-Range,X-Request-ID")),
+		CORSAllowCredentials: getEnvBool("CORS_ALLOW_CREDENTIALS", false),
+		CORSMaxAge:           getEnvInt("CORS_MAX_AGE", 0),
+		APIKeyTiers:    parsePairs(getEnv("API_KEY_TIERS", "")),
 
 		OEmbedEndpoint:      getEnv("OEMBED_ENDPOINT", "https://www.youtube.com/oembed"),
+		MetadataHTTPTimeout: getEnvDuration("METADATA_HTTP_TIMEOUT", 5*time.Second),
+		BreakerFailures:     getEnvInt("BREAKER_FAILURES", 5),
+		BreakerCooldown:     getEnvDuration("BREAKER_COOLDOWN", 30*time.Second),
 		DurationAPIEndpoint: getEnv("DURATION_API_ENDPOINT", "https://ds2.ezsrv.net/api/getDuration"),
 
         MaxConcurrentDownloads:   getEnvInt("MAX_CONCURRENT_DOWNLOADS", 20),
         MaxConcurrentConversions: getEnvInt("MAX_CONCURRENT_CONVERSIONS", 20),
+        MaxConcurrentMetadata:    getEnvInt("MAX_CONCURRENT_METADATA", 16),
 
         // Validation and security
         AllowedDomains:    splitAndTrim(getEnv("ALLOWED_DOMAINS", "youtube.com,youtu.be")),
+        DirectDownloadHosts: splitAndTrim(getEnv("DIRECT_DOWNLOAD_HOSTS", "")),
+        MaxDirectDownloadBytes: getEnvInt64("MAX_DIRECT_DOWNLOAD_BYTES", 2<<30),
         MaxVideoDurationSeconds: getEnvInt("MAX_VIDEO_DURATION_SECONDS", 40*60), // 40 minutes
+        MaxClipSeconds:    getEnvInt("MAX_CLIP_SECONDS", 40*60),
+        MaxChapters:       getEnvInt("MAX_CHAPTERS", 50),
         IPAllowlist:       splitAndTrim(getEnv("IP_ALLOWLIST", "")),
+        TrustedProxyHeader: getEnv("TRUSTED_PROXY_HEADER", ""),
         ShedQueueThreshold: getEnvInt("SHED_QUEUE_THRESHOLD", 0),
+        PrepareDownloadQueueThreshold: getEnvInt("PREPARE_DOWNLOAD_QUEUE_THRESHOLD", 0),
+        ShedLoadPerCPU:     getEnvFloat("SHED_LOAD_PER_CPU", 0),
+        ShedMemoryPercent:  getEnvFloat("SHED_MEMORY_PERCENT", 0),
+        MaxQueueWait:       getEnvDuration("MAX_QUEUE_WAIT", 0),
+        PerKeyMaxConcurrent: getEnvInt("PER_KEY_MAX_CONCURRENT", 0),
+        ReadyProbeInterval: getEnvDuration("READY_PROBE_INTERVAL", 30*time.Second),
+        YtDLPMinVersion:        getEnv("YTDLP_MIN_VERSION", ""),
+        YtDLPMinVersionEnforce: getEnvBool("YTDLP_MIN_VERSION_ENFORCE", false),
+        ShutdownTimeout:        getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+        StatsSampleInterval: getEnvDuration("STATS_SAMPLE_INTERVAL", 5*time.Second),
+        StatsHistorySize:    getEnvInt("STATS_HISTORY_SIZE", 720),
+        IdempotencyTTL:    getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour),
+        MaxRequestBodyBytes: getEnvInt64("MAX_REQUEST_BODY_BYTES", 64<<10),
+        MaxUploadBytes:    getEnvInt64("MAX_UPLOAD_BYTES", 200<<20),
+        DevMode:           getEnvBool("DEV_MODE", false),
+        SyncWaitTimeout:   getEnvDuration("SYNC_WAIT_TIMEOUT", 60*time.Second),
+        StoreTimeout:      getEnvDuration("STORE_TIMEOUT", 5*time.Second),
+        ProgressUpdateInterval: getEnvDuration("PROGRESS_UPDATE_INTERVAL", time.Second),
+        ProgressUpdateStep:     getEnvInt("PROGRESS_UPDATE_STEP", 5),
+
+        ReadHeaderTimeout: getEnvDuration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+        ReadTimeout:       getEnvDuration("SERVER_READ_TIMEOUT", 5*time.Minute),
+        WriteTimeout:      getEnvDuration("SERVER_WRITE_TIMEOUT", 0),
+        IdleTimeout:       getEnvDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+        H2C:               getEnvBool("H2C", false),
+	}
+	if err := cfg.LogLevel.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		cfg.LogLevel = slog.LevelInfo
+	}
+	if cfg.ReadHeaderTimeout <= 0 {
+		cfg.ReadHeaderTimeout = 10 * time.Second
+	}
+	if cfg.CleanupInterval <= 0 {
+		cfg.CleanupInterval = time.Minute
 	}
+	if cfg.ReadyProbeInterval <= 0 {
+		cfg.ReadyProbeInterval = 30 * time.Second
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 10 * time.Second
+	}
+	if cfg.StatsSampleInterval <= 0 {
+		cfg.StatsSampleInterval = 5 * time.Second
+	}
+	if cfg.StoreTimeout <= 0 {
+		cfg.StoreTimeout = 5 * time.Second
+	}
+	cfg.DownloadWorkers = getEnvInt("DOWNLOAD_WORKERS", cfg.WorkerPoolSize)
+	cfg.ConvertWorkers = getEnvInt("CONVERT_WORKERS", cfg.WorkerPoolSize)
 	return cfg
 }
 
@@ -232,3 +600,107 @@ func splitAndTrim(s string) []string {
 	}
 	return res
 }
+
+// parseBitrates parses "label:256k,..." into bitrates in kbps; the "k" is
+// optional. Entries without a positive bitrate are skipped.
+func parseBitrates(s string) map[string]int {
+	res := map[string]int{}
+	for k, v := range parsePairs(s) {
+		n, err := strconv.Atoi(strings.TrimSuffix(v, "k"))
+		if err != nil || n <= 0 {
+			continue
+		}
+		res[k] = n
+	}
+	return res
+}
+
+// parsePairs parses "k1:v1,k2:v2" into a map. Entries without a colon or
+// with an empty key are skipped; values are lowercased.
+func parsePairs(s string) map[string]string {
+	res := map[string]string{}
+	for _, p := range splitAndTrim(s) {
+		k, v, ok := strings.Cut(p, ":")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			continue
+		}
+		res[k] = strings.ToLower(strings.TrimSpace(v))
+	}
+	return res
+}
+
+// systemDirs are locations CONVERSIONS_DIR must not point at: the worker
+// pools write and the cleanup deletes files beneath it.
+var systemDirs = map[string]struct{}{
+	"/": {}, "/bin": {}, "/boot": {}, "/dev": {}, "/etc": {}, "/lib": {}, "/lib64": {},
+	"/proc": {}, "/root": {}, "/run": {}, "/sbin": {}, "/sys": {}, "/usr": {}, "/var": {},
+}
+
+// Validate reports settings that would otherwise fail silently at startup or
+// request time: a missing or system CONVERSIONS_DIR, worker pools smaller
+// than 1, an unknown QUEUE_STRATEGY, an empty QUALITY_BITRATE_MAP, and
+// metadata endpoints that are set but not absolute http(s) URLs.
+func (c *Config) Validate() error {
+	dir, err := filepath.Abs(c.ConversionsDir)
+	if c.ConversionsDir == "" || err != nil {
+		return fmt.Errorf("CONVERSIONS_DIR: %q is not a usable path", c.ConversionsDir)
+	}
+	if _, ok := systemDirs[dir]; ok {
+		return fmt.Errorf("CONVERSIONS_DIR: refusing to use system directory %s; point it at a dedicated subdirectory", dir)
+	}
+	for name, n := range map[string]int{"DOWNLOAD_WORKERS": c.DownloadWorkers, "CONVERT_WORKERS": c.ConvertWorkers} {
+		if n < 1 {
+			return fmt.Errorf("%s: %d workers would leave its queue unserved; use at least 1", name, n)
+		}
+	}
+	if c.QueueStrategy != "priority" && c.QueueStrategy != "fifo" {
+		return fmt.Errorf("QUEUE_STRATEGY: %q is not priority or fifo", c.QueueStrategy)
+	}
+	if len(c.QualityBitrates) == 0 {
+		return fmt.Errorf("QUALITY_BITRATE_MAP: no valid label:bitrate entries")
+	}
+	for name, v := range map[string]string{"OEMBED_ENDPOINT": c.OEmbedEndpoint, "DURATION_API_ENDPOINT": c.DurationAPIEndpoint} {
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s: %q is not an absolute http(s) URL", name, v)
+		}
+	}
+	return nil
+}
+
+// Redacted returns the configuration keyed by field name for display, with
+// durations and log levels as strings. Fields tagged `secret:"true"` are
+// replaced by "[redacted]" when set, so a secret added later only needs the
+// tag to stay hidden.
+func (c *Config) Redacted() map[string]any {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	out := make(map[string]any, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		switch x := fv.Interface().(type) {
+		case time.Duration:
+			out[f.Name] = x.String()
+		case slog.Level:
+			out[f.Name] = x.String()
+		default:
+			if f.Tag.Get("secret") == "true" && !fv.IsZero() {
+				out[f.Name] = "[redacted]"
+				continue
+			}
+			out[f.Name] = x
+		}
+	}
+	return out
+}
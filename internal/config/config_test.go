@@ -0,0 +1,31 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateWorkers(t *testing.T) {
+	tests := []struct {
+		name     string
+		download string
+		convert  string
+		wantErr  string
+	}{
+		{name: "defaults", wantErr: ""},
+		{name: "split pools", download: "4", convert: "2", wantErr: ""},
+		{name: "no download workers", download: "0", wantErr: "DOWNLOAD_WORKERS"},
+		{name: "negative convert workers", convert: "-1", wantErr: "CONVERT_WORKERS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONVERSIONS_DIR", t.TempDir())
+			t.Setenv("DOWNLOAD_WORKERS", tt.download)
+			t.Setenv("CONVERT_WORKERS", tt.convert)
+			err := Load().Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Validate() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
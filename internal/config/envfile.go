@@ -0,0 +1,78 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// fileEnv remembers, for each variable set by LoadEnvFile, the process
+// environment's own value so a later load can restore it when the file no
+// longer sets the variable.
+var (
+	fileEnvMu sync.Mutex
+	fileEnv   = map[string]*string{}
+)
+
+// LoadEnvFile sets environment variables from a file of KEY=VALUE lines so
+// Load picks them up. Blank lines, "#" comments and an "export " prefix are
+// allowed, and values may be wrapped in single or double quotes. Values from
+// the file override the process environment. Calling it again (e.g. on
+// SIGHUP) applies the file's current contents, restoring the environment's
+// value for variables the file no longer sets. Nothing is changed when the
+// file can't be read or parsed.
+func LoadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	vars := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		vars[k] = v
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	fileEnvMu.Lock()
+	defer fileEnvMu.Unlock()
+	for k, orig := range fileEnv {
+		if _, ok := vars[k]; ok {
+			continue
+		}
+		if orig == nil {
+			os.Unsetenv(k)
+		} else {
+			os.Setenv(k, *orig)
+		}
+		delete(fileEnv, k)
+	}
+	for k, v := range vars {
+		if _, tracked := fileEnv[k]; !tracked {
+			var orig *string
+			if cur, ok := os.LookupEnv(k); ok {
+				orig = &cur
+			}
+			fileEnv[k] = orig
+		}
+		os.Setenv(k, v)
+	}
+	return nil
+}
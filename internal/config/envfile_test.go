@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "env")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("YTMP3_TEST_KEEP", "env")
+	t.Setenv("YTMP3_TEST_OVERRIDE", "env")
+	os.Unsetenv("YTMP3_TEST_NEW")
+	t.Cleanup(func() { os.Unsetenv("YTMP3_TEST_NEW") })
+
+	write("# comment\n\nexport YTMP3_TEST_OVERRIDE=\"file value\"\nYTMP3_TEST_NEW='x'\n")
+	if err := LoadEnvFile(path); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ key, want string }{
+		{"YTMP3_TEST_KEEP", "env"},
+		{"YTMP3_TEST_OVERRIDE", "file value"},
+		{"YTMP3_TEST_NEW", "x"},
+	}
+	for _, tt := range tests {
+		if got := os.Getenv(tt.key); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+
+	// Dropping variables from the file restores the environment's values
+	write("YTMP3_TEST_KEEP=file\n")
+	if err := LoadEnvFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("YTMP3_TEST_OVERRIDE"); got != "env" {
+		t.Errorf("YTMP3_TEST_OVERRIDE = %q after removal, want env", got)
+	}
+	if _, ok := os.LookupEnv("YTMP3_TEST_NEW"); ok {
+		t.Errorf("YTMP3_TEST_NEW still set after removal from the file")
+	}
+	if got := os.Getenv("YTMP3_TEST_KEEP"); got != "file" {
+		t.Errorf("YTMP3_TEST_KEEP = %q, want file", got)
+	}
+
+	write("not a pair\n")
+	if err := LoadEnvFile(path); err == nil {
+		t.Errorf("malformed line accepted")
+	}
+	if got := os.Getenv("YTMP3_TEST_KEEP"); got != "file" {
+		t.Errorf("failed load changed YTMP3_TEST_KEEP to %q", got)
+	}
+}
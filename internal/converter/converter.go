@@ -9,17 +9,35 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"ytmp3api/internal/util"
 )
 
+// ProgressFunc receives conversion progress in percent, or ProgressUnknown
+// as a periodic heartbeat while the duration needed for a percentage is
+// unknown.
 type ProgressFunc func(pct int)
 
+// ProgressUnknown is reported instead of a percentage when the source
+// duration is unknown, so callers can tell a running conversion from a hung
+// one.
+const ProgressUnknown = -1
+
+// heartbeatInterval spaces ProgressUnknown reports.
+const heartbeatInterval = 5 * time.Second
+
 type Mode string
 
 const (
 	ModeCBR Mode = "CBR"
 	ModeVBR Mode = "VBR"
+	// ModeABR is reported for AAC outputs, which always target a bitrate.
+	ModeABR Mode = "ABR"
 )
 
+// FormatM4A selects AAC in an MP4 container instead of MP3.
+const FormatM4A = "m4a"
+
 type Config struct {
 	MinTimeout time.Duration
 	MaxTimeout time.Duration
@@ -27,6 +45,11 @@ type Config struct {
 	CBRBitrate string
 	VBRQ       int
 	Threads    int
+	// Priority runs ffmpeg under nice/ionice.
+	Priority util.Priority
+	// QualityBitrates maps quality labels to bitrates in kbps. Unknown
+	// labels encode at CBRBitrate.
+	QualityBitrates map[string]int
 }
 
 type Converter struct {
@@ -38,43 +61,80 @@ func New(cfg Config, maxConcurrent int) *Converter {
 	return &Converter{cfg: cfg, sem: make(chan struct{}, maxConcurrent)}
 }
 
-func (c *Converter) withPermit(fn func() error) error {
-	c.sem <- struct{}{}
+// vbrKbps approximates the average bitrate LAME produces for each -q:a level.
+var vbrKbps = [10]int{245, 225, 190, 175, 165, 130, 115, 100, 85, 65}
+
+// BitrateKbps returns the nominal bitrate an output at the given quality will
+// be encoded with. In VBR mode this is LAME's typical average for VBRQ.
+func (c *Converter) BitrateKbps(quality string) int {
+	if c.cfg.Mode != ModeCBR {
+		q := c.cfg.VBRQ
+		if q < 0 {
+			q = 0
+		}
+		if q > 9 {
+			q = 9
+		}
+		return vbrKbps[q]
+	}
+	return c.targetKbps(quality)
+}
+
+// targetKbps returns the bitrate mapped to the quality label, or CBRBitrate
+// for an empty or unknown label.
+func (c *Converter) targetKbps(quality string) int {
+	if n, ok := c.cfg.QualityBitrates[quality]; ok && quality != "" {
+		return n
+	}
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.ToLower(c.cfg.CBRBitrate), "k"))
+	return n
+}
+
+// withPermit runs fn while holding a concurrency permit. Waiting for a permit
+// is abandoned with ctx's error if ctx is done first.
+func (c *Converter) withPermit(ctx context.Context, fn func() error) error {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	defer func() { <-c.sem }()
 	return fn()
 }
 
-func (c *Converter) Convert(ctx context.Context, inputPath, outputPath string, quality string, start, end string, durationSeconds int, onProgress ProgressFunc) error {
-	return c.withPermit(func() error {
+// Options are the per-request encoding parameters for a conversion.
+type Options struct {
+	// Quality is a label of Config.QualityBitrates; empty uses the configured
+	// default. Ignored in VBR mode.
+	Quality string
+	// Start and End bound the clip in any format ffmpeg accepts for -ss/-to.
+	Start string
+	End   string
+	// SampleRate (Hz) and Channels override the source's native values when
+	// non-zero.
+	SampleRate int
+	Channels   int
+	// Precise seeks after decoding (-ss/-to after -i) for sample-accurate
+	// clip boundaries. It is slower, since ffmpeg decodes everything before
+	// Start, whereas the default input seek is fast but may start slightly
+	// off for some containers.
+	Precise bool
+	// Format is "m4a" for AAC output; anything else encodes MP3. AAC always
+	// targets a bitrate (Quality or CBRBitrate), even in VBR mode.
+	Format string
+	// Normalize applies single-pass EBU R128 loudness normalization.
+	Normalize bool
+}
+
+func (c *Converter) Convert(ctx context.Context, inputPath, outputPath string, opts Options, durationSeconds int, onProgress ProgressFunc) error {
+	return c.withPermit(ctx, func() error {
 		timeout := c.cfg.MaxTimeout
 		ctx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
 
-		args := []string{"-y"}
-		if start != "" {
-			args = append(args, "-ss", start)
-		}
-		if end != "" {
-			args = append(args, "-to", end)
-		}
-		args = append(args, "-i", inputPath, "-vn", "-acodec", "libmp3lame")
-		if c.cfg.Mode == ModeCBR {
-			// quality is expected like 128/192/320; append 'k'
-			br := c.cfg.CBRBitrate
-			if quality != "" {
-				br = quality + "k"
-			}
-			args = append(args, "-b:a", br)
-		} else {
-			q := fmt.Sprintf("%d", c.cfg.VBRQ)
-			args = append(args, "-q:a", q)
-		}
-		if c.cfg.Threads > 0 {
-			args = append(args, "-threads", fmt.Sprintf("%d", c.cfg.Threads))
-		}
-		args = append(args, "-progress", "pipe:1", "-nostats", "-loglevel", "error", outputPath)
+		args := c.ffmpegArgs(inputPath, outputPath, opts)
 
-		cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+		cmd := c.cfg.Priority.Command(ctx, "ffmpeg", args...)
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
 			return err
@@ -86,29 +146,208 @@ func (c *Converter) Convert(ctx context.Context, inputPath, outputPath string, q
 		if err := cmd.Start(); err != nil {
 			return err
 		}
-		go func() { io.Copy(io.Discard, stderr) }()
-		scanner := bufio.NewScanner(stdout)
-		var lastPct int
-		for scanner.Scan() {
-			line := scanner.Text()
-			if strings.HasPrefix(line, "out_time_ms=") {
-				v := strings.TrimPrefix(line, "out_time_ms=")
-				ms, _ := strconv.ParseFloat(v, 64)
-				if durationSeconds > 0 {
-					pct := int((ms / 1000000.0) / float64(durationSeconds) * 100.0)
-					if pct < 0 {
-						pct = 0
-					}
-					if pct > 100 {
-						pct = 100
-					}
-					if pct != lastPct {
-						lastPct = pct
-						onProgress(pct)
-					}
-				}
+		// Keep the tail of stderr to explain failures
+		errTail := &tailBuffer{max: 4 << 10}
+		stderrDone := make(chan struct{})
+		go func() {
+			io.Copy(errTail, stderr)
+			close(stderrDone)
+		}()
+		scanProgress(stdout, durationSeconds, heartbeatInterval, onProgress)
+		// Drain anything the scanner left so ffmpeg can't block on stdout
+		io.Copy(io.Discard, stdout)
+		<-stderrDone
+		if err := cmd.Wait(); err != nil {
+			if ctx.Err() != nil {
+				return err
 			}
+			return classify(err, errTail.String())
 		}
-		return cmd.Wait()
+		return nil
 	})
 }
+
+// scanProgress reads ffmpeg's -progress output from r, reporting each change
+// of percentage to onProgress. With no duration to compute a percentage it
+// reports ProgressUnknown instead, at most once per beat.
+func scanProgress(r io.Reader, durationSeconds int, beat time.Duration, onProgress ProgressFunc) {
+	scanner := bufio.NewScanner(r)
+	var lastPct int
+	var lastBeat time.Time
+	for scanner.Scan() {
+		line := scanner.Text()
+		// ffmpeg ends each progress block with progress=continue; with
+		// no duration to compute a percentage, forward those as
+		// heartbeats instead
+		if durationSeconds <= 0 && line == "progress=continue" && time.Since(lastBeat) >= beat {
+			lastBeat = time.Now()
+			onProgress(ProgressUnknown)
+			continue
+		}
+		if strings.HasPrefix(line, "out_time_ms=") {
+			v := strings.TrimPrefix(line, "out_time_ms=")
+			ms, _ := strconv.ParseFloat(v, 64)
+			if durationSeconds > 0 {
+				pct := int((ms / 1000000.0) / float64(durationSeconds) * 100.0)
+				if pct < 0 {
+					pct = 0
+				}
+				if pct > 100 {
+					pct = 100
+				}
+				if pct != lastPct {
+					lastPct = pct
+					onProgress(pct)
+				}
+			}
+		}
+	}
+}
+
+// ffmpegArgs builds the ffmpeg command line converting inputPath into
+// outputPath with opts.
+func (c *Converter) ffmpegArgs(inputPath, outputPath string, opts Options) []string {
+	args := []string{"-y"}
+	var clip []string
+	if opts.Start != "" {
+		clip = append(clip, "-ss", opts.Start)
+	}
+	if opts.End != "" {
+		clip = append(clip, "-to", opts.End)
+	}
+	if !opts.Precise {
+		args = append(args, clip...)
+	}
+	args = append(args, "-i", inputPath)
+	if opts.Precise {
+		args = append(args, clip...)
+	}
+	br := c.cfg.CBRBitrate
+	if n, ok := c.cfg.QualityBitrates[opts.Quality]; ok && opts.Quality != "" {
+		br = strconv.Itoa(n) + "k"
+	}
+	switch {
+	case opts.Format == FormatM4A:
+		args = append(args, "-vn", "-acodec", "aac", "-b:a", br, "-movflags", "+faststart")
+	case c.cfg.Mode == ModeCBR:
+		args = append(args, "-vn", "-acodec", "libmp3lame", "-b:a", br)
+	default:
+		q := fmt.Sprintf("%d", c.cfg.VBRQ)
+		args = append(args, "-vn", "-acodec", "libmp3lame", "-q:a", q)
+	}
+	if opts.Normalize {
+		args = append(args, "-af", "loudnorm=I=-16:TP=-1.5:LRA=11")
+	}
+	if opts.SampleRate > 0 {
+		args = append(args, "-ar", strconv.Itoa(opts.SampleRate))
+	}
+	if opts.Channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(opts.Channels))
+	}
+	if c.cfg.Threads > 0 {
+		args = append(args, "-threads", fmt.Sprintf("%d", c.cfg.Threads))
+	}
+	args = append(args, "-progress", "pipe:1", "-nostats", "-loglevel", "error", outputPath)
+	return args
+}
+
+// ProbeAudio checks with ffprobe that path contains an audio stream and
+// returns its duration in whole seconds (0 if ffprobe reports none).
+func ProbeAudio(ctx context.Context, path string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=codec_type:format=duration", "-of", "default=noprint_wrappers=1", path).Output()
+	if err != nil {
+		return 0, ErrCorruptSource
+	}
+	var audio bool
+	var dur float64
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch k {
+		case "codec_type":
+			audio = audio || v == "audio"
+		case "duration":
+			dur, _ = strconv.ParseFloat(v, 64)
+		}
+	}
+	if !audio {
+		return 0, ErrNoAudioStream
+	}
+	return int(dur), nil
+}
+
+// Encoding describes the settings an output was encoded with.
+type Encoding struct {
+	Mode        Mode
+	BitrateKbps int
+	// VBRQ is the LAME -q:a level; only meaningful in VBR mode.
+	VBRQ       int
+	SampleRate int
+	Channels   int
+}
+
+// Describe reports the encoding of an output produced with opts. Outside CBR
+// mode the bitrate is the file's actual average as measured by ffprobe. Sample
+// rate and channels come from the file too; if probing fails only the
+// configured values are filled in.
+func (c *Converter) Describe(ctx context.Context, outputPath string, opts Options) Encoding {
+	enc := Encoding{Mode: ModeVBR, BitrateKbps: c.BitrateKbps(opts.Quality)}
+	switch {
+	case opts.Format == FormatM4A:
+		enc.Mode = ModeABR
+		enc.BitrateKbps = c.targetKbps(opts.Quality)
+	case c.cfg.Mode == ModeCBR:
+		enc.Mode = ModeCBR
+	default:
+		enc.VBRQ = c.cfg.VBRQ
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-select_streams", "a:0",
+		"-show_entries", "stream=sample_rate,channels:format=bit_rate", "-of", "default=noprint_wrappers=1", outputPath).Output()
+	if err != nil {
+		return enc
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, _ := strings.Cut(strings.TrimSpace(line), "=")
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		switch k {
+		case "sample_rate":
+			enc.SampleRate = n
+		case "channels":
+			enc.Channels = n
+		case "bit_rate":
+			if enc.Mode != ModeCBR && n > 0 {
+				enc.BitrateKbps = (n + 500) / 1000
+			}
+		}
+	}
+	return enc
+}
+
+// Encoders lists the audio encoders the installed ffmpeg provides, parsed
+// from `ffmpeg -encoders`.
+func Encoders(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return nil, err
+	}
+	enc := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// Entries look like " A....D libmp3lame  libmp3lame MP3 ..."; the
+		// legend above them has "=" in the name column
+		f := strings.Fields(line)
+		if len(f) < 2 || len(f[0]) != 6 || f[0][0] != 'A' || strings.Contains(f[1], "=") {
+			continue
+		}
+		enc[f[1]] = true
+	}
+	return enc, nil
+}
@@ -0,0 +1,76 @@
+package converter
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFFmpegArgsSeekOrder(t *testing.T) {
+	c := New(Config{Mode: ModeCBR, CBRBitrate: "192k"}, 1)
+	tests := []struct {
+		name   string
+		opts   Options
+		before []string
+		after  []string
+		noClip bool
+	}{
+		{name: "fast seek", opts: Options{Start: "10", End: "20"}, before: []string{"-ss", "10", "-to", "20"}},
+		{name: "precise seek", opts: Options{Start: "10", End: "20", Precise: true}, after: []string{"-ss", "10", "-to", "20"}},
+		{name: "precise start only", opts: Options{Start: "5", Precise: true}, after: []string{"-ss", "5"}},
+		{name: "no clip", opts: Options{Precise: true}, noClip: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := c.ffmpegArgs("in.webm", "out.mp3", tt.opts)
+			i := slices.Index(args, "-i")
+			if i < 0 || args[i+1] != "in.webm" {
+				t.Fatalf("no input in %v", args)
+			}
+			if tt.noClip {
+				if slices.Contains(args, "-ss") || slices.Contains(args, "-to") {
+					t.Errorf("unexpected clip args in %v", args)
+				}
+				return
+			}
+			if tt.before != nil && !slices.Equal(args[i-len(tt.before):i], tt.before) {
+				t.Errorf("args before -i = %v, want %v", args[:i], tt.before)
+			}
+			if tt.after != nil && !slices.Equal(args[i+2:i+2+len(tt.after)], tt.after) {
+				t.Errorf("args after -i = %v, want %v", args[i+2:], tt.after)
+			}
+			if tt.before == nil && slices.Contains(args[:i], "-ss") {
+				t.Errorf("-ss before -i in precise mode: %v", args)
+			}
+		})
+	}
+}
+
+func TestScanProgress(t *testing.T) {
+	block := func(outMs string) string {
+		return "out_time_ms=" + outMs + "\nprogress=continue\n"
+	}
+	tests := []struct {
+		name     string
+		output   string
+		duration int
+		beat     time.Duration
+		want     []int
+	}{
+		{name: "percentages", output: block("2500000") + block("5000000") + block("5000000") + block("10000000"), duration: 10, want: []int{25, 50, 100}},
+		{name: "clamped past duration", output: block("12000000"), duration: 10, want: []int{100}},
+		{name: "unknown duration heartbeats", output: block("1000000") + block("2000000") + block("3000000"), duration: 0, beat: 0, want: []int{ProgressUnknown, ProgressUnknown, ProgressUnknown}},
+		{name: "heartbeats throttled", output: block("1000000") + block("2000000") + block("3000000"), duration: 0, beat: time.Hour, want: []int{ProgressUnknown}},
+		{name: "no heartbeat with duration", output: "progress=continue\nprogress=end\n", duration: 10, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			scanProgress(strings.NewReader(tt.output), tt.duration, tt.beat, func(pct int) { got = append(got, pct) })
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("reports = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package converter
+
+import (
+	"errors"
+	"strings"
+)
+
+// Classified ffmpeg failures. Convert wraps them in *FFmpegError, so use
+// errors.Is to test for a kind.
+var (
+	ErrNoAudioStream    = errors.New("source has no audio stream")
+	ErrInvalidDuration  = errors.New("invalid start/end time for this source")
+	ErrCorruptSource    = errors.New("source file is corrupt or unreadable")
+	ErrUnsupportedCodec = errors.New("source codec is not supported")
+	ErrDiskFull         = errors.New("server disk is full")
+)
+
+// FFmpegError is a failed ffmpeg run. Kind is one of the Err* values above
+// when the failure was recognised, and Detail is the last line ffmpeg wrote
+// to stderr. Detail often names server paths, so Error leaves it out; log it
+// with Detail instead.
+type FFmpegError struct {
+	Kind   error
+	Detail string
+	Err    error
+}
+
+func (e *FFmpegError) Error() string {
+	if e.Kind != nil {
+		return e.Kind.Error()
+	}
+	return "ffmpeg failed"
+}
+
+func (e *FFmpegError) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// Detail returns the ffmpeg stderr detail of err for logging, or "" if err
+// is not an *FFmpegError.
+func Detail(err error) string {
+	var fe *FFmpegError
+	if errors.As(err, &fe) {
+		return fe.Detail
+	}
+	return ""
+}
+
+// Permanent reports whether err is a conversion failure that retrying with
+// the same source and options cannot fix.
+func Permanent(err error) bool {
+	return errors.Is(err, ErrNoAudioStream) || errors.Is(err, ErrInvalidDuration) ||
+		errors.Is(err, ErrCorruptSource) || errors.Is(err, ErrUnsupportedCodec)
+}
+
+// stderrPatterns map substrings of ffmpeg's stderr to failure kinds, checked
+// in order.
+var stderrPatterns = []struct {
+	substr string
+	kind   error
+}{
+	{"no space left on device", ErrDiskFull},
+	{"does not contain any stream", ErrNoAudioStream},
+	{"matches no streams", ErrNoAudioStream},
+	{"invalid duration specification", ErrInvalidDuration},
+	{"invalid data found when processing input", ErrCorruptSource},
+	{"moov atom not found", ErrCorruptSource},
+	{"decoder not found", ErrUnsupportedCodec},
+	{"unknown decoder", ErrUnsupportedCodec},
+	{"not currently supported", ErrUnsupportedCodec},
+}
+
+// classify turns a failed ffmpeg run into an *FFmpegError using its stderr.
+func classify(err error, stderr string) error {
+	lower := strings.ToLower(stderr)
+	fe := &FFmpegError{Err: err, Detail: lastLine(stderr)}
+	for _, p := range stderrPatterns {
+		if strings.Contains(lower, p.substr) {
+			fe.Kind = p.kind
+			break
+		}
+	}
+	return fe
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i != -1 {
+		s = s[i+1:]
+	}
+	return strings.TrimSpace(s)
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string { return string(t.buf) }
@@ -0,0 +1,43 @@
+package converter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	exit := errors.New("exit status 1")
+	tests := []struct {
+		name   string
+		stderr string
+		kind   error
+		msg    string
+	}{
+		{name: "no audio", stderr: "/srv/data/streams/abc.webm: Output file #0 does not contain any stream\n", kind: ErrNoAudioStream, msg: ErrNoAudioStream.Error()},
+		{name: "disk full", stderr: "av_interleaved_write_frame(): No space left on device", kind: ErrDiskFull, msg: ErrDiskFull.Error()},
+		{name: "corrupt", stderr: "/srv/data/streams/abc.webm: Invalid data found when processing input", kind: ErrCorruptSource, msg: ErrCorruptSource.Error()},
+		{name: "bad time", stderr: "Invalid duration specification for ss: abc", kind: ErrInvalidDuration, msg: ErrInvalidDuration.Error()},
+		{name: "unrecognised", stderr: "/srv/data/streams/abc.webm: something odd", kind: nil, msg: "ffmpeg failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classify(exit, tt.stderr)
+			if tt.kind != nil && !errors.Is(err, tt.kind) {
+				t.Errorf("errors.Is(%v, %v) = false", err, tt.kind)
+			}
+			if !errors.Is(err, exit) {
+				t.Errorf("exit error not wrapped")
+			}
+			if err.Error() != tt.msg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tt.msg)
+			}
+			if strings.Contains(err.Error(), "/srv") {
+				t.Errorf("Error() leaks stderr: %q", err.Error())
+			}
+			if Detail(err) != lastLine(tt.stderr) {
+				t.Errorf("Detail = %q, want %q", Detail(err), lastLine(tt.stderr))
+			}
+		})
+	}
+}
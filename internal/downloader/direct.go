@@ -0,0 +1,369 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ytmp3api/internal/util"
+)
+
+// isDirect reports whether rawURL is served by one of the DirectHosts, whose
+// media is fetched over plain HTTP instead of through yt-dlp.
+func (d *Downloader) isDirect(rawURL string) bool {
+	return len(d.cfg.DirectHosts) > 0 && util.IsAllowedDomain(rawURL, d.cfg.DirectHosts)
+}
+
+// checkMediaRedirect stops a direct download from following a redirect
+// into loopback, private or link-local address ranges, so an allowed host
+// can't point the server at internal services.
+func checkMediaRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	host := req.URL.Hostname()
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+		if err != nil {
+			return err
+		}
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if internalIP(ip) {
+			return fmt.Errorf("%w: redirect to internal address %s", ErrUnavailable, host)
+		}
+	}
+	return nil
+}
+
+func internalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// tooLarge reports a direct download whose size exceeds MaxDirectBytes.
+func (d *Downloader) tooLarge(size int64) error {
+	if d.cfg.MaxDirectBytes > 0 && size > d.cfg.MaxDirectBytes {
+		return fmt.Errorf("%w: direct download exceeds %d bytes", ErrUnavailable, d.cfg.MaxDirectBytes)
+	}
+	return nil
+}
+
+// minPartBytes is the smallest range worth its own connection; smaller files
+// are fetched as a single stream.
+const minPartBytes = 4 << 20
+
+// downloadHTTP fetches rawURL into outputPath. With DirectConcurrency above
+// 1 and a server that honors ranges, large files are fetched as parallel
+// ranged GETs; otherwise, or if that fails, as a single stream.
+func (d *Downloader) downloadHTTP(ctx context.Context, rawURL, outputPath string, onProgress func(int)) error {
+	if d.cfg.DirectConcurrency > 1 {
+		if size, ok := d.rangeSize(ctx, rawURL); ok && size >= 2*minPartBytes {
+			if err := d.tooLarge(size); err != nil {
+				return err
+			}
+			err := d.downloadParts(ctx, rawURL, outputPath, size, onProgress)
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			// Servers may stop honoring ranges mid-download (or cap
+			// connections); a single stream still works against those
+		}
+	}
+	return d.downloadStream(ctx, rawURL, outputPath, onProgress)
+}
+
+// rangeSize asks for the first byte of rawURL and reports the total size
+// when the server answers with a proper partial response.
+func (d *Downloader) rangeSize(ctx context.Context, rawURL string) (int64, bool) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := d.media.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, false
+	}
+	start, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	return total, ok && start == 0 && total > 0
+}
+
+// parseContentRange parses "bytes START-END/TOTAL"; an unknown total ("*")
+// is reported as not ok.
+func parseContentRange(v string) (start, end, total int64, ok bool) {
+	rest, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, size, found := strings.Cut(rest, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	s, e, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	start, err1 = strconv.ParseInt(s, 10, 64)
+	end, err2 = strconv.ParseInt(e, 10, 64)
+	total, err3 = strconv.ParseInt(size, 10, 64)
+	return start, end, total, err1 == nil && err2 == nil && err3 == nil
+}
+
+// downloadParts splits size bytes into DirectConcurrency ranges fetched in
+// parallel, each written at its offset of a preallocated ".parts" file that
+// becomes outputPath once every range is complete. Progress is the sum of
+// all ranges, reported from a single goroutine. Any range failing, or
+// answered without a matching partial response, cancels the rest and
+// removes the file.
+func (d *Downloader) downloadParts(ctx context.Context, rawURL, outputPath string, size int64, onProgress func(int)) error {
+	tmp := outputPath + ".parts"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(tmp)
+		}
+	}()
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	n := int64(d.cfg.DirectConcurrency)
+	if max := size / minPartBytes; n > max {
+		n = max
+	}
+	chunk := (size + n - 1) / n
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		done     atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() { firstErr = err; cancel() })
+	}
+	for start := int64(0); start < size; start += chunk {
+		end := min(start+chunk, size) - 1
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := d.fetchRange(ctx, rawURL, f, start, end, &done); err != nil {
+				fail(err)
+			}
+		}(start, end)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-finished:
+			waiting = false
+		case <-ticker.C:
+			onProgress(int(done.Load() * 100 / size))
+		}
+	}
+	if cerr := f.Close(); firstErr == nil {
+		firstErr = cerr
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := os.Rename(tmp, outputPath); err != nil {
+		return err
+	}
+	ok = true
+	onProgress(100)
+	return nil
+}
+
+// fetchRange writes bytes start..end (inclusive) of rawURL at the same offset
+// of f, adding each chunk read to done.
+func (d *Downloader) fetchRange(ctx context.Context, rawURL string, f *os.File, start, end int64, done *atomic.Int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := d.media.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("direct download: range %d-%d: HTTP %d", start, end, resp.StatusCode)
+	}
+	if s, e, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || s != start || e != end {
+		return fmt.Errorf("direct download: range %d-%d answered with %q", start, end, resp.Header.Get("Content-Range"))
+	}
+	want := end - start + 1
+	n, err := io.Copy(io.NewOffsetWriter(f, start), &countingReader{r: io.LimitReader(resp.Body, want), n: done})
+	if err != nil {
+		return err
+	}
+	if n != want {
+		return fmt.Errorf("direct download: range %d-%d: got %d of %d bytes", start, end, n, want)
+	}
+	return nil
+}
+
+// countingReader adds the bytes read through it to n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// downloadStream fetches rawURL into outputPath over one connection. Bytes
+// land in a ".part" file first; if one is left over from an earlier attempt
+// the download resumes with a Range request, falling back to a full fetch
+// when the server ignores it. Progress is reported from Content-Length when
+// the server sends one.
+func (d *Downloader) downloadStream(ctx context.Context, rawURL, outputPath string, onProgress func(int)) error {
+	part := outputPath + ".part"
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.media.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The part file already holds the whole body
+		return os.Rename(part, outputPath)
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		offset = 0
+		flags |= os.O_TRUNC
+	default:
+		return fmt.Errorf("direct download: HTTP %d", resp.StatusCode)
+	}
+	f, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+		if err := d.tooLarge(total); err != nil {
+			f.Close()
+			os.Remove(part)
+			return err
+		}
+	}
+	// Without a Content-Length the cap is enforced while reading: one byte
+	// past it is enough to tell
+	var body io.Reader = resp.Body
+	if d.cfg.MaxDirectBytes > 0 {
+		body = io.LimitReader(resp.Body, d.cfg.MaxDirectBytes-offset+1)
+	}
+	n, err := io.Copy(f, &progressReader{r: body, n: offset, total: total, onProgress: onProgress})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if err = d.tooLarge(offset + n); err != nil {
+			os.Remove(part)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	onProgress(100)
+	return os.Rename(part, outputPath)
+}
+
+// progressReader reports the percentage of total read so far. A negative
+// total means the size is unknown and nothing is reported.
+type progressReader struct {
+	r          io.Reader
+	n, total   int64
+	onProgress func(int)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if p.total > 0 && n > 0 {
+		p.onProgress(int(p.n * 100 / p.total))
+	}
+	return n, err
+}
+
+// directMetadata describes a directly hosted file: its name stands in for
+// the title and ffprobe reads the duration from the remote headers.
+func (d *Downloader) directMetadata(ctx context.Context, rawURL string) (Metadata, error) {
+	m := Metadata{}
+	if u, err := url.Parse(rawURL); err == nil {
+		name := path.Base(u.Path)
+		m.Title = strings.TrimSuffix(name, path.Ext(name))
+	}
+	dur, err := d.probeDuration(ctx, rawURL)
+	m.Duration = dur
+	return m, err
+}
+
+func (d *Downloader) probeDuration(ctx context.Context, rawURL string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.YtDLPTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", rawURL).Output()
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, err
+	}
+	return int(f), nil
+}
@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckMediaRedirect(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		wantErr bool
+	}{
+		{name: "public", target: "http://93.184.216.34/a.mp4", wantErr: false},
+		{name: "loopback", target: "http://127.0.0.1:8080/a.mp4", wantErr: true},
+		{name: "private", target: "http://10.0.0.5/a.mp4", wantErr: true},
+		{name: "metadata service", target: "http://169.254.169.254/latest/meta-data/", wantErr: true},
+		{name: "unspecified", target: "http://0.0.0.0/a.mp4", wantErr: true},
+		{name: "ipv6 loopback", target: "http://[::1]/a.mp4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			err := checkMediaRedirect(req, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkMediaRedirect(%s) = %v, wantErr %v", tt.target, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnavailable) {
+				t.Fatalf("err = %v, want ErrUnavailable", err)
+			}
+		})
+	}
+}
+
+func TestDirectDownloadRefusesInternalRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/a.mp4" {
+			http.Redirect(w, r, "http://127.0.0.1:1/secret", http.StatusFound)
+			return
+		}
+		w.Write([]byte("secret"))
+	}))
+	defer srv.Close()
+	d := New(Config{}, 1)
+	out := filepath.Join(t.TempDir(), "a.mp4")
+	err := d.downloadHTTP(context.Background(), srv.URL+"/a.mp4", out, func(int) {})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestDirectDownloadSizeCap(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	tests := []struct {
+		name    string
+		max     int64
+		chunked bool
+		wantErr bool
+	}{
+		{name: "no cap", max: 0, wantErr: false},
+		{name: "under cap", max: 100, wantErr: false},
+		{name: "over cap", max: 99, wantErr: true},
+		{name: "over cap without length", max: 99, chunked: true, wantErr: true},
+		{name: "under cap without length", max: 100, chunked: true, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.chunked {
+					w.(http.Flusher).Flush()
+				} else {
+					w.Header().Set("Content-Length", "100")
+				}
+				w.Write([]byte(body))
+			}))
+			defer srv.Close()
+			d := New(Config{MaxDirectBytes: tt.max}, 1)
+			out := filepath.Join(t.TempDir(), "a.mp4")
+			err := d.downloadHTTP(context.Background(), srv.URL+"/a.mp4", out, func(int) {})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("downloadHTTP() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrUnavailable) {
+					t.Fatalf("err = %v, want ErrUnavailable", err)
+				}
+				if _, serr := os.Stat(out + ".part"); !os.IsNotExist(serr) {
+					t.Fatal("part file left behind")
+				}
+				return
+			}
+			if b, _ := os.ReadFile(out); string(b) != body {
+				t.Fatalf("got %d bytes, want %d", len(b), len(body))
+			}
+		})
+	}
+}
@@ -12,9 +12,12 @@ import (
     "os/exec"
     "regexp"
     "strconv"
+    "fmt"
     "strings"
     "sync/atomic"
     "time"
+
+    "ytmp3api/internal/util"
 )
 
 // Example yt-dlp progress line:
@@ -24,41 +27,179 @@ var downloadPctRe = regexp.MustCompile(`(?i)\[download\]\s+(\d{1,3}(?:\.\d+)?)%`
 
 type ProgressFunc func(pct int)
 
+// ErrUnavailable is returned when yt-dlp reports that the video can't be
+// downloaded at all (removed, private or restricted), or a direct download
+// is refused (too large, or redirected to a private address), which
+// retrying won't change.
+var ErrUnavailable = errors.New("video unavailable")
+
+// unavailableMarkers are lowercase substrings of yt-dlp errors that mean
+// ErrUnavailable.
+var unavailableMarkers = []string{
+	"video unavailable",
+	"private video",
+	"this video is not available",
+	"has been removed",
+	"account associated with this video has been terminated",
+	"sign in to confirm your age",
+	"not available in your country",
+	"unsupported url",
+}
+
+// unavailableLine reports whether a yt-dlp stderr line means ErrUnavailable.
+func unavailableLine(line string) bool {
+	if !strings.HasPrefix(line, "ERROR:") {
+		return false
+	}
+	lower := strings.ToLower(line)
+	for _, m := range unavailableMarkers {
+		if strings.Contains(lower, m) {
+			return true
+		}
+	}
+	return false
+}
+
 type Config struct {
 	YtDLPTimeout        time.Duration
 	DownloadTimeout     time.Duration
 	OEmbedEndpoint      string
 	DurationAPIEndpoint string
+	// BreakerFailures consecutive failures open an endpoint's circuit
+	// breaker for BreakerCooldown. 0 disables the breakers.
+	BreakerFailures int
+	BreakerCooldown time.Duration
+	// HTTPTimeout bounds each metadata HTTP call (default 5s).
+	HTTPTimeout time.Duration
+	// Priority runs audio downloads under nice/ionice. Metadata lookups
+	// are on the request path and keep normal priority.
+	Priority util.Priority
+	// MaxConcurrentMetadata bounds concurrent FetchMetadata, FetchDuration
+	// and FetchChapters calls; callers beyond it wait for a permit. 0 means
+	// unbounded.
+	MaxConcurrentMetadata int
+	// DirectHosts are hosts (matched like ALLOWED_DOMAINS) whose URLs point
+	// straight at media files; those are fetched over HTTP, not yt-dlp.
+	DirectHosts []string
+	// DirectConcurrency is how many ranged GETs a direct download of a
+	// large file runs in parallel; 1 or less uses a single stream.
+	DirectConcurrency int
+	// MaxDirectBytes caps the size of a direct download; 0 means no cap.
+	MaxDirectBytes int64
 }
 
 type Downloader struct {
-	cfg Config
-	sem chan struct{}
+	cfg      Config
+	sem      chan struct{}
+	metaSem  chan struct{}
+	breakers map[string]*breaker
+	// client is shared by the metadata calls so connections (and TLS
+	// sessions) to the endpoints are reused.
+	client *http.Client
+	// media fetches direct downloads; it has no overall timeout, since
+	// those are bounded by DownloadTimeout instead.
+	media *http.Client
 }
 
 func New(cfg Config, maxConcurrent int) *Downloader {
-	return &Downloader{cfg: cfg, sem: make(chan struct{}, maxConcurrent)}
+	if cfg.HTTPTimeout <= 0 {
+		cfg.HTTPTimeout = 5 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 32
+	transport.IdleConnTimeout = 90 * time.Second
+	d := &Downloader{
+		cfg:      cfg,
+		sem:      make(chan struct{}, maxConcurrent),
+		breakers: map[string]*breaker{},
+		client:   &http.Client{Timeout: cfg.HTTPTimeout, Transport: transport},
+		media:    &http.Client{Transport: transport, CheckRedirect: checkMediaRedirect},
+	}
+	if cfg.MaxConcurrentMetadata > 0 {
+		d.metaSem = make(chan struct{}, cfg.MaxConcurrentMetadata)
+	}
+	for _, ep := range []string{cfg.OEmbedEndpoint, cfg.DurationAPIEndpoint} {
+		if ep != "" {
+			d.breakers[ep] = newBreaker(cfg.BreakerFailures, cfg.BreakerCooldown)
+		}
+	}
+	return d
 }
 
-func (d *Downloader) withPermit(fn func() error) error {
-	d.sem <- struct{}{}
-	defer func() { <-d.sem }()
+// BreakerStates returns the circuit breaker state of each metadata endpoint.
+func (d *Downloader) BreakerStates() map[string]BreakerState {
+	out := make(map[string]BreakerState, len(d.breakers))
+	for ep, b := range d.breakers {
+		out[ep] = b.snapshot()
+	}
+	return out
+}
+
+// guarded calls fn unless endpoint's breaker is open, recording the result.
+func (d *Downloader) guarded(endpoint string, fn func() error) error {
+	b, ok := d.breakers[endpoint]
+	if !ok {
+		return fn()
+	}
+	if !b.allow(time.Now()) {
+		return ErrCircuitOpen
+	}
+	err := fn()
+	b.record(err, time.Now())
+	return err
+}
+
+// withPermit runs fn while holding a permit from sem. Waiting for a permit
+// is abandoned with ctx's error if ctx is done first. A nil sem is unbounded.
+func withPermit(ctx context.Context, sem chan struct{}, fn func() error) error {
+	if sem == nil {
+		return fn()
+	}
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-sem }()
 	return fn()
 }
 
-func (d *Downloader) FetchMetadata(ctx context.Context, videoURL string) (title, thumbnail string, durationSeconds int, err error) {
+// Metadata is the subset of video metadata the API surfaces.
+type Metadata struct {
+	Title     string
+	Thumbnail string
+	Uploader  string
+	Duration  int
+}
+
+// FetchMetadata looks up title, thumbnail, uploader and duration for
+// videoURL, waiting for a metadata permit first.
+func (d *Downloader) FetchMetadata(ctx context.Context, videoURL string) (Metadata, error) {
+	var meta Metadata
+	err := withPermit(ctx, d.metaSem, func() (err error) {
+		meta, err = d.fetchMetadata(ctx, videoURL)
+		return err
+	})
+	return meta, err
+}
+
+func (d *Downloader) fetchMetadata(ctx context.Context, videoURL string) (Metadata, error) {
+	if d.isDirect(videoURL) {
+		return d.directMetadata(ctx, videoURL)
+	}
 	// Try fast HTTP-based fetch first (oEmbed title/thumbnail + external duration API),
 	// then fall back to yt-dlp if either fails to provide usable data.
 	type metaResult struct {
-		title string
-		thumb string
-		dur   int
-		err   error
+		title  string
+		thumb  string
+		author string
+		dur    int
+		err    error
 	}
 
 	// Small, snappy timeout for HTTP metadata calls
-	httpTimeout := 5 * time.Second
-	httpCtx, httpCancel := context.WithTimeout(ctx, httpTimeout)
+	httpCtx, httpCancel := context.WithTimeout(ctx, d.cfg.HTTPTimeout)
 	defer httpCancel()
 
 	// Run both HTTP calls concurrently
@@ -66,11 +207,20 @@ func (d *Downloader) FetchMetadata(ctx context.Context, videoURL string) (title,
 	chD := make(chan metaResult, 1)
 
 	go func() {
-		t, th, e := d.fetchOEmbed(httpCtx, d.cfg.OEmbedEndpoint, videoURL)
-		chO <- metaResult{title: t, thumb: th, dur: 0, err: e}
+		var t, th, au string
+		e := d.guarded(d.cfg.OEmbedEndpoint, func() (err error) {
+			t, th, au, err = d.fetchOEmbed(httpCtx, d.cfg.OEmbedEndpoint, videoURL)
+			return err
+		})
+		chO <- metaResult{title: t, thumb: th, author: au, dur: 0, err: e}
 	}()
 	go func() {
-		dur, e := d.fetchDuration(httpCtx, d.cfg.DurationAPIEndpoint, videoURL)
+		var dur int
+		// Skipped while the duration API is failing so prepares don't pay its timeout
+		e := d.guarded(d.cfg.DurationAPIEndpoint, func() (err error) {
+			dur, err = d.fetchDuration(httpCtx, d.cfg.DurationAPIEndpoint, videoURL)
+			return err
+		})
 		chD <- metaResult{dur: dur, err: e}
 	}()
 
@@ -90,7 +240,7 @@ func (d *Downloader) FetchMetadata(ctx context.Context, videoURL string) (title,
 
 	// If we got anything useful from HTTP, return it (prefer fast path)
 	if o.title != "" || o.thumb != "" || dd.dur > 0 {
-		return o.title, o.thumb, dd.dur, nil
+		return Metadata{Title: o.title, Thumbnail: o.thumb, Uploader: o.author, Duration: dd.dur}, nil
 	}
 
 	// Fallback to yt-dlp --dump-json
@@ -99,20 +249,85 @@ func (d *Downloader) FetchMetadata(ctx context.Context, videoURL string) (title,
 	cmd := exec.CommandContext(ytdlpCtx, "yt-dlp", "--dump-json", "--no-playlist", videoURL)
 	out, e := cmd.Output()
 	if e != nil {
-		return "", "", 0, e
+		return Metadata{}, e
 	}
-	title = extractJSONField(string(out), "title")
-	thumbnail = extractJSONField(string(out), "thumbnail")
+	var m Metadata
+	m.Title = extractJSONField(string(out), "title")
+	m.Thumbnail = extractJSONField(string(out), "thumbnail")
+	m.Uploader = extractJSONField(string(out), "uploader")
 	durStr := extractJSONField(string(out), "duration")
 	if durStr != "" {
 		if strings.ContainsAny(durStr, ".") {
 			durStr = strings.SplitN(durStr, ".", 2)[0]
 		}
 		if n, e2 := strconv.Atoi(durStr); e2 == nil {
-			durationSeconds = n
+			m.Duration = n
 		}
 	}
-	return title, thumbnail, durationSeconds, nil
+	return m, nil
+}
+
+// FetchDuration asks yt-dlp for just the video duration in seconds, waiting
+// for a metadata permit first. It is used to fill in the duration when the
+// fast HTTP path returned none.
+func (d *Downloader) FetchDuration(ctx context.Context, videoURL string) (int, error) {
+	var dur int
+	err := withPermit(ctx, d.metaSem, func() (err error) {
+		dur, err = d.ytdlpDuration(ctx, videoURL)
+		return err
+	})
+	return dur, err
+}
+
+func (d *Downloader) ytdlpDuration(ctx context.Context, videoURL string) (int, error) {
+	if d.isDirect(videoURL) {
+		return d.probeDuration(ctx, videoURL)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.YtDLPTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "yt-dlp", "--skip-download", "--no-playlist", "--print", "duration", videoURL).Output()
+	if err != nil {
+		return 0, err
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil || f <= 0 {
+		return 0, errors.New("duration unavailable")
+	}
+	return int(f), nil
+}
+
+// Chapter is a chapter marker with bounds in seconds.
+type Chapter struct {
+	Title string  `json:"title"`
+	Start float64 `json:"start_time"`
+	End   float64 `json:"end_time"`
+}
+
+// FetchChapters returns the video's chapter markers from yt-dlp, or none if
+// it has no chapters.
+func (d *Downloader) FetchChapters(ctx context.Context, videoURL string) ([]Chapter, error) {
+	var chapters []Chapter
+	err := withPermit(ctx, d.metaSem, func() (err error) {
+		chapters, err = d.ytdlpChapters(ctx, videoURL)
+		return err
+	})
+	return chapters, err
+}
+
+func (d *Downloader) ytdlpChapters(ctx context.Context, videoURL string) ([]Chapter, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.YtDLPTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "yt-dlp", "--dump-json", "--no-playlist", videoURL).Output()
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		Chapters []Chapter `json:"chapters"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, err
+	}
+	return info.Chapters, nil
 }
 
 func extractJSONField(js, field string) string {
@@ -147,13 +362,13 @@ func extractJSONField(js, field string) string {
 	return strings.TrimSpace(v[:end])
 }
 
-func (d *Downloader) fetchOEmbed(ctx context.Context, endpoint, videoURL string) (title string, thumbnail string, err error) {
+func (d *Downloader) fetchOEmbed(ctx context.Context, endpoint, videoURL string) (title, thumbnail, author string, err error) {
 	if endpoint == "" {
-		return "", "", errors.New("oembed endpoint not configured")
+		return "", "", "", errors.New("oembed endpoint not configured")
 	}
 	u, e := url.Parse(endpoint)
 	if e != nil {
-		return "", "", e
+		return "", "", "", e
 	}
 	q := u.Query()
 	q.Set("url", videoURL)
@@ -161,27 +376,27 @@ func (d *Downloader) fetchOEmbed(ctx context.Context, endpoint, videoURL string)
 	u.RawQuery = q.Encode()
 	req, e := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if e != nil {
-		return "", "", e
+		return "", "", "", e
 	}
 	req.Header.Set("Accept", "application/json")
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, e := client.Do(req)
+	resp, e := d.client.Do(req)
 	if e != nil {
-		return "", "", e
+		return "", "", "", e
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return "", "", errors.New("oembed non-2xx")
+		return "", "", "", errors.New("oembed non-2xx")
 	}
 	var payload struct {
 		Title        string `json:"title"`
 		ThumbnailURL string `json:"thumbnail_url"`
+		AuthorName   string `json:"author_name"`
 	}
 	dec := json.NewDecoder(resp.Body)
 	if e := dec.Decode(&payload); e != nil {
-		return "", "", e
+		return "", "", "", e
 	}
-	return payload.Title, payload.ThumbnailURL, nil
+	return payload.Title, payload.ThumbnailURL, payload.AuthorName, nil
 }
 
 func (d *Downloader) fetchDuration(ctx context.Context, endpoint, videoURL string) (durationSeconds int, err error) {
@@ -196,8 +411,7 @@ func (d *Downloader) fetchDuration(ctx context.Context, endpoint, videoURL strin
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, e := client.Do(req)
+	resp, e := d.client.Do(req)
 	if e != nil {
 		return 0, e
 	}
@@ -218,13 +432,16 @@ func (d *Downloader) fetchDuration(ctx context.Context, endpoint, videoURL strin
 }
 
 func (d *Downloader) Download(ctx context.Context, url, outputPath string, onProgress ProgressFunc) error {
-	return d.withPermit(func() error {
+	return withPermit(ctx, d.sem, func() error {
 		ctx, cancel := context.WithTimeout(ctx, d.cfg.DownloadTimeout)
 		defer cancel()
+		if d.isDirect(url) {
+			return d.downloadHTTP(ctx, url, outputPath, onProgress)
+		}
 		// Strictly prefer audio-only formats; avoid falling back to video
 		audioFmt := "bestaudio[ext=m4a]/bestaudio[ext=webm]/bestaudio"
 		args := []string{"-f", audioFmt, "-o", outputPath, "--no-playlist", "--newline", url}
-		cmd := exec.CommandContext(ctx, "yt-dlp", args...)
+		cmd := d.cfg.Priority.Command(ctx, "yt-dlp", args...)
         stderr, err := cmd.StderrPipe()
 		if err != nil {
 			return err
@@ -250,16 +467,35 @@ func (d *Downloader) Download(ctx context.Context, url, outputPath string, onPro
                 }
             }
         }
-        go readProgress(stderr, monotonicCB)
-        go readProgress(stdout, monotonicCB)
-		return cmd.Wait()
+		var unavailable atomic.Bool
+		stderrDone := make(chan struct{})
+		go func() {
+			readProgress(stderr, monotonicCB, func(line string) {
+				if unavailableLine(line) {
+					unavailable.Store(true)
+				}
+			})
+			close(stderrDone)
+		}()
+        go readProgress(stdout, monotonicCB, nil)
+		<-stderrDone
+		err = cmd.Wait()
+		if err != nil && ctx.Err() == nil && unavailable.Load() {
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+		return err
 	})
 }
 
-func readProgress(r io.Reader, onProgress func(int)) {
+// readProgress forwards the progress lines of r to onProgress and, when
+// onLine is set, every line to onLine.
+func readProgress(r io.Reader, onProgress func(int), onLine func(string)) {
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
+		if onLine != nil {
+			onLine(line)
+		}
         // Only parse lines marked as download progress
         m := downloadPctRe.FindStringSubmatch(line)
         if len(m) == 0 {
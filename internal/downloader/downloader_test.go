@@ -0,0 +1,56 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMetadataLookupsWaitForPermit(t *testing.T) {
+	d := New(Config{MaxConcurrentMetadata: 1}, 1)
+	// Hold the only permit so every lookup has to wait for it
+	d.metaSem <- struct{}{}
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+	}{
+		{name: "duration", call: func(ctx context.Context) error {
+			_, err := d.FetchDuration(ctx, "https://www.youtube.com/watch?v=dQw4w9WgXcQ")
+			return err
+		}},
+		{name: "chapters", call: func(ctx context.Context) error {
+			_, err := d.FetchChapters(ctx, "https://www.youtube.com/watch?v=dQw4w9WgXcQ")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			if err := tt.call(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("err = %v, want deadline exceeded while waiting for a permit", err)
+			}
+		})
+	}
+}
+
+func TestUnavailableLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{line: "ERROR: [youtube] dQw4w9WgXcQ: Video unavailable. This video has been removed by the uploader", want: true},
+		{line: "ERROR: [youtube] dQw4w9WgXcQ: Private video. Sign in if you've been granted access", want: true},
+		{line: "ERROR: [youtube] dQw4w9WgXcQ: Sign in to confirm your age", want: true},
+		{line: "ERROR: Unsupported URL: https://example.com/", want: true},
+		{line: "ERROR: unable to download video data: HTTP Error 503: Service Unavailable", want: false},
+		{line: "WARNING: video unavailable in some formats", want: false},
+		{line: "[download]  12.3% of 3.21MiB at 123.4KiB/s ETA 00:12", want: false},
+	}
+	for _, tt := range tests {
+		if got := unavailableLine(tt.line); got != tt.want {
+			t.Errorf("unavailableLine(%q) = %v, want %v", tt.line, got, tt.want)
+		}
+	}
+}
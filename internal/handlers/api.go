@@ -1,20 +1,37 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"log/slog"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	runtimemetrics "runtime/metrics"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel/attribute"
 
 	"ytmp3api/internal/config"
 	"ytmp3api/internal/converter"
@@ -24,137 +41,754 @@ import (
 	"ytmp3api/internal/models"
 	"ytmp3api/internal/queue"
 	"ytmp3api/internal/store"
+	"ytmp3api/internal/tracing"
 	"ytmp3api/internal/util"
-    "os/exec"
 )
 
 type API struct {
 	cfg      *config.Config
 	sessions store.SessionStore
+	idem     store.IdempotencyStore
+	rdb      *redis.Client // nil when sessions are held in memory
 	dl       *downloader.Downloader
 	conv     *converter.Converter
 	dlQueue  *queue.Queue
 	cvQueue  *queue.Queue
 	metrics  *metrics.Registry
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// draining is set by POST /drain or shutdown: new work is refused
+	// while workers finish what is already queued
+	draining atomic.Bool
+
+	// inUsePaths counts in-flight jobs reading or writing each file so
+	// cleanup leaves them alone
+	inUseMu    sync.Mutex
+	inUsePaths map[string]int
+
+	deps depStatus
+
+	// diskBytes caches the size of streams/ and outputs/, refreshed by the
+	// cleanup loop so /health and /stats don't walk the directories
+	diskBytes atomic.Int64
+
+	// keyActive counts running convert jobs per principal for
+	// PerKeyMaxConcurrent
+	keyMu     sync.Mutex
+	keyActive map[string]int
+
+	// live holds the current config snapshot for fields that can be
+	// reloaded on SIGHUP; cors is rebuilt from it. Everything else reads cfg.
+	live atomic.Pointer[config.Config]
+	cors atomic.Pointer[cors.Cors]
+
+	// encoders caches ffmpeg's audio encoders, probed on first use; nil if
+	// probing failed
+	encodersOnce sync.Once
+	encoders     map[string]bool
 }
 
 func NewAPI(cfg *config.Config) (*API, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if _, ok := cfg.QualityBitrates[cfg.DefaultQuality]; cfg.DefaultQuality != "" && !ok {
+		return nil, fmt.Errorf("DEFAULT_QUALITY: %q is not in QUALITY_BITRATE_MAP", cfg.DefaultQuality)
+	}
+	if err := checkPresets(cfg.QualityBitrates); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(models.SupportedFormats, cfg.DefaultFormat) {
+		return nil, fmt.Errorf("DEFAULT_FORMAT: unsupported format %q", cfg.DefaultFormat)
+	}
 	var sess store.SessionStore
+	var idem store.IdempotencyStore
+	var rdb *redis.Client
 	if cfg.RedisAddr != "" {
-		rdb := redis.NewClient(&redis.Options{Addr: cfg.RedisAddr, Password: cfg.RedisPassword, DB: cfg.RedisDB})
-		if err := rdb.Ping(context.Background()).Err(); err == nil {
-			sess = store.NewRedisStore(rdb)
+		opts := &redis.Options{Addr: cfg.RedisAddr, Password: cfg.RedisPassword, DB: cfg.RedisDB}
+		if cfg.RedisTLS {
+			host, _, _ := net.SplitHostPort(cfg.RedisAddr)
+			opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: host}
+		}
+		c := redis.NewClient(opts)
+		if err := c.Ping(context.Background()).Err(); err == nil {
+			rdb = c
+			sess = store.NewResilientStore(store.NewRedisStore(rdb, cfg.RedisKeyPrefix))
+			idem = store.NewRedisIdempotencyStore(rdb, cfg.RedisKeyPrefix)
 		}
 	}
 	if sess == nil {
 		sess = store.NewMemoryStore()
+		idem = store.NewMemoryIdempotencyStore()
 	}
 
-	_ = os.MkdirAll(cfg.ConversionsDir, 0o755)
-	_ = os.MkdirAll(filepath.Join(cfg.ConversionsDir, "streams"), 0o755)
-	_ = os.MkdirAll(filepath.Join(cfg.ConversionsDir, "outputs"), 0o755)
+	if err := prepareConversionsDir(cfg.ConversionsDir, cfg.MinFreeDiskBytes); err != nil {
+		return nil, err
+	}
 
+	priority := util.Priority{Nice: cfg.ProcessNice, IOClass: cfg.ProcessIOClass}
 	dl := downloader.New(downloader.Config{
 		YtDLPTimeout:        cfg.YtDLPTimeout,
 		DownloadTimeout:     cfg.YtDLPDownloadTimeout,
 		OEmbedEndpoint:      cfg.OEmbedEndpoint,
 		DurationAPIEndpoint: cfg.DurationAPIEndpoint,
+		BreakerFailures:     cfg.BreakerFailures,
+		BreakerCooldown:     cfg.BreakerCooldown,
+		HTTPTimeout:         cfg.MetadataHTTPTimeout,
+		Priority:            priority,
+		MaxConcurrentMetadata: cfg.MaxConcurrentMetadata,
+		DirectHosts:         cfg.DirectDownloadHosts,
+		DirectConcurrency:   cfg.YtDLPDownloadConcurrency,
+		MaxDirectBytes:      cfg.MaxDirectDownloadBytes,
 	}, cfg.MaxConcurrentDownloads)
-	cv := converter.New(converter.Config{MinTimeout: cfg.FFmpegMinTimeout, MaxTimeout: cfg.FFmpegMaxTimeout, Mode: converter.Mode(strings.ToUpper(cfg.FFmpegMode)), CBRBitrate: cfg.FFmpegCBRBitrate, VBRQ: cfg.FFmpegVBRQ, Threads: cfg.FFmpegThreads}, cfg.MaxConcurrentConversions)
+	cv := converter.New(converter.Config{MinTimeout: cfg.FFmpegMinTimeout, MaxTimeout: cfg.FFmpegMaxTimeout, Mode: converter.Mode(strings.ToUpper(cfg.FFmpegMode)), CBRBitrate: cfg.FFmpegCBRBitrate, VBRQ: cfg.FFmpegVBRQ, Threads: cfg.FFmpegThreads, Priority: priority, QualityBitrates: cfg.QualityBitrates}, cfg.MaxConcurrentConversions)
 
-	dlQ := queue.NewQueue(cfg.JobQueueCapacity)
-	cvQ := queue.NewQueue(cfg.JobQueueCapacity)
+	order, _ := queue.OrderFor(cfg.QueueStrategy) // checked by Validate
+	dlQ := queue.NewQueueWithOrder(cfg.JobQueueCapacity, order)
+	cvQ := queue.NewQueueWithOrder(cfg.JobQueueCapacity, order)
 
 	m := metrics.NewRegistry()
-	m.Workers.Store(int64(cfg.WorkerPoolSize))
+	m.Workers.Store(int64(cfg.DownloadWorkers + cfg.ConvertWorkers))
 	m.QueueCapacity.Store(int64(cfg.JobQueueCapacity))
 	m.RateLimit.Store(int64(cfg.BurstSize))
+	m.SetHistorySize(cfg.StatsHistorySize)
 
-	api := &API{cfg: cfg, sessions: sess, dl: dl, conv: cv, dlQueue: dlQ, cvQueue: cvQ, metrics: m}
+	api := &API{cfg: cfg, sessions: sess, idem: idem, rdb: rdb, dl: dl, conv: cv, dlQueue: dlQ, cvQueue: cvQ, metrics: m, stopCh: make(chan struct{}), inUsePaths: map[string]int{}, keyActive: map[string]int{}}
+	api.live.Store(cfg)
+	api.cors.Store(newCors(cfg))
 	api.startWorkers()
 	api.startCleanup()
+	api.startProbes()
+	api.startSampler()
+	go api.probeEndpoints()
 	return api, nil
 }
 
 func (a *API) startWorkers() {
-	dlPool := queue.NewWorkerPool(a.cfg.WorkerPoolSize, a.dlQueue, a.handleDownload)
+	dlPool := queue.NewWorkerPool(a.cfg.DownloadWorkers, a.dlQueue, a.tracked(a.handleDownload))
 	dlPool.Start()
-	cvPool := queue.NewWorkerPool(a.cfg.WorkerPoolSize, a.cvQueue, a.handleConvert)
+	cvPool := queue.NewWorkerPool(a.cfg.ConvertWorkers, a.cvQueue, a.tracked(a.keyLimited(a.handleConvert)))
+	if a.cfg.PerKeyMaxConcurrent > 0 {
+		cvPool.SetClaim(a.claimKeySlot)
+	}
 	cvPool.Start()
 }
 
+// claimKeySlot reserves a concurrency slot for the job's principal (API key
+// or JWT subject), refusing when it already has PerKeyMaxConcurrent jobs
+// running so workers pick other tenants' jobs instead. Anonymous jobs are not
+// limited.
+func (a *API) claimKeySlot(j queue.Job) bool {
+	if j.Principal == "" {
+		return true
+	}
+	a.keyMu.Lock()
+	defer a.keyMu.Unlock()
+	if a.keyActive[j.Principal] >= a.cfg.PerKeyMaxConcurrent {
+		return false
+	}
+	a.keyActive[j.Principal]++
+	return true
+}
+
+// keyLimited releases the slot taken by claimKeySlot once h finishes and
+// wakes workers that skipped the principal's other jobs.
+func (a *API) keyLimited(h func(queue.Job)) func(queue.Job) {
+	if a.cfg.PerKeyMaxConcurrent <= 0 {
+		return h
+	}
+	return func(j queue.Job) {
+		defer func() {
+			if j.Principal == "" {
+				return
+			}
+			a.keyMu.Lock()
+			if a.keyActive[j.Principal]--; a.keyActive[j.Principal] <= 0 {
+				delete(a.keyActive, j.Principal)
+			}
+			a.keyMu.Unlock()
+			a.cvQueue.Wake()
+		}()
+		h(j)
+	}
+}
+
+// current returns the live config snapshot, reflecting any SIGHUP reloads.
+func (a *API) current() *config.Config {
+	return a.live.Load()
+}
+
+// Reload applies the hot-reloadable fields of next: global and per-IP rate
+// limits, the shed thresholds, allowed domains, the IP allowlist, admin
+// credentials and CORS settings. Other changed fields need a restart and are
+// logged as ignored.
+func (a *API) Reload(next *config.Config) {
+	cur := a.current()
+	updated := *cur
+	updated.RequestsPerSecond = next.RequestsPerSecond
+	updated.BurstSize = next.BurstSize
+	updated.PerIPRPS = next.PerIPRPS
+	updated.PerIPBurst = next.PerIPBurst
+	updated.ShedQueueThreshold = next.ShedQueueThreshold
+	updated.PrepareDownloadQueueThreshold = next.PrepareDownloadQueueThreshold
+	updated.ShedLoadPerCPU = next.ShedLoadPerCPU
+	updated.ShedMemoryPercent = next.ShedMemoryPercent
+	updated.AllowedDomains = next.AllowedDomains
+	updated.IPAllowlist = next.IPAllowlist
+	updated.AdminUser = next.AdminUser
+	updated.AdminPass = next.AdminPass
+	updated.AllowedOrigins = next.AllowedOrigins
+	updated.CORSAllowedMethods = next.CORSAllowedMethods
+	updated.CORSAllowedHeaders = next.CORSAllowedHeaders
+	updated.CORSExposeHeaders = next.CORSExposeHeaders
+	updated.CORSAllowCredentials = next.CORSAllowCredentials
+	updated.CORSMaxAge = next.CORSMaxAge
+	if next.WorkerPoolSize != cur.WorkerPoolSize || next.DownloadWorkers != cur.DownloadWorkers || next.ConvertWorkers != cur.ConvertWorkers {
+		log.Printf("config reload: worker pool sizes require a restart; ignored")
+	}
+	if next.JobQueueCapacity != cur.JobQueueCapacity {
+		log.Printf("config reload: JOB_QUEUE_CAPACITY requires a restart; ignored")
+	}
+	if next.MaxConcurrentDownloads != cur.MaxConcurrentDownloads || next.MaxConcurrentConversions != cur.MaxConcurrentConversions {
+		log.Printf("config reload: MAX_CONCURRENT_* require a restart; ignored")
+	}
+	a.live.Store(&updated)
+	a.cors.Store(newCors(&updated))
+	a.metrics.RateLimit.Store(int64(updated.BurstSize))
+	log.Printf("config reloaded: rps=%v burst=%d per_ip_rps=%v per_ip_burst=%d shed=%d", updated.RequestsPerSecond, updated.BurstSize, updated.PerIPRPS, updated.PerIPBurst, updated.ShedQueueThreshold)
+}
+
+func newCors(cfg *config.Config) *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins:   cfg.AllowedOrigins,
+		AllowedMethods:   cfg.CORSAllowedMethods,
+		AllowedHeaders:   cfg.CORSAllowedHeaders,
+		ExposedHeaders:   cfg.CORSExposeHeaders,
+		AllowCredentials: cfg.CORSAllowCredentials,
+		MaxAge:           cfg.CORSMaxAge,
+	})
+}
+
+// tracked wraps a job handler so the queued/active gauges follow the job from
+// dequeue to completion. ActiveJobs is decremented in a defer so a panicking
+// handler cannot leak the counter.
+func (a *API) tracked(h func(queue.Job)) func(queue.Job) {
+	return func(j queue.Job) {
+		a.metrics.QueuedJobs.Add(-1)
+		a.metrics.ActiveJobs.Add(1)
+		defer a.metrics.ActiveJobs.Add(-1)
+		h(j)
+	}
+}
+
+// estimateWait approximates seconds until a job at the given convert queue
+// position finishes, using the average conversion time spread across the
+// convert workers. Returns 0 when no conversions have been observed yet.
+func (a *API) estimateWait(position int) int {
+	workers := a.cfg.ConvertWorkers
+	if position <= 0 || workers <= 0 {
+		return 0
+	}
+	avg := a.metrics.AvgDurationSeconds(true)
+	return int(float64(position) * avg / float64(workers))
+}
+
+// jobDeadline returns the deadline for a job enqueued now, or the zero time
+// when JobDeadline is disabled.
+func (a *API) jobDeadline() time.Time {
+	if a.cfg.JobDeadline <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(a.cfg.JobDeadline)
+}
+
+// failJob marks the session as terminally failed with msg, logs it with its
+// failure kind and counts it. URLs in msg are redacted before it is stored,
+// since /status and the 409 of a retried convert return it. For
+// download jobs the shared asset entry is marked failed too so later prepares
+// retry the download.
+func (a *API) failJob(ctx context.Context, s *models.ConversionSession, job queue.Job, kind, msg string) {
+	s.State = models.StateFailed
+	s.Error = util.RedactURLs(msg)
+	s.FailureKind = kind
+	jobLogger(job, s).Error("job failed", "kind", kind, "attempts", job.Attempts, "error", msg)
+	a.saveSession(ctx, s)
+	if job.Type == queue.JobDownload && s.AssetHash != "" {
+		_ = a.sessions.SetAsset(ctx, s.AssetHash, "", string(models.StateFailed))
+	}
+	a.metrics.ErrorCount.Add(1)
+	a.metrics.FailedJobs.Add(1)
+	job.Finish()
+}
+
+// storeCtx returns a context bounding a worker's session store calls by
+// StoreTimeout.
+func (a *API) storeCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), a.cfg.StoreTimeout)
+}
+
+// saveSession persists s unless it is the unstored placeholder session of a
+// warm-up download. Workers save sessions they read before a long download
+// or conversion, so a write that would move the stored session backwards
+// (see regresses) is dropped; a blocked download still records its source.
+// This narrows rather than closes the race, as the store has no
+// compare-and-swap.
+func (a *API) saveSession(ctx context.Context, s *models.ConversionSession) {
+	if s.ID == "" {
+		return
+	}
+	cur, err := a.sessions.GetSession(ctx, s.ID)
+	if err == nil && regresses(cur, s) {
+		if s.SourcePath != "" && cur.SourcePath == "" {
+			cur.SourcePath = s.SourcePath
+			_ = a.sessions.UpdateSession(ctx, cur)
+		}
+		return
+	}
+	if err == nil {
+		// The stored log is authoritative; s may predate events recorded
+		// since it was read
+		s.Events = cur.Events
+		// Progress is written behind the worker's back (see
+		// progressWriter), so it only moves forward here
+		s.DownloadProgress = max(s.DownloadProgress, cur.DownloadProgress)
+		if cur.VariantHash == s.VariantHash {
+			s.ConversionProgress = max(s.ConversionProgress, cur.ConversionProgress)
+		}
+		if cur.LastProgressAt.After(s.LastProgressAt) {
+			s.LastProgressAt = cur.LastProgressAt
+		}
+		if cur.State != s.State {
+			msg := ""
+			if s.State == models.StateFailed {
+				msg = s.Error
+			}
+			s.Events = appendEvent(s.Events, s.State, msg)
+		}
+	}
+	_ = a.sessions.UpdateSession(ctx, s)
+}
+
+// stateRank orders states along a session's lifecycle. Failed ranks with
+// Completed as the other terminal state.
+var stateRank = map[models.ConversionState]int{
+	models.StatePreparing:   0,
+	models.StateFetching:    1,
+	models.StateCreated:     2,
+	models.StateDownloading: 3,
+	models.StateDownloaded:  4,
+	models.StateQueued:      5,
+	models.StateConverting:  6,
+	models.StateCompleted:   7,
+	models.StateFailed:      7,
+}
+
+// regresses reports whether saving next over the stored cur would move the
+// session backwards: a download-stage state over a session that has moved
+// on to converting, or, for the same variant, an earlier state or any change
+// to a completed conversion. A new /convert changes the variant, so it may
+// legitimately restart a completed or failed session.
+func regresses(cur, next *models.ConversionSession) bool {
+	downloaded := stateRank[models.StateDownloaded]
+	if stateRank[next.State] <= downloaded && stateRank[cur.State] > downloaded {
+		return true
+	}
+	if cur.VariantHash != next.VariantHash {
+		return false
+	}
+	return cur.State == models.StateCompleted || stateRank[next.State] < stateRank[cur.State]
+}
+
+// enqueue pushes a job onto q and counts it as queued when accepted.
+func (a *API) enqueue(q *queue.Queue, j queue.Job) bool {
+	if !q.Enqueue(j) {
+		return false
+	}
+	a.metrics.QueuedJobs.Add(1)
+	return true
+}
+
+// createSession stores s and counts it in SessionsActive.
+func (a *API) createSession(ctx context.Context, s *models.ConversionSession) error {
+	if err := a.sessions.CreateSession(ctx, s); err != nil {
+		return err
+	}
+	a.metrics.SessionsActive.Add(1)
+	return nil
+}
+
+// deleteSession removes a session and uncounts it from SessionsActive.
+func (a *API) deleteSession(ctx context.Context, id string) error {
+	if err := a.sessions.DeleteSession(ctx, id); err != nil {
+		return err
+	}
+	a.metrics.SessionsActive.Add(-1)
+	return nil
+}
+
+// syncSessionCount resets SessionsActive to the number of stored sessions,
+// correcting drift from sessions the store expired on its own (Redis TTLs)
+// or deletes of sessions that were already gone.
+func (a *API) syncSessionCount(ctx context.Context) {
+	if sessions, err := a.sessions.ListSessions(ctx); err == nil {
+		a.metrics.SessionsActive.Store(int64(len(sessions)))
+	}
+}
+
+// sessionsFull reports whether MaxSessions is reached, writing a 503 if so.
+func (a *API) sessionsFull(w http.ResponseWriter) bool {
+	if a.cfg.MaxSessions <= 0 || a.metrics.SessionsActive.Load() < int64(a.cfg.MaxSessions) {
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	writeErr(w, http.StatusServiceUnavailable, CodeOverloaded, "too many active sessions; try again later")
+	return true
+}
+
 func (a *API) startCleanup() {
+	a.syncSessionCount(context.Background())
+	a.refreshDiskUsage()
 	go func() {
-		ticker := time.NewTicker(time.Minute)
-		for range ticker.C {
-			now := time.Now()
-			// Clean outputs (converted files)
-			outDir := filepath.Join(a.cfg.ConversionsDir, "outputs")
-			if outs, _ := os.ReadDir(outDir); outs != nil {
-				for _, e := range outs {
-					if e.IsDir() {
-						continue
-					}
-					p := filepath.Join(outDir, e.Name())
-					info, err := os.Stat(p)
-					if err != nil {
-						continue
-					}
-					if now.Sub(info.ModTime()) > a.cfg.ConvertedFileTTL {
-						_ = os.Remove(p)
-					}
-				}
-			}
-			// Clean streams (unconverted source files)
-			stDir := filepath.Join(a.cfg.ConversionsDir, "streams")
-			if sts, _ := os.ReadDir(stDir); sts != nil {
-				for _, e := range sts {
-					if e.IsDir() {
-						continue
-					}
-					p := filepath.Join(stDir, e.Name())
-					info, err := os.Stat(p)
-					if err != nil {
-						continue
-					}
-					if now.Sub(info.ModTime()) > a.cfg.UnconvertedFileTTL {
-						_ = os.Remove(p)
-					}
-				}
+		ticker := time.NewTicker(a.cfg.CleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stopCh:
+				return
+			case now := <-ticker.C:
+				a.cleanupOnce(now)
+				a.syncSessionCount(context.Background())
+				a.refreshDiskUsage()
 			}
 		}
 	}()
 }
 
+// cleanupOnce runs a single cleanup cycle, removing files older than their
+// TTL as of now. Cache entries and sessions pointing at removed files are
+// dropped too so the store stays consistent with disk.
+func (a *API) cleanupOnce(now time.Time) {
+	ctx := context.Background()
+	// Clean outputs (converted files); names are <variantHash>.mp3
+	removedOutputs := a.removeExpired(filepath.Join(a.cfg.ConversionsDir, "outputs"), now, a.cfg.ConvertedFileTTL)
+	// Clean streams (unconverted source files); names are <assetHash>.source
+	removedSources := a.removeExpired(filepath.Join(a.cfg.ConversionsDir, "streams"), now, a.cfg.UnconvertedFileTTL)
+	if a.cfg.MaxDiskUsageBytes > 0 {
+		a.enforceDiskLimit(removedOutputs, removedSources)
+	}
+	for p := range removedOutputs {
+		_ = a.sessions.DeleteVariant(ctx, strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)))
+	}
+	for p := range removedSources {
+		_ = a.sessions.DeleteAsset(ctx, strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)))
+	}
+	if len(removedOutputs) == 0 && len(removedSources) == 0 {
+		return
+	}
+	sessions, err := a.sessions.ListSessions(ctx)
+	if err != nil {
+		return
+	}
+	for _, s := range sessions {
+		_, outGone := removedOutputs[s.OutputPath]
+		_, srcGone := removedSources[s.SourcePath]
+		switch {
+		case s.OutputPath != "" && outGone:
+			_ = a.deleteSession(ctx, s.ID)
+		case s.SourcePath != "" && srcGone && s.State != models.StateCompleted:
+			// Nothing left to convert from; a fresh prepare is needed
+			_ = a.deleteSession(ctx, s.ID)
+		case s.SourcePath != "" && srcGone:
+			s.SourcePath = ""
+			_ = a.sessions.UpdateSession(ctx, s)
+		}
+	}
+}
+
+// removeExpired deletes regular files in dir whose mtime is older than ttl
+// and returns the set of removed paths.
+func (a *API) removeExpired(dir string, now time.Time, ttl time.Duration) map[string]struct{} {
+	removed := map[string]struct{}{}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		if a.inUse(p) {
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) > ttl {
+			if os.Remove(p) == nil {
+				removed[p] = struct{}{}
+			}
+		}
+	}
+	return removed
+}
+
+// enforceDiskLimit deletes the least recently modified files from streams/
+// and outputs/ while their combined size exceeds MaxDiskUsageBytes, stopping
+// at the low-water mark. Files used by in-flight jobs are never removed.
+// Removed paths are added to the given sets.
+func (a *API) enforceDiskLimit(removedOutputs, removedSources map[string]struct{}) {
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+		output  bool
+	}
+	var files []file
+	var total int64
+	for _, sub := range []string{"outputs", "streams"} {
+		dir := filepath.Join(a.cfg.ConversionsDir, sub)
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			total += info.Size()
+			files = append(files, file{path: filepath.Join(dir, e.Name()), size: info.Size(), modTime: info.ModTime(), output: sub == "outputs"})
+		}
+	}
+	if total <= a.cfg.MaxDiskUsageBytes {
+		return
+	}
+	low := a.cfg.DiskLowWaterBytes
+	if low <= 0 || low > a.cfg.MaxDiskUsageBytes {
+		low = a.cfg.MaxDiskUsageBytes * 9 / 10
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total <= low {
+			break
+		}
+		if a.inUse(f.path) {
+			continue
+		}
+		if os.Remove(f.path) != nil {
+			continue
+		}
+		total -= f.size
+		if f.output {
+			removedOutputs[f.path] = struct{}{}
+		} else {
+			removedSources[f.path] = struct{}{}
+		}
+	}
+}
+
+// safePath reports whether p resolves to a file inside CONVERSIONS_DIR.
+// Paths are built from hashes today; this guards every open, write and
+// delete in case a stored path or future input ever escapes the directory.
+func (a *API) safePath(p string) bool {
+	if util.WithinDir(a.cfg.ConversionsDir, p) {
+		return true
+	}
+	slog.Warn("refusing path outside CONVERSIONS_DIR", "path", p)
+	return false
+}
+
+// tempPath returns a hidden sibling of final to write it to before renaming
+// it into place, named by INSTANCE_ID and the job so no other instance or job
+// writes the same file, while retries of the job reuse it and can resume a
+// partial download. The extension is kept because ffmpeg picks the output
+// format from it.
+func (a *API) tempPath(final, jobID string) string {
+	id := strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			return c
+		}
+		return '_'
+	}, a.cfg.InstanceID)
+	ext := filepath.Ext(final)
+	base := strings.TrimSuffix(filepath.Base(final), ext)
+	return filepath.Join(filepath.Dir(final), fmt.Sprintf(".%s.%s-%s.tmp%s", base, id, jobID, ext))
+}
+
+// removeTemp deletes a temp file from tempPath along with the partial files
+// yt-dlp and the direct downloader keep next to it.
+func removeTemp(tmp string) {
+	for _, suffix := range []string{"", ".part", ".parts", ".ytdl"} {
+		os.Remove(tmp + suffix)
+	}
+}
+
+// touchSource marks a source as just used when PinSources is enabled. Cleanup
+// ages files by mtime, so this restarts the source's TTL and moves it to the
+// back of the disk-limit eviction order.
+func (a *API) touchSource(path string) {
+	if !a.cfg.PinSources || path == "" || !a.safePath(path) {
+		return
+	}
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// markInUse protects path (and temp files derived from it, like yt-dlp's
+// .part files) from cleanup until the returned func is called.
+func (a *API) markInUse(path string) func() {
+	if path == "" {
+		return func() {}
+	}
+	a.inUseMu.Lock()
+	a.inUsePaths[path]++
+	a.inUseMu.Unlock()
+	return func() {
+		a.inUseMu.Lock()
+		if a.inUsePaths[path]--; a.inUsePaths[path] <= 0 {
+			delete(a.inUsePaths, path)
+		}
+		a.inUseMu.Unlock()
+	}
+}
+
+func (a *API) inUse(path string) bool {
+	a.inUseMu.Lock()
+	defer a.inUseMu.Unlock()
+	for p := range a.inUsePaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// diskUsage returns the bytes used by streams/ and outputs/ as of the last
+// cleanup cycle.
+func (a *API) diskUsage() int64 {
+	return a.diskBytes.Load()
+}
+
+// refreshDiskUsage measures streams/ and outputs/ for diskUsage.
+func (a *API) refreshDiskUsage() {
+	a.diskBytes.Store(util.DirSize(filepath.Join(a.cfg.ConversionsDir, "streams")) + util.DirSize(filepath.Join(a.cfg.ConversionsDir, "outputs")))
+}
+
+// Drain stops accepting new work: /ready fails so load balancers stop
+// routing here, and prepare/convert requests get 503, while the workers keep
+// processing queued jobs. It is safe to call more than once.
+func (a *API) Drain() {
+	if !a.draining.Swap(true) {
+		slog.Info("draining: refusing new work", "queued", a.dlQueue.Len()+a.cvQueue.Len(), "active", a.metrics.ActiveJobs.Load())
+	}
+}
+
+// WaitIdle blocks until both queues are empty and no job is running, or ctx
+// is done. Jobs sleeping before a retry are not counted and may be lost.
+func (a *API) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for a.dlQueue.Len()+a.cvQueue.Len() > 0 || a.metrics.ActiveJobs.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// acceptingWork wraps a handler that creates jobs so it answers 503 while
+// draining.
+func (a *API) acceptingWork(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.draining.Load() {
+			w.Header().Set("Retry-After", "5")
+			writeErr(w, http.StatusServiceUnavailable, CodeDraining, "server is draining; retry on another instance")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleDebugConfig returns the effective configuration, including values
+// applied by the latest reload, with secrets redacted.
+func (a *API) handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.current().Redacted())
+}
+
+// handleDrain switches the instance into draining mode ahead of a deploy.
+func (a *API) handleDrain(w http.ResponseWriter, r *http.Request) {
+	a.Drain()
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"draining":    true,
+		"queued_jobs": a.dlQueue.Len() + a.cvQueue.Len(),
+		"active_jobs": a.metrics.ActiveJobs.Load(),
+	})
+}
+
+// Close stops background goroutines started by NewAPI. It is safe to call
+// more than once.
+func (a *API) Close() {
+	a.stopOnce.Do(func() { close(a.stopCh) })
+}
+
 func (a *API) Router() http.Handler {
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RouteMetrics(a.metrics.ObserveRoute))
+	r.Use(tracing.Middleware)
 	// CORS and security headers
-	corsMw := cors.New(cors.Options{AllowedOrigins: a.cfg.AllowedOrigins, AllowedMethods: []string{"GET", "POST", "DELETE", "OPTIONS"}, AllowedHeaders: []string{"*"}, ExposedHeaders: []string{"Content-Length", "Content-Range"}, AllowCredentials: false})
-	r.Use(corsMw.Handler)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			a.cors.Load().ServeHTTP(w, r, next.ServeHTTP)
+		})
+	})
 	r.Use(middleware.SecurityHeaders)
+	// Compress JSON/HTML responses; downloads are already-compressed audio
+	r.Use(middleware.Compress(5, "/download/"))
     // Optional IP allowlist
-    r.Use(middleware.IPAllowlistMiddleware(a.cfg.IPAllowlist))
+    r.Use(middleware.IPAllowlistMiddleware(func() []string { return a.current().IPAllowlist }, a.cfg.TrustedProxyHeader))
 	// Rate limiting
-	r.Use(middleware.GlobalRateLimiter(a.cfg.RequestsPerSecond, a.cfg.BurstSize))
-	r.Use(middleware.PerIPRateLimiter(a.cfg.PerIPRPS, a.cfg.PerIPBurst))
-	// API key middleware
+	r.Use(middleware.GlobalRateLimiter(func() (float64, int) {
+		c := a.current()
+		return c.RequestsPerSecond, c.BurstSize
+	}))
+	// API key / JWT auth runs before per-IP limiting so token claims can
+	// set the caller's rate limit
 	keys := map[string]struct{}{}
 	for _, k := range a.cfg.APIKeys {
 		keys[k] = struct{}{}
 	}
-	r.Use(middleware.APIKey(a.cfg.RequireAPIKey, keys))
+	verifier := middleware.NewJWTVerifier(a.cfg.JWTSecret, a.cfg.JWTJWKSURL, a.cfg.JWTIssuer, a.cfg.JWTAudience)
+	r.Use(middleware.APIKey(a.cfg.RequireAPIKey, keys, verifier))
+	r.Use(middleware.PerIPRateLimiter(func() (float64, int) {
+		c := a.current()
+		return c.PerIPRPS, c.PerIPBurst
+	}, a.cfg.TrustedProxyHeader))
 
-	r.Post("/prepare", a.handlePrepare)
-	r.Post("/convert", a.handleConvertReq)
+	r.Post("/prepare", a.acceptingWork(a.idempotent(a.handlePrepare)))
+	r.Post("/convert", a.acceptingWork(a.idempotent(a.handleConvertReq)))
+	r.Post("/convert/upload", a.acceptingWork(a.handleUpload))
+	r.Post("/reconvert", a.acceptingWork(a.idempotent(a.handleReconvert)))
+	r.Post("/estimate", a.handleEstimate)
 	r.Get("/status/{id}", a.handleStatus)
+	r.Get("/jobs/{id}/logs", a.handleJobLogs)
+	r.Get("/formats", a.handleFormats)
 	r.Get("/download/{id}.mp3", a.handleDownloadFile)
+	r.Get("/download/{id}.m4a", a.handleDownloadFile)
+	// HEAD lets clients learn size/readiness; ServeContent omits the body
+	r.Head("/download/{id}.mp3", a.handleDownloadFile)
+	r.Head("/download/{id}.m4a", a.handleDownloadFile)
 	r.Delete("/delete/{id}", a.handleDelete)
 
     r.Get("/health", a.handleHealth)
     r.Get("/ready", a.handleReady)
 	r.Get("/metrics", a.handleMetricsJSON)
+	r.Get("/metrics/prom", a.handleMetricsProm)
 	r.Get("/stats", a.handleStats)
-	// prometheus metrics at /metrics/prom if client_golang is added later
+	r.Get("/stats/history", a.handleStatsHistory)
 
     // Simple docs and admin placeholders
 	r.Get("/docs", func(w http.ResponseWriter, r *http.Request) {
@@ -169,98 +803,556 @@ func (a *API) Router() http.Handler {
     // Tool self-test endpoint
     r.Get("/selftest", a.handleSelfTest)
 
+	// Admin operations
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.AdminAuth(func() (string, string) {
+			c := a.current()
+			return c.AdminUser, c.AdminPass
+		}))
+		r.Post("/purge", a.handlePurge)
+		r.Get("/queue", a.handleQueue)
+		r.Post("/warm", a.acceptingWork(a.handleWarm))
+		r.Post("/drain", a.handleDrain)
+		r.Get("/debug/config", a.handleDebugConfig)
+		if a.cfg.DevMode {
+			r.Post("/metrics/reset", a.handleMetricsReset)
+		}
+	})
+
 	return r
 }
 
+// idempotencyLockTTL bounds how long a key stays claimed by a request that
+// never records its response (e.g. the process died mid-request).
+const idempotencyLockTTL = 5 * time.Minute
+
+// idempotent replays the first successful response recorded for a request's
+// Idempotency-Key instead of running h again. Keys are scoped by route and
+// caller (see principal) so clients cannot collide with each other. A key
+// reused with a different body gets 422, and one whose first request is
+// still running gets 409. Requests without the header, and non-2xx
+// responses, are not recorded.
+func (a *API) idempotent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ik := r.Header.Get("Idempotency-Key")
+		if ik == "" {
+			h(w, r)
+			return
+		}
+		// decodeBody enforces the size limit on the restored body
+		body, err := io.ReadAll(io.LimitReader(r.Body, a.cfg.MaxRequestBodyBytes+1))
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "failed to read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		key := util.HashString(r.URL.Path + "|" + principal(r) + "|" + ik)
+		bodyHash := util.HashString(string(body))
+		lockTTL := min(idempotencyLockTTL, a.cfg.IdempotencyTTL)
+		rec, claimed, err := a.idem.Begin(r.Context(), key, bodyHash, lockTTL)
+		if err != nil {
+			// Without the store, running the request beats refusing it
+			h(w, r)
+			return
+		}
+		if !claimed {
+			switch {
+			case rec.BodyHash != bodyHash:
+				writeErr(w, http.StatusUnprocessableEntity, CodeIdempotencyReused, "Idempotency-Key was already used with a different request body")
+			case rec.Pending:
+				w.Header().Set("Retry-After", "1")
+				writeErr(w, http.StatusConflict, CodeIdempotencyPending, "a request with this Idempotency-Key is still in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(rec.Status)
+				_, _ = w.Write(rec.Body)
+			}
+			return
+		}
+		rrec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rrec, r)
+		// The request context may be done once the handler returns
+		ctx, cancel := a.storeCtx()
+		defer cancel()
+		if rrec.status >= 200 && rrec.status < 300 {
+			_ = a.idem.SetResponse(ctx, key, bodyHash, rrec.status, rrec.body.Bytes(), a.cfg.IdempotencyTTL)
+		} else {
+			_ = a.idem.Release(ctx, key)
+		}
+	}
+}
+
+// principal identifies the authenticated caller: the JWT subject when a token
+// was verified, otherwise the API key (empty for anonymous callers).
+func principal(r *http.Request) string {
+	if c, ok := middleware.ClaimsFrom(r.Context()); ok && c.Subject != "" {
+		return "sub:" + c.Subject
+	}
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return "key:" + k
+	}
+	return ""
+}
+
+// responseRecorder passes writes through while keeping a copy of the status
+// and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	rr.status = code
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
 func (a *API) handlePrepare(w http.ResponseWriter, r *http.Request) {
 	var req models.PrepareRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
-		writeErr(w, http.StatusBadRequest, "invalid request")
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(a.validationRules()); len(errs) > 0 {
+		writeFieldErrs(w, errs)
+		return
+	}
+	// By default always create a new session and dedupe at the asset/variant
+	// layer; clients polling by URL can opt in to reusing a live session.
+	if r.URL.Query().Get("reuse") == "true" {
+		if s, ok := a.activeSessionForURL(r.Context(), reuseKey(r, req.URL)); ok {
+			writeJSON(w, http.StatusOK, models.PrepareResponse{ConversionID: s.ID, Status: string(s.State), Metadata: s.Meta, Message: "Reusing existing session for this URL.", AssetHash: s.AssetHash, Cached: true, StartOffset: s.StartOffset})
+			return
+		}
+	}
+	// Per-stage backpressure: refuse before creating a session whose
+	// download would only sit behind a backed-up queue
+	if max := a.current().PrepareDownloadQueueThreshold; max > 0 && a.dlQueue.Len() >= max {
+		w.Header().Set("Retry-After", "30")
+		writeErr(w, http.StatusServiceUnavailable, CodeOverloaded, "download queue is backed up; try again later")
+		return
+	}
+	if a.sessionsFull(w) {
 		return
 	}
-    // Validation: allowed domains
-    if !util.IsAllowedDomain(req.URL, a.cfg.AllowedDomains) {
-        writeErr(w, http.StatusBadRequest, "unsupported url domain")
-        return
-    }
-	// Always create a new session; dedupe at asset/variant layer instead of reusing sessions
 	id := newID()
-	s := &models.ConversionSession{ID: id, URL: req.URL, State: models.StatePreparing}
-	if err := a.sessions.CreateSession(r.Context(), s); err != nil {
-		writeErr(w, http.StatusInternalServerError, "failed to create session")
+	s := &models.ConversionSession{ID: id, URL: req.URL, State: models.StatePreparing, RequestID: middleware.RequestIDFrom(r.Context())}
+	s.StartOffset, _ = util.StartOffset(req.URL)
+	if err := a.createSession(r.Context(), s); err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to create session")
 		return
 	}
-	_ = a.sessions.SetURLMap(r.Context(), req.URL, id)
+	_ = a.sessions.SetURLMap(r.Context(), reuseKey(r, req.URL), id)
 
 	// fetch metadata fast using yt-dlp --dump-json (fallback design)
-	title, thumb, dur, _ := a.dl.FetchMetadata(r.Context(), req.URL)
+	metaCtx, span := tracing.Start(r.Context(), "fetch_metadata")
+	metaStart := time.Now()
+	meta, metaErr := a.dl.FetchMetadata(metaCtx, req.URL)
+	a.metrics.ObserveMetadata(time.Since(metaStart).Seconds(), metaErr != nil)
+	span.SetAttributes(attribute.Int("ytmp3.duration_s", meta.Duration))
+	tracing.End(span, metaErr)
+	dur := meta.Duration
 	
 	// Check video duration limit
 	if dur > 0 && dur > a.cfg.MaxVideoDurationSeconds {
-		writeErr(w, http.StatusBadRequest, fmt.Sprintf("Video too long. Maximum allowed duration is %s", formatDuration(a.cfg.MaxVideoDurationSeconds)))
+		writeErr(w, http.StatusBadRequest, CodeVideoTooLong, fmt.Sprintf("Video too long. Maximum allowed duration is %s", formatDuration(a.cfg.MaxVideoDurationSeconds)))
 		return
 	}
 	
-	s.Meta = models.MetaLite{Title: title, Thumbnail: thumb, Duration: dur}
+	s.Meta = models.MetaLite{Title: meta.Title, Thumbnail: meta.Thumbnail, Duration: dur, Uploader: meta.Uploader}
 	s.State = models.StateCreated
 	_ = a.sessions.UpdateSession(r.Context(), s)
+	// The fast path can return a title without a duration; fill it in the
+	// background rather than delaying the response
+	if dur == 0 && metaErr == nil {
+		go a.fillDuration(id, req.URL)
+	}
 
 	// enqueue background download
 	assetHash := util.HashString(util.CanonicalVideoID(req.URL))
 	s.AssetHash = assetHash
-	_ = a.sessions.UpdateSession(r.Context(), s)
-	if _, state, ok, _ := a.sessions.GetAsset(r.Context(), assetHash); !ok || state == "" || state == string(models.StateFailed) {
+	if src, state, ok, _ := a.sessions.GetAsset(r.Context(), assetHash); !ok || state == "" || state == string(models.StateFailed) {
+		a.metrics.AssetCacheMisses.Add(1)
+		_ = a.sessions.UpdateSession(r.Context(), s)
 		_ = a.sessions.SetAsset(r.Context(), assetHash, "", string(models.StatePreparing))
-		job := queue.Job{ID: newID(), Type: queue.JobDownload, SessionID: id, EnqueuedAt: time.Now(), Priority: 10}
-		if !a.dlQueue.Enqueue(job) {
-			writeErr(w, http.StatusServiceUnavailable, "queue full")
+		job := queue.Job{ID: newID(), Type: queue.JobDownload, SessionID: id, EnqueuedAt: time.Now(), Priority: 10, Deadline: a.jobDeadline(), TraceParent: tracing.Inject(r.Context()), RequestID: s.RequestID}
+		if !a.enqueue(a.dlQueue, job) {
+			writeErr(w, http.StatusServiceUnavailable, CodeQueueFull, "queue full")
 			return
 		}
+	} else {
+		// An existing or in-flight download of the same asset is reused
+		a.metrics.AssetCacheHits.Add(1)
+		a.touchSource(src)
+		s.Cached = true
+		_ = a.sessions.UpdateSession(r.Context(), s)
 	}
-	resp := models.PrepareResponse{ConversionID: id, Status: string(s.State), Metadata: s.Meta, Message: "Metadata fetched successfully. Stream is downloading in background."}
+	resp := models.PrepareResponse{ConversionID: id, Status: string(s.State), Metadata: s.Meta, Message: "Metadata fetched successfully. Stream is downloading in background.", AssetHash: assetHash, Cached: s.Cached, StartOffset: s.StartOffset}
 	writeJSON(w, http.StatusAccepted, resp)
 }
 
+// fillDuration looks up the duration with yt-dlp and stores it on the session
+// if it is still unknown.
+func (a *API) fillDuration(id, url string) {
+	// Bounded so prepares can't pile up goroutines waiting for a permit
+	ctx, cancel := context.WithTimeout(context.Background(), 2*a.cfg.YtDLPTimeout)
+	defer cancel()
+	dur, err := a.dl.FetchDuration(ctx, url)
+	if err != nil {
+		return
+	}
+	sctx, scancel := a.storeCtx()
+	defer scancel()
+	s, err := a.sessions.GetSession(sctx, id)
+	if err != nil || s.Meta.Duration != 0 {
+		return
+	}
+	// Only the duration changes; saveSession drops the write if a worker
+	// moved the session on since it was read
+	s.Meta.Duration = dur
+	a.saveSession(sctx, s)
+}
+
+// groupStatus summarizes the child conversions of a fanned-out request.
+// Children that no longer exist are counted as failed.
+func (a *API) groupStatus(ctx context.Context, ids []string) *models.GroupStatus {
+	g := &models.GroupStatus{Total: len(ids)}
+	for _, id := range ids {
+		c, err := a.sessions.GetSession(ctx, id)
+		if err != nil {
+			g.Failed++
+			g.Children = append(g.Children, models.StatusResponse{ConversionID: id, Status: string(models.StateFailed), Error: "not found"})
+			continue
+		}
+		cs := models.StatusResponse{ConversionID: c.ID, Status: string(c.State), Error: c.Error, AssetHash: c.AssetHash, VariantHash: c.VariantHash, Cached: c.Cached, Quality: c.Quality, Format: c.Format}
+		cs.DownloadProgress, cs.ConversionProgress = sessionProgress(c)
+		cs.LastProgressAt = lastProgressAt(c)
+		switch c.State {
+		case models.StateCompleted:
+			g.Completed++
+			if c.OutputPath != "" {
+				cs.DownloadURL = sessionDownloadURL(c)
+			}
+		case models.StateFailed:
+			g.Failed++
+		}
+		g.Children = append(g.Children, cs)
+	}
+	g.Done = g.Completed+g.Failed == g.Total
+	return g
+}
+
+// activeSessionForURL returns the session last prepared under key (see
+// reuseKey) if it still exists and is still in progress; completed and
+// failed sessions are not reused.
+func (a *API) activeSessionForURL(ctx context.Context, key string) (*models.ConversionSession, bool) {
+	id, ok, err := a.sessions.FindByURL(ctx, key)
+	if err != nil || !ok {
+		return nil, false
+	}
+	s, err := a.sessions.GetSession(ctx, id)
+	if err != nil || s.State == models.StateFailed || s.State == models.StateCompleted {
+		return nil, false
+	}
+	return s, true
+}
+
+// reuseKey indexes prepared sessions for reuse=true: the caller (see
+// principal), so tenants never see each other's sessions, and the
+// canonical video, so any URL shape for it matches. It is hashed to keep API
+// keys out of store keys.
+func reuseKey(r *http.Request, rawURL string) string {
+	return util.HashString(principal(r) + "|" + util.CanonicalVideoID(rawURL))
+}
+
 func (a *API) handleConvertReq(w http.ResponseWriter, r *http.Request) {
 	var req models.ConvertRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ConversionID == "" {
-		writeErr(w, http.StatusBadRequest, "invalid request")
+	if !a.decodeBody(w, r, &req) {
 		return
 	}
+	if errs := req.Validate(a.validationRules()); len(errs) > 0 {
+		writeFieldErrs(w, errs)
+		return
+	}
+	a.applyDefaults(&req)
 	s, err := a.sessions.GetSession(r.Context(), req.ConversionID)
 	if err != nil {
-		writeErr(w, http.StatusNotFound, "session not found")
+		writeErr(w, http.StatusNotFound, CodeNotFound, "session not found")
+		return
+	}
+	if s.State == models.StateFailed {
+		if !a.retryable(s) {
+			msg := "session failed"
+			if s.Error != "" {
+				msg += ": " + s.Error
+			}
+			writeErr(w, http.StatusConflict, CodeSessionFailed, msg)
+			return
+		}
+		if !a.retryFailed(r, s) {
+			writeErr(w, http.StatusServiceUnavailable, CodeQueueFull, "queue full")
+			return
+		}
+	}
+	defaultStart(&req, s)
+	if req.SplitChapters {
+		a.submitChapters(w, r, s, req)
+		return
+	}
+	if len(req.Qualities) > 0 {
+		a.submitConvertGroup(w, r, s, req)
 		return
 	}
+	if len(req.Formats) > 0 {
+		a.submitFormats(w, r, s, req)
+		return
+	}
+	a.submitConvert(w, r, s, req)
+}
+
+// retryable reports whether /convert may retry failed session s: retries are
+// enabled and its failure is not permanent.
+func (a *API) retryable(s *models.ConversionSession) bool {
+	return a.cfg.RetryFailedSessions && !permanentFailures[s.FailureKind]
+}
+
+// retryFailed resets failed session s, whose failure is transient, so it can
+// be converted again. A source still on disk is reused; otherwise the
+// download is enqueued afresh unless another session already has it in
+// flight. It reports false, leaving s failed, if the download queue is full.
+func (a *API) retryFailed(r *http.Request, s *models.ConversionSession) bool {
+	log.Printf("retrying failed session %s (request %s): %s", s.ID, middleware.RequestIDFrom(r.Context()), s.Error)
+	note := "retrying after failure: " + s.Error
+	prevErr, prevKind := s.Error, s.FailureKind
+	s.Error = ""
+	s.FailureKind = ""
+	if s.SourcePath != "" {
+		if _, err := os.Stat(s.SourcePath); err == nil && a.safePath(s.SourcePath) {
+			s.State = models.StateDownloaded
+			s.Events = appendEvent(s.Events, s.State, note)
+			_ = a.sessions.UpdateSession(r.Context(), s)
+			return true
+		}
+	}
+	if s.AssetHash == "" {
+		s.AssetHash = util.HashString(util.CanonicalVideoID(s.URL))
+	}
+	s.SourcePath = ""
+	s.State = models.StateCreated
+	s.Events = appendEvent(s.Events, s.State, note)
+	// Failed states rank last, so saveSession would refuse this reset
+	_ = a.sessions.UpdateSession(r.Context(), s)
+	if _, state, ok, _ := a.sessions.GetAsset(r.Context(), s.AssetHash); ok && state != "" && state != string(models.StateFailed) {
+		return true
+	}
+	_ = a.sessions.SetAsset(r.Context(), s.AssetHash, "", string(models.StatePreparing))
+	job := queue.Job{ID: newID(), Type: queue.JobDownload, SessionID: s.ID, EnqueuedAt: time.Now(), Priority: 10, Deadline: a.jobDeadline(), TraceParent: tracing.Inject(r.Context()), RequestID: middleware.RequestIDFrom(r.Context())}
+	if !a.enqueue(a.dlQueue, job) {
+		// Nothing will download the asset; let the next prepare or retry
+		// start over
+		_ = a.sessions.DeleteAsset(r.Context(), s.AssetHash)
+		s.State = models.StateFailed
+		s.Error, s.FailureKind = prevErr, prevKind
+		_ = a.sessions.UpdateSession(r.Context(), s)
+		return false
+	}
+	return true
+}
+
+// defaultStart starts req at the session URL's "t" timestamp when it sets no
+// start_time of its own. Offsets past the known duration or end_time, and
+// chapter splits, which set their own bounds, are left alone.
+func defaultStart(req *models.ConvertRequest, s *models.ConversionSession) {
+	if req.StartTime != "" || req.SplitChapters || s.StartOffset <= 0 {
+		return
+	}
+	if s.Meta.Duration > 0 && s.StartOffset >= s.Meta.Duration {
+		return
+	}
+	start := strconv.Itoa(s.StartOffset)
+	// An explicit end_time before the offset wins
+	if _, _, ok := util.ParseClipBounds(start, req.EndTime, 0, 0); !ok {
+		return
+	}
+	req.StartTime = start
+}
+
+// checkPresets reports a preset whose quality label is missing from
+// qualityBitrates, which would otherwise pass validation and silently encode
+// at the CBR fallback.
+func checkPresets(qualityBitrates map[string]int) error {
+	names := make([]string, 0, len(models.Presets))
+	for name := range models.Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if q := models.Presets[name].Quality; qualityBitrates[string(q)] == 0 {
+			return fmt.Errorf("QUALITY_BITRATE_MAP: quality %q of preset %q is not in the map", q, name)
+		}
+	}
+	return nil
+}
+
+// applyDefaults resolves req's preset, then fills in DefaultQuality and
+// DefaultFormat where req leaves them unset. A request listing several
+// qualities or formats keeps those. req must already have passed Validate.
+func (a *API) applyDefaults(req *models.ConvertRequest) {
+	if p, ok := models.Presets[req.Preset]; ok {
+		req.Quality, req.SampleRate, req.Channels, req.Normalize = p.Quality, p.SampleRate, p.Channels, p.Normalize
+	}
+	if req.Quality == "" && len(req.Qualities) == 0 {
+		req.Quality = models.ConversionQuality(a.cfg.DefaultQuality)
+	}
+	if req.Format == "" && len(req.Formats) == 0 {
+		req.Format = a.cfg.DefaultFormat
+	}
+}
+
+// handleReconvert converts an already-downloaded source again with different
+// settings. It creates a new session sharing the original's cached source so
+// no download is enqueued, and returns 404 if the source has been cleaned up.
+func (a *API) handleReconvert(w http.ResponseWriter, r *http.Request) {
+	var req models.ConvertRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	if errs := req.Validate(a.validationRules()); len(errs) > 0 {
+		writeFieldErrs(w, errs)
+		return
+	}
+	if len(req.Qualities) > 0 || len(req.Formats) > 0 || req.SplitChapters {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "qualities, formats and split_chapters are only supported by /convert")
+		return
+	}
+	a.applyDefaults(&req)
+	orig, err := a.sessions.GetSession(r.Context(), req.ConversionID)
+	if err != nil {
+		writeErr(w, http.StatusNotFound, CodeNotFound, "session not found")
+		return
+	}
+	assetHash := orig.AssetHash
+	if assetHash == "" {
+		assetHash = util.HashString(util.CanonicalVideoID(orig.URL))
+	}
+	src, state, ok, _ := a.sessions.GetAsset(r.Context(), assetHash)
+	if !ok || src == "" || state != string(models.StateDownloaded) {
+		a.metrics.AssetCacheMisses.Add(1)
+		writeErr(w, http.StatusNotFound, CodeSourceExpired, "source no longer available; prepare again")
+		return
+	}
+	if _, err := os.Stat(src); err != nil || !a.safePath(src) {
+		a.metrics.AssetCacheMisses.Add(1)
+		writeErr(w, http.StatusNotFound, CodeSourceExpired, "source no longer available; prepare again")
+		return
+	}
+	a.metrics.AssetCacheHits.Add(1)
+	s := &models.ConversionSession{ID: newID(), URL: orig.URL, AssetHash: assetHash, SourcePath: src, State: models.StateDownloaded, Meta: orig.Meta, StartOffset: orig.StartOffset}
+	defaultStart(&req, s)
+	if err := a.createSession(r.Context(), s); err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to create session")
+		return
+	}
+	a.submitConvert(w, r, s, req)
+}
+
+// submitConvert validates req against session s and either completes it from
+// the variant cache or enqueues a convert job, writing the 202 response.
+func (a *API) submitConvert(w http.ResponseWriter, r *http.Request, s *models.ConversionSession, req models.ConvertRequest) {
+	if code, msg := a.validateConvert(s, req); code != "" {
+		writeErr(w, http.StatusBadRequest, code, msg)
+		return
+	}
+	wait := r.URL.Query().Get("wait") == "true"
+	var done chan struct{}
+	if wait {
+		done = make(chan struct{}, 1)
+	}
+	resp, job, ok := a.enqueueConvert(r, s, req, done)
+	if !ok {
+		writeErr(w, http.StatusServiceUnavailable, CodeQueueFull, "queue full")
+		return
+	}
+	if wait && job.ID != "" && a.awaitJob(w, r, job) {
+		return
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// validateConvert checks req against session s, returning a client error
+// code and message, or an empty code when the request is acceptable.
+func (a *API) validateConvert(s *models.ConversionSession, req models.ConvertRequest) (ErrorCode, string) {
     // Validation: check if video duration exceeds maximum allowed
     total := s.Meta.Duration
     if total < 0 { total = 0 }
     
     // Check if video duration exceeds maximum allowed
     if total > 0 && total > a.cfg.MaxVideoDurationSeconds {
-        writeErr(w, http.StatusBadRequest, fmt.Sprintf("Video too long. Maximum allowed duration is %s", formatDuration(a.cfg.MaxVideoDurationSeconds)))
-        return
+        return CodeVideoTooLong, fmt.Sprintf("Video too long. Maximum allowed duration is %s", formatDuration(a.cfg.MaxVideoDurationSeconds))
     }
     
-    // Basic validation for start/end times (no clip length limit)
-    if _, _, ok := util.ParseClipBounds(req.StartTime, req.EndTime, 0, total); !ok {
-        writeErr(w, http.StatusBadRequest, "invalid start/end time format")
-        return
+    if !a.qualityAvailable(req.Quality) {
+        return CodeUnsupported, "unsupported quality"
+    }
+    if !a.formatAvailable(req.Format) {
+        return CodeUnsupported, "format not supported by this server's ffmpeg"
     }
+    // Clip length can't be bounded without a duration or explicit end time
+    if a.cfg.MaxClipSeconds > 0 && total == 0 && strings.TrimSpace(req.EndTime) == "" {
+        return CodeDurationUnknown, "video duration unknown; end_time is required"
+    }
+    // Validate start/end times and clip length
+    if _, _, ok := util.ParseClipBounds(req.StartTime, req.EndTime, a.cfg.MaxClipSeconds, total); !ok {
+        // Bounds that are only rejected by the length limit are too long,
+        // not malformed
+        if _, _, ok := util.ParseClipBounds(req.StartTime, req.EndTime, 0, total); ok {
+            return CodeClipTooLong, fmt.Sprintf("Clip too long. Maximum allowed clip length is %s", formatDuration(a.cfg.MaxClipSeconds))
+        }
+        return CodeInvalidTime, "start/end time outside the video"
+    }
+	return "", ""
+}
+
+// enqueueConvert completes s from the variant cache or enqueues a convert
+// job for it, returning the accepted response and the job (zero when served
+// from cache). ok is false when the convert queue is full. done, if non-nil,
+// is attached to the job so the caller can wait for it.
+func (a *API) enqueueConvert(r *http.Request, s *models.ConversionSession, req models.ConvertRequest, done chan struct{}) (models.ConvertAcceptedResponse, queue.Job, bool) {
 	// Always accept and enqueue conversion asynchronously. If source not ready,
 	// workers will re-enqueue after a short delay until download completes.
-	// Variant hash (url + quality + range)
-	s.AssetHash = util.HashString(util.CanonicalVideoID(s.URL))
-	s.VariantHash = util.HashString(s.AssetHash + "|" + string(req.Quality) + "|" + req.StartTime + "|" + req.EndTime)
+	// Variant hash (url + quality + range); uploads already carry a
+	// content-hash asset
+	if s.AssetHash == "" {
+		s.AssetHash = util.HashString(util.CanonicalVideoID(s.URL))
+	}
+	if v := a.variantHash(s.AssetHash, requestOptions(req)); v != s.VariantHash {
+		s.VariantHash = v
+		s.ConversionProgress = 0
+		s.TempOutputPath = ""
+	}
+	s.Quality = req.Quality
+	s.Format = req.Format
+	s.ClientRef = req.ClientRef
+	s.Cached = false
+	s.RequestID = middleware.RequestIDFrom(r.Context())
 	_ = a.sessions.UpdateSession(r.Context(), s)
 	// Fast-complete if variant already exists
 	if out, ok, _ := a.sessions.GetVariant(r.Context(), s.VariantHash); ok && out != "" {
+		a.metrics.VariantCacheHits.Add(1)
 		s.OutputPath = out
 		s.State = models.StateCompleted
+		s.Cached = true
+		s.Encoding = a.encoding(r.Context(), out, requestOptions(req))
 		_ = a.sessions.UpdateSession(r.Context(), s)
-		writeJSON(w, http.StatusAccepted, models.ConvertAcceptedResponse{ConversionID: s.ID, Status: string(s.State), QueuePosition: 0, Message: "Reused existing converted output."})
-		return
+		return models.ConvertAcceptedResponse{ConversionID: s.ID, Status: string(s.State), QueuePosition: 0, Message: "Reused existing converted output.", AssetHash: s.AssetHash, VariantHash: s.VariantHash, Cached: true}, queue.Job{}, true
 	}
+	// Misses are counted by handleConvert, which may still find the variant
+	// once another job has produced it
     // Determine if source is already ready to avoid unnecessary 'queued' bounce
     sourceReady := false
     if s.SourcePath != "" {
@@ -272,25 +1364,28 @@ func (a *API) handleConvertReq(w http.ResponseWriter, r *http.Request) {
         }
     }
 
-    // Map API key to job priority (simple heuristic: premium > default)
 	apiKey := r.Header.Get("X-API-Key")
-	priority := 5
-	lk := strings.ToLower(apiKey)
-	if strings.HasPrefix(lk, "premium") || strings.HasPrefix(lk, "pro") || strings.HasPrefix(lk, "vip") {
-		priority = 50
+	tier := a.cfg.APIKeyTiers[apiKey]
+	if c, ok := middleware.ClaimsFrom(r.Context()); ok {
+		tier = c.Tier
 	}
-	job := queue.Job{ID: newID(), Type: queue.JobConvert, SessionID: s.ID, Quality: string(req.Quality), StartTime: req.StartTime, EndTime: req.EndTime, EnqueuedAt: time.Now(), Priority: priority, ApiKey: apiKey}
-	if !a.cvQueue.Enqueue(job) {
-		writeErr(w, http.StatusServiceUnavailable, "queue full")
-		return
-	}
-    // If the source is ready, reflect a more immediate state; otherwise mark queued
+	priority := jobPriority(tier, req.Priority)
+	job := queue.Job{ID: newID(), Type: queue.JobConvert, SessionID: s.ID, Quality: string(req.Quality), StartTime: req.StartTime, EndTime: req.EndTime, SampleRate: req.SampleRate, Channels: req.Channels, Precise: req.Precise, Format: req.Format, Normalize: req.Normalize, EnqueuedAt: time.Now(), Priority: priority, ApiKey: apiKey, Principal: principal(r), Deadline: a.jobDeadline(), TraceParent: tracing.Inject(r.Context()), RequestID: s.RequestID, Done: done}
+    // If the source is ready, reflect a more immediate state; otherwise mark
+    // queued. This is saved before enqueueing so it can't overwrite the
+    // progress of a worker that picks the job up straight away.
+    prev := s.State
     if sourceReady {
         s.State = models.StateConverting
     } else {
         s.State = models.StateQueued
     }
     _ = a.sessions.UpdateSession(r.Context(), s)
+	if !a.enqueue(a.cvQueue, job) {
+		s.State = prev
+		_ = a.sessions.UpdateSession(r.Context(), s)
+		return models.ConvertAcceptedResponse{}, job, false
+	}
 	// Report position in the convert queue and current download state
 	position := a.cvQueue.PositionForSession(queue.JobConvert, s.ID)
     msg := "Conversion request accepted."
@@ -301,102 +1396,575 @@ func (a *API) handleConvertReq(w http.ResponseWriter, r *http.Request) {
     }
     // Report more accurate status in response to reduce UI flicker
     respStatus := string(s.State)
-    writeJSON(w, http.StatusAccepted, models.ConvertAcceptedResponse{
+    return models.ConvertAcceptedResponse{
 		ConversionID:  s.ID,
         Status:        respStatus,
-		QueuePosition: position,
-		Message:       msg,
+		QueuePosition:        position,
+		EstimatedWaitSeconds: a.estimateWait(position),
+		Message:              msg,
+		AssetHash:            s.AssetHash,
+		VariantHash:          s.VariantHash,
+	}, job, true
+}
+
+// submitConvertGroup converts session s at several qualities at once. Each
+// quality gets a child session sharing s's source and its own variant; s
+// records the children so /status can report the group's progress.
+func (a *API) submitConvertGroup(w http.ResponseWriter, r *http.Request, s *models.ConversionSession, req models.ConvertRequest) {
+	if code, msg := a.validateConvert(s, req); code != "" {
+		writeErr(w, http.StatusBadRequest, code, msg)
+		return
+	}
+	children := make([]childConvert, 0, len(req.Qualities))
+	for _, q := range req.Qualities {
+		childReq := req
+		childReq.Quality = q
+		childReq.Qualities = nil
+		children = append(children, childConvert{req: childReq, meta: s.Meta})
+	}
+	a.fanOut(w, r, s, children)
+}
+
+// submitFormats converts session s into each requested container format, one
+// child per format sharing s's source and its own variant.
+func (a *API) submitFormats(w http.ResponseWriter, r *http.Request, s *models.ConversionSession, req models.ConvertRequest) {
+	if code, msg := a.validateConvert(s, req); code != "" {
+		writeErr(w, http.StatusBadRequest, code, msg)
+		return
+	}
+	children := make([]childConvert, 0, len(req.Formats))
+	for _, f := range req.Formats {
+		childReq := req
+		childReq.Format = f
+		childReq.Formats = nil
+		children = append(children, childConvert{req: childReq, meta: s.Meta, byFormat: true})
+	}
+	a.fanOut(w, r, s, children)
+}
+
+// submitChapters splits session s into one conversion per chapter of the
+// video, each a clip over the chapter's bounds titled after it.
+func (a *API) submitChapters(w http.ResponseWriter, r *http.Request, s *models.ConversionSession, req models.ConvertRequest) {
+	if s.URL == "" {
+		writeErr(w, http.StatusBadRequest, CodeNoChapters, "no chapters available for this conversion")
+		return
+	}
+	chapters, err := a.dl.FetchChapters(r.Context(), s.URL)
+	if err != nil {
+		writeErr(w, http.StatusBadGateway, CodeUpstreamError, "failed to fetch chapters")
+		return
+	}
+	if len(chapters) == 0 {
+		writeErr(w, http.StatusBadRequest, CodeNoChapters, "video has no chapters")
+		return
+	}
+	if len(chapters) > a.cfg.MaxChapters {
+		writeErr(w, http.StatusBadRequest, CodeTooManyChapters, fmt.Sprintf("video has %d chapters; at most %d can be split", len(chapters), a.cfg.MaxChapters))
+		return
+	}
+	children := make([]childConvert, 0, len(chapters))
+	for i, ch := range chapters {
+		childReq := req
+		childReq.SplitChapters = false
+		childReq.StartTime = strconv.FormatFloat(ch.Start, 'f', 3, 64)
+		childReq.EndTime = strconv.FormatFloat(ch.End, 'f', 3, 64)
+		if code, msg := a.validateConvert(s, childReq); code != "" {
+			writeErr(w, http.StatusBadRequest, code, fmt.Sprintf("chapter %d: %s", i+1, msg))
+			return
+		}
+		meta := s.Meta
+		meta.Title = ch.Title
+		if meta.Title == "" {
+			meta.Title = fmt.Sprintf("%s - Chapter %d", s.Meta.Title, i+1)
+		}
+		children = append(children, childConvert{req: childReq, meta: meta, byChapter: true})
+	}
+	a.fanOut(w, r, s, children)
+}
+
+// childConvert is one conversion of a fanned-out request.
+type childConvert struct {
+	req  models.ConvertRequest
+	meta models.MetaLite
+	// byFormat lists the child under its format in the response's
+	// download_urls.
+	byFormat bool
+	// byChapter appends the child's download URL to the response's
+	// chapter_download_urls.
+	byChapter bool
+}
+
+// fanOut creates a child session of s for each entry, sharing s's source,
+// enqueues their conversions and writes the group response. s records the
+// children so /status can report the group's progress.
+func (a *API) fanOut(w http.ResponseWriter, r *http.Request, s *models.ConversionSession, children []childConvert) {
+	resp := models.ConvertGroupResponse{ConversionID: s.ID, Status: string(s.State), Message: "Conversion requests accepted."}
+	var jobs []queue.Job
+	prior := len(s.Children)
+	for _, c := range children {
+		child := &models.ConversionSession{ID: newID(), URL: s.URL, AssetHash: s.AssetHash, SourcePath: s.SourcePath, State: s.State, Meta: c.meta, ParentID: s.ID}
+		if err := a.createSession(r.Context(), child); err != nil {
+			a.rollbackFanOut(r.Context(), s, prior, jobs)
+			writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to create session")
+			return
+		}
+		cr, job, ok := a.enqueueConvert(r, child, c.req, nil)
+		if !ok {
+			_ = a.deleteSession(r.Context(), child.ID)
+			a.rollbackFanOut(r.Context(), s, prior, jobs)
+			writeErr(w, http.StatusServiceUnavailable, CodeQueueFull, "queue full")
+			return
+		}
+		job.SessionID = child.ID
+		jobs = append(jobs, job)
+		s.Children = append(s.Children, child.ID)
+		resp.Children = append(resp.Children, cr)
+		if c.byFormat {
+			if resp.DownloadURLs == nil {
+				resp.DownloadURLs = map[string]string{}
+			}
+			resp.DownloadURLs[outputExt(child.Format)] = sessionDownloadURL(child)
+		}
+		if c.byChapter {
+			resp.ChapterDownloadURLs = append(resp.ChapterDownloadURLs, sessionDownloadURL(child))
+		}
+	}
+	_ = a.sessions.UpdateSession(r.Context(), s)
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// rollbackFanOut undoes a fan-out that failed partway. The first prior
+// children of s predate it. Children whose jobs are still queued are dequeued
+// and deleted; children a worker has already taken (or that completed from
+// the variant cache) stay recorded on s so /status still reports them.
+func (a *API) rollbackFanOut(ctx context.Context, s *models.ConversionSession, prior int, jobs []queue.Job) {
+	s.Children = s.Children[:prior]
+	for _, j := range jobs {
+		if j.ID != "" && a.cvQueue.Remove(j.ID) {
+			a.metrics.QueuedJobs.Add(-1)
+			_ = a.deleteSession(ctx, j.SessionID)
+			continue
+		}
+		s.Children = append(s.Children, j.SessionID)
+	}
+	_ = a.sessions.UpdateSession(ctx, s)
+}
+
+// priorityTier bounds the convert priority a caller may request.
+type priorityTier struct {
+	Min, Max, Default int
+}
+
+// priorityTiers are keyed by the tier names used in API_KEY_TIERS.
+var priorityTiers = map[string]priorityTier{
+	"free":    {Min: 1, Max: 10, Default: 5},
+	"premium": {Min: 1, Max: 100, Default: 50},
+}
+
+// jobPriority resolves the queue priority for a convert request: the tier
+// default when requested is 0, otherwise requested clamped to the tier range.
+// Unknown or empty tiers get the free tier.
+func jobPriority(tierName string, requested int) int {
+	tier, ok := priorityTiers[tierName]
+	if !ok {
+		tier = priorityTiers["free"]
+	}
+	switch {
+	case requested == 0:
+		return tier.Default
+	case requested < tier.Min:
+		return tier.Min
+	case requested > tier.Max:
+		return tier.Max
+	}
+	return requested
+}
+
+// awaitJob blocks until job finishes and writes its final status, returning
+// true. It returns false without writing if SyncWaitTimeout elapses first or
+// the client goes away, leaving the caller to answer with a 202.
+func (a *API) awaitJob(w http.ResponseWriter, r *http.Request, job queue.Job) bool {
+	timer := time.NewTimer(a.cfg.SyncWaitTimeout)
+	defer timer.Stop()
+	select {
+	case <-job.Done:
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+	s, err := a.sessions.GetSession(r.Context(), job.SessionID)
+	if err != nil {
+		return false
+	}
+	resp := models.StatusResponse{ConversionID: s.ID, Status: string(s.State), Error: s.Error, AssetHash: s.AssetHash, VariantHash: s.VariantHash, Cached: s.Cached}
+	if s.State == models.StateCompleted && s.OutputPath != "" {
+		resp.DownloadURL = sessionDownloadURL(s)
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return true
+}
+
+// handleEstimate reports the expected duration and size of converting a
+// prepared session with the given options, validating and defaulting them as
+// /convert does so the variant it checks for is the one /convert would make.
+func (a *API) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	var body models.EstimateRequest
+	if !a.decodeBody(w, r, &body) {
+		return
+	}
+	req := body.ConvertRequest
+	if errs := req.Validate(a.validationRules()); len(errs) > 0 {
+		writeFieldErrs(w, errs)
+		return
+	}
+	if len(req.Qualities) > 0 || len(req.Formats) > 0 || req.SplitChapters {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "qualities, formats and split_chapters are only supported by /convert")
+		return
+	}
+	a.applyDefaults(&req)
+	s, err := a.sessions.GetSession(r.Context(), req.ConversionID)
+	if err != nil {
+		writeErr(w, http.StatusNotFound, CodeNotFound, "session not found")
+		return
+	}
+	defaultStart(&req, s)
+	if code, msg := a.validateConvert(s, req); code != "" {
+		writeErr(w, http.StatusBadRequest, code, msg)
+		return
+	}
+	total := max(s.Meta.Duration, 0)
+	// Without MAX_CLIP_SECONDS validateConvert lets this through, but there
+	// is still nothing to size the output by
+	if total == 0 && strings.TrimSpace(req.EndTime) == "" {
+		writeErr(w, http.StatusBadRequest, CodeDurationUnknown, "video duration unknown; end_time is required")
+		return
+	}
+	start, end, _ := util.ParseClipBounds(req.StartTime, req.EndTime, 0, total)
+	dur := total
+	if end > 0 {
+		dur = end
+	}
+	dur = max(dur-start, 0)
+	kbps := a.conv.BitrateKbps(string(req.Quality))
+	assetHash := s.AssetHash
+	if assetHash == "" {
+		assetHash = util.HashString(util.CanonicalVideoID(s.URL))
+	}
+	out, cached, _ := a.sessions.GetVariant(r.Context(), a.variantHash(assetHash, requestOptions(req)))
+	writeJSON(w, http.StatusOK, models.EstimateResponse{
+		ConversionID:    s.ID,
+		DurationSeconds: dur,
+		BitrateKbps:     kbps,
+		EstimatedBytes:  int64(dur) * int64(kbps) * 1000 / 8,
+		Cached:          cached && out != "",
 	})
 }
 
+func (a *API) handleFormats(w http.ResponseWriter, r *http.Request) {
+	resp := models.FormatsResponse{
+		Qualities:               a.qualities(),
+		Formats:                 a.availableFormats(),
+		DefaultQuality:          models.ConversionQuality(a.cfg.DefaultQuality),
+		DefaultFormat:           a.cfg.DefaultFormat,
+		Presets:                 models.Presets,
+		QualityBitrates:         a.cfg.QualityBitrates,
+		EncodingMode:            strings.ToUpper(a.cfg.FFmpegMode),
+		MaxVideoDurationSeconds: a.cfg.MaxVideoDurationSeconds,
+		SampleRates:             models.SupportedSampleRates,
+		Channels:                models.SupportedChannels,
+	}
+	if resp.EncodingMode == string(converter.ModeCBR) {
+		resp.CBRBitrate = a.cfg.FFmpegCBRBitrate
+		if resp.DefaultQuality == "" {
+			resp.DefaultQuality = models.ConversionQuality(strings.TrimSuffix(strings.ToLower(a.cfg.FFmpegCBRBitrate), "k"))
+		}
+	} else {
+		q := a.cfg.FFmpegVBRQ
+		resp.VBRQuality = &q
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 func (a *API) handleStatus(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	s, err := a.sessions.GetSession(r.Context(), id)
 	if err != nil {
-		writeErr(w, http.StatusNotFound, "not found")
+		writeErr(w, http.StatusNotFound, CodeNotFound, "not found")
 		return
 	}
 	downloadURL := ""
 	if s.State == models.StateCompleted && s.OutputPath != "" {
 		// Prefer stable session-based download URL
-		downloadURL = "/download/" + s.ID + ".mp3"
+		downloadURL = sessionDownloadURL(s)
 	}
 	// Use proper capitalization for all states
 	status := string(s.State)
-	resp := models.StatusResponse{ConversionID: s.ID, Status: status, DownloadURL: downloadURL}
+	resp := models.StatusResponse{ConversionID: s.ID, Status: status, DownloadURL: downloadURL, AssetHash: s.AssetHash, VariantHash: s.VariantHash, Cached: s.Cached}
+	resp.DownloadProgress, resp.ConversionProgress = sessionProgress(s)
+	resp.LastProgressAt = lastProgressAt(s)
 	if s.State == models.StateQueued {
 		resp.QueuePosition = a.cvQueue.PositionForSession(queue.JobConvert, s.ID)
+		resp.EstimatedWaitSeconds = a.estimateWait(resp.QueuePosition)
 	}
 	if s.Error != "" {
 		resp.Error = s.Error
 	}
+	if s.State == models.StateFailed {
+		resp.RequestID = s.RequestID
+	}
+	if len(s.Children) > 0 {
+		resp.Group = a.groupStatus(r.Context(), s.Children)
+	}
+	if s.State == models.StateCompleted {
+		resp.Encoding = s.Encoding
+	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
 func (a *API) handleDelete(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	s, _ := a.sessions.GetSession(r.Context(), id)
-	_ = a.sessions.DeleteSession(r.Context(), id)
-	if s != nil {
-		if s.OutputPath != "" {
+	if s == nil {
+		// Not counted (or already gone); delete anyway without uncounting
+		_ = a.sessions.DeleteSession(r.Context(), id)
+	} else {
+		_ = a.deleteSession(r.Context(), id)
+		if s.OutputPath != "" && a.safePath(s.OutputPath) {
 			_ = os.Remove(s.OutputPath)
 		}
-		if s.SourcePath != "" {
+		if s.SourcePath != "" && a.safePath(s.SourcePath) {
 			_ = os.Remove(s.SourcePath)
 		}
 	}
 	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "message": "Conversion data removed successfully."})
 }
 
-func (a *API) handleDownload(job queue.Job) {
-	ctx := context.Background()
-	s, err := a.sessions.GetSession(ctx, job.SessionID)
+// handlePurge drops the cached source and every known converted variant of a
+// URL, removing their files so the next request downloads again. Variants are
+// found through the sessions that reference the asset.
+func (a *API) handlePurge(w http.ResponseWriter, r *http.Request) {
+	var req models.PurgeRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	if req.URL == "" {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request")
+		return
+	}
+	ctx := r.Context()
+	assetHash := util.HashString(util.CanonicalVideoID(req.URL))
+	resp := models.PurgeResponse{AssetHash: assetHash}
+	remove := func(path string) {
+		if path != "" && a.safePath(path) && os.Remove(path) == nil {
+			resp.FilesRemoved++
+		}
+	}
+	sessions, err := a.sessions.ListSessions(ctx)
 	if err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to list sessions")
+		return
+	}
+	seen := map[string]struct{}{}
+	for _, s := range sessions {
+		if s.AssetHash != assetHash || s.VariantHash == "" {
+			continue
+		}
+		if _, ok := seen[s.VariantHash]; ok {
+			continue
+		}
+		seen[s.VariantHash] = struct{}{}
+		if out, ok, _ := a.sessions.GetVariant(ctx, s.VariantHash); ok {
+			remove(out)
+		}
+		for _, f := range models.SupportedFormats {
+			remove(filepath.Join(a.cfg.ConversionsDir, "outputs", s.VariantHash+"."+f))
+		}
+		_ = a.sessions.DeleteVariant(ctx, s.VariantHash)
+		resp.VariantsPurged++
+	}
+	if src, _, ok, _ := a.sessions.GetAsset(ctx, assetHash); ok {
+		remove(src)
+	}
+	remove(filepath.Join(a.cfg.ConversionsDir, "streams", assetHash+".source"))
+	if err := a.sessions.DeleteAsset(ctx, assetHash); err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to purge asset")
+		return
+	}
+	log.Printf("purged asset %s (%d variants, %d files, request %s)", assetHash, resp.VariantsPurged, resp.FilesRemoved, middleware.RequestIDFrom(r.Context()))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleWarm pre-downloads sources for the given URLs at low priority so
+// later prepares find them cached. No sessions are created.
+func (a *API) handleWarm(w http.ResponseWriter, r *http.Request) {
+	var req models.WarmRequest
+	if !a.decodeBody(w, r, &req) {
+		return
+	}
+	if len(req.URLs) == 0 {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request")
+		return
+	}
+	var resp models.WarmResponse
+	for _, u := range req.URLs {
+		if u == "" || !util.IsAllowedDomain(u, a.current().AllowedDomains) {
+			resp.Rejected = append(resp.Rejected, u)
+			continue
+		}
+		assetHash := util.HashString(util.CanonicalVideoID(u))
+		if _, state, ok, _ := a.sessions.GetAsset(r.Context(), assetHash); ok && state != "" && state != string(models.StateFailed) {
+			resp.Cached++
+			continue
+		}
+		_ = a.sessions.SetAsset(r.Context(), assetHash, "", string(models.StatePreparing))
+		job := queue.Job{ID: newID(), Type: queue.JobDownload, URL: u, EnqueuedAt: time.Now(), Priority: 1, Deadline: a.jobDeadline(), RequestID: middleware.RequestIDFrom(r.Context())}
+		if !a.enqueue(a.dlQueue, job) {
+			_ = a.sessions.DeleteAsset(r.Context(), assetHash)
+			writeJSON(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+		resp.Enqueued++
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// handleMetricsReset zeroes the metric counters so tests can assert deltas.
+// Only routed when DevMode is on.
+func (a *API) handleMetricsReset(w http.ResponseWriter, r *http.Request) {
+	a.metrics.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleQueue lists the next jobs in each queue (?limit=N, default 20) so
+// operators can see what is waiting or stuck.
+func (a *API) handleQueue(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "invalid limit")
+			return
+		}
+		limit = n
+	}
+	view := func(jobs []queue.Job) []models.QueuedJob {
+		out := make([]models.QueuedJob, 0, len(jobs))
+		for _, j := range jobs {
+			out = append(out, models.QueuedJob{ID: j.ID, Type: j.Type.String(), SessionID: j.SessionID, Priority: j.Priority, EnqueuedAt: j.EnqueuedAt, Attempts: j.Attempts})
+		}
+		return out
+	}
+	writeJSON(w, http.StatusOK, models.QueueSnapshotResponse{
+		Download:    view(a.dlQueue.Snapshot(limit)),
+		Convert:     view(a.cvQueue.Snapshot(limit)),
+		DownloadLen: a.dlQueue.Len(),
+		ConvertLen:  a.cvQueue.Len(),
+	})
+}
+
+func (a *API) handleDownload(job queue.Job) {
+	ctx, cancel := a.storeCtx()
+	defer cancel()
+	var s *models.ConversionSession
+	var err error
+	if job.SessionID == "" {
+		// Warm-up download: only the asset cache is populated
+		s = &models.ConversionSession{URL: job.URL}
+	} else if s, err = a.sessions.GetSession(ctx, job.SessionID); err != nil {
 		return
 	}
-	s.State = models.StateDownloading
-	_ = a.sessions.UpdateSession(ctx, s)
-    start := time.Now()
 	// store by asset hash under streams/ so future sessions reuse it
 	if s.AssetHash == "" {
 		s.AssetHash = util.HashString(util.CanonicalVideoID(s.URL))
 	}
+	if job.Expired(time.Now()) {
+		a.failJob(ctx, s, job, failDeadline, "job deadline exceeded")
+		return
+	}
+	if job.Stale(time.Now(), a.cfg.MaxQueueWait) {
+		a.metrics.QueueWaitExceeded.Add(1)
+		a.failJob(ctx, s, job, failQueueWait, "queue wait exceeded")
+		return
+	}
+	s.State = models.StateDownloading
+	a.saveSession(ctx, s)
+	logger := jobLogger(job, s)
+	logger.Debug("download started", "attempt", job.Attempts)
+    start := time.Now()
 	out := filepath.Join(a.cfg.ConversionsDir, "streams", s.AssetHash+".source")
-	err = a.dl.Download(ctx, s.URL, out, func(p int) {
-		// Progress tracking removed - using "initializing" status instead
-	})
+	if !a.safePath(out) {
+		a.failJob(ctx, s, job, failInvalidPath, "invalid source path")
+		return
+	}
+	defer a.markInUse(out)()
+	jobCtx, jobCancel := job.Context(context.Background())
+	defer jobCancel()
+	spanCtx, span := tracing.Start(tracing.Extract(jobCtx, job.TraceParent), "download",
+		attribute.String("ytmp3.asset_hash", s.AssetHash),
+		attribute.String("ytmp3.session_id", s.ID),
+		attribute.Int("ytmp3.attempt", job.Attempts))
+	tmp := a.tempPath(out, job.ID)
+	defer a.markInUse(tmp)()
+	err = a.dl.Download(spanCtx, s.URL, tmp, a.downloadProgress(s.ID))
+	if err == nil {
+		err = os.Rename(tmp, out)
+	}
+	span.SetAttributes(attribute.Float64("ytmp3.elapsed_s", time.Since(start).Seconds()))
+	tracing.End(span, err)
+	// The download may have outlived the first store deadline
+	ctx, cancel = a.storeCtx()
+	defer cancel()
     if err != nil {
         job.Attempts++
-        if job.Attempts < a.cfg.MaxJobRetries {
-            backoff := time.Duration(1<<job.Attempts) * time.Second
-            if backoff > 60*time.Second { backoff = 60 * time.Second }
+        if job.Attempts < a.cfg.MaxJobRetries && !permanentFailures[failureKind(err)] {
+            backoff := queue.Backoff(job.Attempts, 60*time.Second)
+            logger.Warn("download failed; retrying", "attempt", job.Attempts, "backoff", backoff, "kind", failureKind(err), "error", err)
+            a.recordEvent(ctx, s, fmt.Sprintf("download attempt %d failed, retrying in %s: %v", job.Attempts, backoff.Round(time.Second), err))
             go func(j queue.Job) {
                 time.Sleep(backoff)
-                a.dlQueue.Enqueue(j)
+                a.enqueue(a.dlQueue, j)
             }(job)
         } else {
-            s.State = models.StateFailed
-            s.Error = err.Error()
-            _ = a.sessions.UpdateSession(ctx, s)
-            _ = a.sessions.SetAsset(ctx, s.AssetHash, "", string(models.StateFailed))
-            a.metrics.ErrorCount.Add(1)
+            removeTemp(tmp)
+            a.failJob(ctx, s, job, failureKind(err), err.Error())
         }
         return
     }
     a.metrics.SuccessCount.Add(1)
     a.metrics.ObserveDuration(time.Since(start).Seconds(), false)
+	logger.Info("download completed", "duration", time.Since(start))
 	s.SourcePath = out
 	s.State = models.StateDownloaded
-	_ = a.sessions.UpdateSession(ctx, s)
+	a.saveSession(ctx, s)
 	_ = a.sessions.SetAsset(ctx, s.AssetHash, out, string(models.StateDownloaded))
+	a.metrics.CompletedJobs.Add(1)
 }
 
 func (a *API) handleConvert(job queue.Job) {
-	ctx := context.Background()
+	// Wake synchronous waiters on every exit except a re-enqueue, which
+	// hands the job (and its Done) to a later run
+	requeued := false
+	defer func() {
+		if !requeued {
+			job.Finish()
+		}
+	}()
+	ctx, cancel := a.storeCtx()
+	defer cancel()
 	s, err := a.sessions.GetSession(ctx, job.SessionID)
 	if err != nil {
 		return
 	}
+	if job.Expired(time.Now()) {
+		a.failJob(ctx, s, job, failDeadline, "job deadline exceeded")
+		return
+	}
+	if job.Stale(time.Now(), a.cfg.MaxQueueWait) {
+		a.metrics.QueueWaitExceeded.Add(1)
+		a.failJob(ctx, s, job, failQueueWait, "queue wait exceeded")
+		return
+	}
     start := time.Now()
     // Attempt to hydrate missing SourcePath from the shared asset cache.
     // This allows new sessions for the same URL to convert immediately
@@ -408,104 +1976,381 @@ func (a *API) handleConvert(job queue.Job) {
         if src, state, ok, _ := a.sessions.GetAsset(ctx, s.AssetHash); ok && src != "" && state == string(models.StateDownloaded) {
             s.SourcePath = src
             s.State = models.StateDownloaded
-            _ = a.sessions.UpdateSession(ctx, s)
+            a.saveSession(ctx, s)
         }
     }
+	// A failed download will never produce a source; fail instead of waiting
+	if s.SourcePath == "" {
+		if _, state, ok, _ := a.sessions.GetAsset(ctx, s.AssetHash); ok && state == string(models.StateFailed) {
+			msg := "source download failed"
+			if s.Error != "" {
+				msg += ": " + s.Error
+			}
+			// Keep the download's own kind, e.g. unavailable, when this
+			// session ran it
+			kind := failSource
+			if s.FailureKind != "" {
+				kind = s.FailureKind
+			}
+			a.failJob(ctx, s, job, kind, msg)
+			return
+		}
+	}
 	// Wait until download finishes; if not ready, re-enqueue shortly
 	if s.SourcePath == "" || s.State == models.StateDownloading || s.State == models.StatePreparing || s.State == models.StateCreated {
+		job.SourceWaits++
+		if a.cfg.MaxSourceWaits > 0 && job.SourceWaits > a.cfg.MaxSourceWaits {
+			a.failJob(ctx, s, job, failSourceWait, "source never became ready")
+			return
+		}
+		requeued = true
 		go func(j queue.Job) {
 			// Re-enqueue without mutating the session to avoid overwriting newer fields
 			time.Sleep(5 * time.Second)
-			a.cvQueue.Enqueue(j)
+			if !a.enqueue(a.cvQueue, j) {
+				j.Finish()
+			}
 		}(job)
 		return
 	}
-	// Only set to Converting when source is actually ready
-	s.State = models.StateConverting
-	_ = a.sessions.UpdateSession(ctx, s)
 	if s.AssetHash == "" {
 		s.AssetHash = util.HashString(util.CanonicalVideoID(s.URL))
 	}
 	if s.VariantHash == "" {
-		s.VariantHash = util.HashString(s.AssetHash + "|" + job.Quality + "|" + job.StartTime + "|" + job.EndTime)
+		s.VariantHash = a.variantHash(s.AssetHash, jobOptions(job))
+	}
+	// Another job may have produced this variant while this one was queued
+	if out, ok, _ := a.sessions.GetVariant(ctx, s.VariantHash); ok && out != "" && a.safePath(out) {
+		if _, err := os.Stat(out); err == nil {
+			a.metrics.VariantCacheHits.Add(1)
+			s.OutputPath = out
+			s.State = models.StateCompleted
+			s.Cached = true
+			s.Encoding = a.encoding(ctx, out, jobOptions(job))
+			a.saveSession(ctx, s)
+			a.metrics.CompletedJobs.Add(1)
+			return
+		}
+	}
+	// Retries of a failed encode were counted on their first attempt
+	if job.Attempts == 0 {
+		a.metrics.VariantCacheMisses.Add(1)
 	}
-	out := filepath.Join(a.cfg.ConversionsDir, "outputs", s.VariantHash+".mp3")
+	logger := jobLogger(job, s).With("variant", s.VariantHash)
+	logger.Debug("convert started", "attempt", job.Attempts, "quality", job.Quality, "format", job.Format)
+	out := filepath.Join(a.cfg.ConversionsDir, "outputs", s.VariantHash+"."+outputExt(s.Format))
+	if !a.safePath(out) || !a.safePath(s.SourcePath) {
+		a.failJob(ctx, s, job, failInvalidPath, "invalid output or source path")
+		return
+	}
+	tmp := a.tempPath(out, job.ID)
+	// Only set to Converting when source is actually ready. The temp path
+	// is recorded so ?stream=true can tail the file ffmpeg is writing
+	s.State = models.StateConverting
+	s.TempOutputPath = tmp
+	a.saveSession(ctx, s)
+	defer a.markInUse(out)()
+	defer a.markInUse(tmp)()
+	defer a.markInUse(s.SourcePath)()
+	a.touchSource(s.SourcePath)
 	dur := s.Meta.Duration
-    err = a.conv.Convert(ctx, s.SourcePath, out, job.Quality, job.StartTime, job.EndTime, dur, func(p int) {
-		// Progress tracking removed - using "initializing" status instead
-	})
+	jobCtx, jobCancel := job.Context(context.Background())
+	defer jobCancel()
+	if dur <= 0 {
+		// Metadata had no duration; ask ffprobe before falling back to
+		// heartbeat-only progress
+		if probed, err := converter.ProbeAudio(jobCtx, s.SourcePath); err == nil {
+			dur = probed
+		}
+	}
+	spanCtx, span := tracing.Start(tracing.Extract(jobCtx, job.TraceParent), "convert",
+		attribute.String("ytmp3.asset_hash", s.AssetHash),
+		attribute.String("ytmp3.variant_hash", s.VariantHash),
+		attribute.String("ytmp3.session_id", s.ID),
+		attribute.String("ytmp3.quality", job.Quality),
+		attribute.Int("ytmp3.attempt", job.Attempts))
+    err = a.conv.Convert(spanCtx, s.SourcePath, tmp, jobOptions(job), dur, a.conversionProgress(s.ID, s.VariantHash))
+	if err == nil {
+		err = os.Rename(tmp, out)
+	}
+	if err != nil {
+		removeTemp(tmp)
+	}
+	span.SetAttributes(attribute.Float64("ytmp3.elapsed_s", time.Since(start).Seconds()))
+	tracing.End(span, err)
+	ctx, cancel = a.storeCtx()
+	defer cancel()
 	if err != nil {
         job.Attempts++
-        if job.Attempts < a.cfg.MaxJobRetries {
-            // Exponential backoff: 2^attempt seconds up to 60s
-            backoff := time.Duration(1<<job.Attempts) * time.Second
-            if backoff > 60*time.Second { backoff = 60 * time.Second }
+        // Classified source/option problems fail the same way on every retry
+        if job.Attempts < a.cfg.MaxJobRetries && !converter.Permanent(err) {
+            // Exponential backoff: 2^attempt seconds up to 60s, with full jitter
+            backoff := queue.Backoff(job.Attempts, 60*time.Second)
+            logger.Warn("convert failed; retrying", "attempt", job.Attempts, "backoff", backoff, "kind", failureKind(err), "error", err, "detail", converter.Detail(err))
+            a.recordEvent(ctx, s, fmt.Sprintf("convert attempt %d failed, retrying in %s: %v", job.Attempts, backoff.Round(time.Second), err))
+            requeued = true
             go func(j queue.Job) {
                 time.Sleep(backoff)
-                a.cvQueue.Enqueue(j)
+                if !a.enqueue(a.cvQueue, j) {
+                    j.Finish()
+                }
             }(job)
         } else {
-            s.State = models.StateFailed
-            s.Error = err.Error()
-            _ = a.sessions.UpdateSession(ctx, s)
-            a.metrics.ErrorCount.Add(1)
+            if d := converter.Detail(err); d != "" {
+                logger.Error("ffmpeg stderr", "detail", d)
+            }
+            a.failJob(ctx, s, job, failureKind(err), err.Error())
         }
         return
 	}
     a.metrics.SuccessCount.Add(1)
     a.metrics.ObserveDuration(time.Since(start).Seconds(), true)
+	logger.Info("convert completed", "duration", time.Since(start))
 	s.OutputPath = out
+	s.TempOutputPath = ""
 	s.State = models.StateCompleted
-	_ = a.sessions.UpdateSession(ctx, s)
+	s.Encoding = a.encoding(ctx, out, jobOptions(job))
+	a.saveSession(ctx, s)
 	_ = a.sessions.SetVariant(ctx, s.VariantHash, out)
+	a.metrics.CompletedJobs.Add(1)
 }
 
 func (a *API) handleDownloadFile(w http.ResponseWriter, r *http.Request) {
+	disposition := r.URL.Query().Get("disposition")
+	switch disposition {
+	case "":
+		disposition = "attachment"
+	case "attachment", "inline":
+	default:
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "disposition must be attachment or inline")
+		return
+	}
 	id := chi.URLParam(r, "id")
 	s, err := a.sessions.GetSession(r.Context(), id)
+	if err == nil && s.OutputPath == "" && r.Method == http.MethodGet && r.URL.Query().Get("stream") == "true" {
+		a.streamDownload(w, r, s, disposition)
+		return
+	}
 	if err != nil || s.OutputPath == "" {
-		writeErr(w, http.StatusNotFound, "file not ready")
+		writeErr(w, http.StatusNotFound, CodeFileNotReady, "file not ready")
+		return
+	}
+	if path.Ext(r.URL.Path) != "."+outputExt(s.Format) {
+		writeErr(w, http.StatusNotFound, CodeNotFound, "not found")
+		return
+	}
+	if !a.safePath(s.OutputPath) {
+		writeErr(w, http.StatusNotFound, CodeNotFound, "missing")
 		return
 	}
 	f, err := os.Open(s.OutputPath)
 	if err != nil {
-		writeErr(w, http.StatusNotFound, "missing")
+		writeErr(w, http.StatusNotFound, CodeNotFound, "missing")
 		return
 	}
 	defer f.Close()
 	fi, _ := f.Stat()
-	w.Header().Set("Content-Type", "audio/mpeg")
+	w.Header().Set("Content-Type", contentType(s.Format))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
 	w.Header().Set("Accept-Ranges", "bytes")
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+safeFilename(s.Meta.Title)+".mp3\"")
+	// Variant hashes identify the encoded audio, so they make a strong ETag;
+	// ServeContent answers If-None-Match with 304 once it is set.
+	if s.VariantHash != "" {
+		w.Header().Set("ETag", `"`+s.VariantHash+`"`)
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, a.downloadFilename(s)+"."+outputExt(s.Format)))
+	if s.Encoding != nil {
+		w.Header().Set("X-Audio-Mode", s.Encoding.Mode)
+		w.Header().Set("X-Audio-Bitrate-Kbps", strconv.Itoa(s.Encoding.BitrateKbps))
+	}
 	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
 }
 
+// streamInterval is how often streamDownload polls for new output bytes and
+// session state while a conversion is running.
+const streamInterval = 500 * time.Millisecond
+
+// streamDownload serves an in-progress conversion by tailing the temp file
+// ffmpeg is writing (the session's TempOutputPath), using chunked transfer
+// until the session completes. The open file survives the rename into
+// place, so the tail ends with the complete output. Client disconnects only
+// end this response; the shared conversion keeps running.
+func (a *API) streamDownload(w http.ResponseWriter, r *http.Request, s *models.ConversionSession, disposition string) {
+	// MP4 outputs are only playable once ffmpeg has written the index at
+	// the end, so only mp3 is streamed
+	if s.VariantHash == "" || s.State == models.StateFailed || outputExt(s.Format) != models.FormatMP3 || path.Ext(r.URL.Path) != ".mp3" {
+		writeErr(w, http.StatusNotFound, CodeFileNotReady, "file not ready")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "streaming unsupported")
+		return
+	}
+	ctx := r.Context()
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	var offset int64
+	var tailed string
+	buf := make([]byte, 64*1024)
+	started := false
+	for {
+		// Re-read state before draining so bytes written right before
+		// completion are still sent
+		cur, err := a.sessions.GetSession(ctx, s.ID)
+		if err != nil || cur.State == models.StateFailed {
+			if !started {
+				writeErr(w, http.StatusNotFound, CodeFileNotReady, "file not ready")
+			}
+			return
+		}
+		done := cur.State == models.StateCompleted
+		if f == nil {
+			// A conversion that finished before the first read is served
+			// from its final path
+			p := cur.TempOutputPath
+			if done {
+				p = cur.OutputPath
+			}
+			if p != "" && a.safePath(p) {
+				if f, err = os.Open(p); err != nil {
+					f = nil
+				}
+			}
+			tailed = p
+		}
+		if f != nil {
+			fi, err := f.Stat()
+			if err == nil && fi.Size() < offset {
+				// Output was rewritten (e.g. a retry restarted ffmpeg)
+				return
+			}
+			if onDisk, serr := os.Stat(tailed); err == nil && serr == nil && !os.SameFile(fi, onDisk) {
+				// A retry replaced the temp file with a new one
+				return
+			}
+			for {
+				n, err := f.Read(buf)
+				if n > 0 {
+					if !started {
+						w.Header().Set("Content-Type", "audio/mpeg")
+						w.Header().Set("Content-Disposition", contentDisposition(disposition, a.downloadFilename(cur)+".mp3"))
+						w.WriteHeader(http.StatusOK)
+						started = true
+					}
+					if _, werr := w.Write(buf[:n]); werr != nil {
+						return
+					}
+					offset += int64(n)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if started {
+				flusher.Flush()
+			}
+		}
+		if done {
+			if !started {
+				writeErr(w, http.StatusNotFound, CodeNotFound, "missing")
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// memSamples are the runtime/metrics equivalents of MemStats.Alloc and Sys;
+// reading them doesn't stop the world as runtime.ReadMemStats does.
+var memSamples = []runtimemetrics.Sample{
+	{Name: "/memory/classes/heap/objects:bytes"},
+	{Name: "/memory/classes/total:bytes"},
+}
+
 func (a *API) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ms := make([]runtimemetrics.Sample, len(memSamples))
+	copy(ms, memSamples)
+	runtimemetrics.Read(ms)
+	// Liveness only: this stays 200 while the process can serve requests.
+	// Dependency health belongs to /ready so a transient Redis or tool
+	// failure takes the instance out of rotation instead of restarting it.
 	resp := map[string]any{
 		"status":         "healthy",
+		"probe":          "liveness",
+		"semantics":      "200 while the process is alive; dependency health is reported by /ready",
 		"active_jobs":    a.metrics.ActiveJobs.Load(),
 		"queued_jobs":    a.metrics.QueuedJobs.Load(),
 		"completed_jobs": a.metrics.CompletedJobs.Load(),
 		"failed_jobs":    a.metrics.FailedJobs.Load(),
 		"workers":        a.metrics.Workers.Load(),
 		"uptime":         time.Since(a.metrics.UptimeStart).String(),
-		"memory_usage":   "",
+		"memory_usage": map[string]any{
+			"alloc_bytes": ms[0].Value.Uint64(),
+			"sys_bytes":   ms[1].Value.Uint64(),
+			"disk_bytes":  a.diskUsage(),
+		},
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// shedReason reports why the instance should shed load, or "" when it can
+// take more work: too many queued jobs, or system load or memory use above
+// the configured thresholds.
+func (a *API) shedReason() string {
+	cfg := a.current()
+	if cfg.ShedQueueThreshold > 0 && a.dlQueue.Len()+a.cvQueue.Len() > cfg.ShedQueueThreshold {
+		return "too many queued jobs"
+	}
+	if cfg.ShedLoadPerCPU > 0 {
+		if load, ok := util.LoadPerCPU(); ok && load > cfg.ShedLoadPerCPU {
+			return fmt.Sprintf("load %.2f per cpu", load)
+		}
+	}
+	if cfg.ShedMemoryPercent > 0 {
+		if used, ok := util.MemoryUsedPercent(); ok && used > cfg.ShedMemoryPercent {
+			return fmt.Sprintf("memory %.0f%% used", used)
+		}
+	}
+	return ""
+}
+
 func (a *API) handleReady(w http.ResponseWriter, r *http.Request) {
-    // Consider ready if queues below capacity and tools installed
-    // Cheap checks; deeper checks available via /selftest
-    if a.cfg.ShedQueueThreshold > 0 {
-        totalQ := a.dlQueue.Len() + a.cvQueue.Len()
-        if totalQ > a.cfg.ShedQueueThreshold {
-            writeErr(w, http.StatusServiceUnavailable, "shedding: too many queued jobs")
-            return
-        }
+    // Consider ready if queues below capacity and dependencies are healthy.
+    // Dependency results come from the background prober, so this stays cheap.
+    if a.draining.Load() {
+        writeErr(w, http.StatusServiceUnavailable, CodeDraining, "draining")
+        return
+    }
+    if reason := a.shedReason(); reason != "" {
+        writeErr(w, http.StatusServiceUnavailable, CodeOverloaded, "shedding: "+reason)
+        return
+    }
+    resp := map[string]any{
+        "status":       "ready",
+        "probe":        "readiness",
+        "semantics":    "503 while shedding load or when a dependency probe failed; results are cached from a background prober",
+        "dependencies": a.deps.snapshot(),
+        "last_checked": a.deps.lastChecked(),
+    }
+    if failing := a.deps.failing(); len(failing) > 0 {
+        resp["status"] = "not ready"
+        resp["failing"] = failing
+        writeJSON(w, http.StatusServiceUnavailable, resp)
+        return
     }
-    writeJSON(w, http.StatusOK, map[string]any{"status": "ready"})
+    writeJSON(w, http.StatusOK, resp)
 }
 
 func (a *API) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
@@ -515,48 +2360,158 @@ func (a *API) handleMetricsJSON(w http.ResponseWriter, r *http.Request) {
 		"completed_jobs":   a.metrics.CompletedJobs.Load(),
 		"failed_jobs":      a.metrics.FailedJobs.Load(),
 		"workers":          a.metrics.Workers.Load(),
+		"download_workers": a.cfg.DownloadWorkers,
+		"convert_workers":  a.cfg.ConvertWorkers,
 		"queue_capacity":   a.cfg.JobQueueCapacity,
-		"rate_limit":       a.cfg.RequestsPerSecond,
+		"rate_limit":       a.current().RequestsPerSecond,
 		"uptime_seconds":   a.metrics.UptimeSeconds(),
 		"success_rate":     a.metrics.SuccessRate(),
-		"avg_processing_s": 0.0,
+		"avg_processing_s": a.metrics.AvgProcessingSeconds(),
+		"avg_download_s":   a.metrics.AvgDurationSeconds(false),
+		"avg_convert_s":    a.metrics.AvgDurationSeconds(true),
 		"sessions_active":  a.metrics.SessionsActive.Load(),
-        "convert_latency_buckets": a.metrics.ConvertLatencyBuckets,
-        "download_latency_buckets": a.metrics.DownloadLatencyBuckets,
+		"queue_wait_exceeded": a.metrics.QueueWaitExceeded.Load(),
+        "convert_latency_buckets": a.metrics.LatencyBuckets(true),
+        "download_latency_buckets": a.metrics.LatencyBuckets(false),
+		"routes":           a.metrics.RouteStats(),
+		"metadata_fetch":   a.metrics.MetadataStats(),
+		"tools_available":  a.metrics.ToolAvailability(),
+		"cache":            a.cacheStats(),
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// cacheStats reports asset and variant cache lookups with their hit rates in
+// percent.
+func (a *API) cacheStats() map[string]any {
+	ah, am := a.metrics.AssetCacheHits.Load(), a.metrics.AssetCacheMisses.Load()
+	vh, vm := a.metrics.VariantCacheHits.Load(), a.metrics.VariantCacheMisses.Load()
+	return map[string]any{
+		"asset_hits":           ah,
+		"asset_misses":         am,
+		"asset_hit_rate_pct":   metrics.HitRatePercent(ah, am),
+		"variant_hits":         vh,
+		"variant_misses":       vm,
+		"variant_hit_rate_pct": metrics.HitRatePercent(vh, vm),
+	}
+}
+
 func (a *API) handleStats(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]any{
 		"queue_download_len": a.dlQueue.Len(),
 		"queue_convert_len":  a.cvQueue.Len(),
+		"disk_usage_bytes":   a.diskUsage(),
+		"breakers":           a.dl.BreakerStates(),
+	})
+}
+
+// startSampler records a stats sample every StatsSampleInterval for
+// /stats/history.
+func (a *API) startSampler() {
+	if a.cfg.StatsHistorySize <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(a.cfg.StatsSampleInterval)
+		defer ticker.Stop()
+		prevOK, prevErr := a.metrics.SuccessCount.Load(), a.metrics.ErrorCount.Load()
+		for {
+			select {
+			case <-a.stopCh:
+				return
+			case now := <-ticker.C:
+				ok, failed := a.metrics.SuccessCount.Load(), a.metrics.ErrorCount.Load()
+				// A reset moves the counters backwards; start over from it
+				if ok < prevOK || failed < prevErr {
+					prevOK, prevErr = 0, 0
+				}
+				s := metrics.Sample{
+					Time:             now,
+					QueueDownloadLen: a.dlQueue.Len(),
+					QueueConvertLen:  a.cvQueue.Len(),
+					ActiveJobs:       a.metrics.ActiveJobs.Load(),
+					Succeeded:        ok - prevOK,
+					Failed:           failed - prevErr,
+					SuccessRate:      1,
+				}
+				if n := s.Succeeded + s.Failed; n > 0 {
+					s.SuccessRate = float64(s.Succeeded) / float64(n)
+				}
+				a.metrics.RecordSample(s)
+				prevOK, prevErr = ok, failed
+			}
+		}
+	}()
+}
+
+// handleStatsHistory returns the sampled stats time series, oldest first.
+func (a *API) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"interval_seconds": a.cfg.StatsSampleInterval.Seconds(),
+		"samples":          a.metrics.History(),
 	})
 }
 
 func (a *API) handleSelfTest(w http.ResponseWriter, r *http.Request) {
     // Check presence of external tools
-    type toolInfo struct{ Name, Version, Error string }
-    tools := []toolInfo{}
-    // ffmpeg -version
-    if out, err := exec.Command("ffmpeg", "-version").Output(); err == nil {
-        lines := strings.SplitN(string(out), "\n", 2)
-        tools = append(tools, toolInfo{Name: "ffmpeg", Version: strings.TrimSpace(lines[0])})
-    } else {
-        tools = append(tools, toolInfo{Name: "ffmpeg", Error: err.Error()})
-    }
-    if out, err := exec.Command("yt-dlp", "--version").Output(); err == nil {
-        v := strings.TrimSpace(string(out))
-        tools = append(tools, toolInfo{Name: "yt-dlp", Version: v})
-    } else {
-        tools = append(tools, toolInfo{Name: "yt-dlp", Error: err.Error()})
+    tools := a.probeTools(r.Context())
+    // Audio encoders relevant to the formats we offer or might add
+    encoders := map[string]bool{}
+    if enc := a.audioEncoders(); enc != nil {
+        for _, name := range []string{"libmp3lame", "aac", "libfdk_aac", "libopus", "libvorbis", "flac"} {
+            encoders[name] = enc[name]
+        }
     }
-    writeJSON(w, http.StatusOK, map[string]any{"tools": tools})
+    writeJSON(w, http.StatusOK, map[string]any{"tools": tools, "encoders": encoders, "formats": a.availableFormats()})
 }
 
-func writeErr(w http.ResponseWriter, code int, msg string) {
-	w.WriteHeader(code)
-	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+// decodeBody decodes the JSON request body into v, capping it at
+// MaxRequestBodyBytes. The request must be sent as application/json and may
+// not contain fields v doesn't define, so client typos surface as errors. On
+// failure it writes the error response (413 for an oversized body, 400
+// otherwise) and returns false.
+func (a *API) decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		writeErr(w, http.StatusBadRequest, CodeBadContentType, "Content-Type must be application/json")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, a.cfg.MaxRequestBodyBytes)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeErr(w, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "request body too large")
+			return false
+		}
+		if strings.HasPrefix(err.Error(), "json: unknown field ") {
+			writeErr(w, http.StatusBadRequest, CodeInvalidRequest, strings.TrimPrefix(err.Error(), "json: "))
+			return false
+		}
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "invalid request")
+		return false
+	}
+	return true
+}
+
+// validationRules returns the current settings request validation checks
+// against.
+func (a *API) validationRules() models.ValidationRules {
+	return models.ValidationRules{AllowedDomains: a.current().AllowedDomains, Qualities: a.qualities(), Formats: a.availableFormats()}
+}
+
+// writeFieldErrs writes a 422 listing each invalid request field.
+func writeFieldErrs(w http.ResponseWriter, errs []models.FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid request fields", "code": string(CodeValidation), "fields": errs})
+}
+
+// writeErr writes an error response carrying a human-readable message and a
+// stable ErrorCode for clients to branch on.
+func writeErr(w http.ResponseWriter, status int, code ErrorCode, msg string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": string(code)})
 }
 
 func writeJSON(w http.ResponseWriter, code int, v any) {
@@ -565,16 +2520,251 @@ func writeJSON(w http.ResponseWriter, code int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// downloadFilename renders DownloadFilenameTemplate for s without the
+// extension, falling back to the sanitized title when the result is empty.
+func (a *API) downloadFilename(s *models.ConversionSession) string {
+	tmpl := strings.TrimSuffix(a.cfg.DownloadFilenameTemplate, ".mp3")
+	field := func(v string) string {
+		if strings.TrimSpace(v) == "" {
+			return ""
+		}
+		return safeFilename(v)
+	}
+	name := strings.NewReplacer(
+		"{title}", field(s.Meta.Title),
+		"{uploader}", field(s.Meta.Uploader),
+		"{quality}", field(string(s.Quality)),
+		"{id}", field(s.ID),
+		"{client_ref}", field(s.ClientRef),
+	).Replace(tmpl)
+	name = strings.TrimSpace(name)
+	if strings.Trim(name, " -_[]().") == "" {
+		name = strings.TrimSpace(s.Meta.Title)
+	}
+	// The caller's reference leads the name unless the template places it;
+	// the separator only goes in front of something
+	if s.ClientRef != "" && !strings.Contains(tmpl, "{client_ref}") {
+		if name == "" {
+			name = s.ClientRef
+		} else {
+			name = s.ClientRef + " - " + name
+		}
+	}
+	return safeFilename(name)
+}
+
+// maxFilenameBytes bounds sanitized filenames, leaving room for an extension
+// within common 255-byte filesystem limits.
+const maxFilenameBytes = 200
+
+// reservedNames are Windows device names that cannot be used as file names,
+// with or without an extension.
+var reservedNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// safeFilename makes a title usable as a download file name: path separators
+// and characters invalid on common filesystems are replaced, control
+// characters dropped, whitespace collapsed, reserved device names avoided and
+// the result truncated to maxFilenameBytes on a rune boundary.
 func safeFilename(s string) string {
-	s = strings.TrimSpace(s)
-	s = strings.ReplaceAll(s, "/", "-")
-	s = strings.ReplaceAll(s, "\\", "-")
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			// Before the control check so line breaks separate words
+			b.WriteRune(' ')
+		case r == utf8.RuneError, unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`/\:*?"<>|`, r):
+			b.WriteRune('-')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	s = strings.Join(strings.Fields(b.String()), " ")
+	if len(s) > maxFilenameBytes {
+		cut := maxFilenameBytes
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		s = strings.TrimSpace(s[:cut])
+	}
+	// Trailing dots and spaces are stripped by Windows
+	s = strings.TrimRight(s, ". ")
 	if s == "" {
 		return "download"
 	}
+	base := strings.ToUpper(s)
+	if i := strings.IndexByte(base, '.'); i != -1 {
+		base = base[:i]
+	}
+	if _, ok := reservedNames[strings.TrimSpace(base)]; ok {
+		s = "_" + s
+	}
 	return s
 }
 
+// contentDisposition builds a Content-Disposition value carrying both an
+// ASCII-only filename for legacy clients and the UTF-8 name encoded per
+// RFC 5987 in filename*.
+func contentDisposition(disposition, name string) string {
+	var ascii strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			ascii.WriteByte('_')
+			continue
+		}
+		ascii.WriteRune(r)
+	}
+	return disposition + "; filename=\"" + ascii.String() + "\"; filename*=UTF-8''" + rfc5987Escape(name)
+}
+
+func rfc5987Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("!#$&+-.^_`|~", c) != -1 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// qualityAvailable reports whether q is empty (the default) or a label of
+// QUALITY_BITRATE_MAP.
+func (a *API) qualityAvailable(q models.ConversionQuality) bool {
+	_, ok := a.cfg.QualityBitrates[string(q)]
+	return q == "" || ok
+}
+
+// qualities lists the configured quality labels by ascending bitrate.
+func (a *API) qualities() []models.ConversionQuality {
+	out := make([]models.ConversionQuality, 0, len(a.cfg.QualityBitrates))
+	for q := range a.cfg.QualityBitrates {
+		out = append(out, models.ConversionQuality(q))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		bi, bj := a.cfg.QualityBitrates[string(out[i])], a.cfg.QualityBitrates[string(out[j])]
+		if bi != bj {
+			return bi < bj
+		}
+		return out[i] < out[j]
+	})
+	return out
+}
+
+// variantHash identifies a converted output by its source asset and the
+// parameters that affect the encoded audio. Optional parameters are only
+// mixed in when set so existing cached variants keep their hashes. Quality
+// labels are hashed as their mapped bitrate, so renaming a tier keeps its
+// cache and remapping one doesn't serve stale audio.
+func (a *API) variantHash(assetHash string, o converter.Options) string {
+	quality := o.Quality
+	if kbps, ok := a.cfg.QualityBitrates[quality]; ok && quality != "" {
+		quality = strconv.Itoa(kbps)
+	}
+	key := assetHash + "|" + quality + "|" + o.Start + "|" + o.End
+	if o.SampleRate > 0 || o.Channels > 0 {
+		key += fmt.Sprintf("|ar=%d|ac=%d", o.SampleRate, o.Channels)
+	}
+	// Only clipped outputs differ between fast and precise seeking
+	if o.Precise && (o.Start != "" || o.End != "") {
+		key += "|precise"
+	}
+	if o.Format != "" && o.Format != models.FormatMP3 {
+		key += "|fmt=" + o.Format
+	}
+	if o.Normalize {
+		key += "|loudnorm"
+	}
+	return util.HashString(key)
+}
+
+// requestOptions and jobOptions map a convert request or queued job to the
+// converter's encoding options.
+func requestOptions(req models.ConvertRequest) converter.Options {
+	return converter.Options{Quality: string(req.Quality), Start: req.StartTime, End: req.EndTime, SampleRate: req.SampleRate, Channels: req.Channels, Precise: req.Precise, Format: req.Format, Normalize: req.Normalize}
+}
+
+// encoding describes the output at path for the session record.
+func (a *API) encoding(ctx context.Context, path string, opts converter.Options) *models.Encoding {
+	e := a.conv.Describe(ctx, path, opts)
+	enc := &models.Encoding{Mode: string(e.Mode), BitrateKbps: e.BitrateKbps, SampleRate: e.SampleRate, Channels: e.Channels}
+	if e.Mode == converter.ModeVBR {
+		enc.VBRQuality = &e.VBRQ
+	}
+	return enc
+}
+
+// formatEncoders maps each output format to the ffmpeg encoder it needs.
+var formatEncoders = map[string]string{
+	models.FormatMP3: "libmp3lame",
+	models.FormatM4A: "aac",
+}
+
+// audioEncoders returns ffmpeg's audio encoders, probing them once.
+func (a *API) audioEncoders() map[string]bool {
+	a.encodersOnce.Do(func() {
+		enc, err := converter.Encoders(context.Background())
+		if err != nil {
+			log.Printf("listing ffmpeg encoders failed: %v", err)
+			return
+		}
+		a.encoders = enc
+	})
+	return a.encoders
+}
+
+// formatAvailable reports whether ffmpeg can encode format (empty is mp3).
+// If the encoders couldn't be listed every format is assumed available.
+func (a *API) formatAvailable(format string) bool {
+	enc := a.audioEncoders()
+	return enc == nil || enc[formatEncoders[outputExt(format)]]
+}
+
+// availableFormats lists the supported formats ffmpeg can encode.
+func (a *API) availableFormats() []string {
+	var out []string
+	for _, f := range models.SupportedFormats {
+		if a.formatAvailable(f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// outputExt returns the file extension for an output format; empty is mp3.
+func outputExt(format string) string {
+	if format == "" {
+		return models.FormatMP3
+	}
+	return format
+}
+
+func contentType(format string) string {
+	if outputExt(format) == models.FormatM4A {
+		return "audio/mp4"
+	}
+	return "audio/mpeg"
+}
+
+// sessionDownloadURL is the stable session-based URL of s's output.
+func sessionDownloadURL(s *models.ConversionSession) string {
+	return "/download/" + s.ID + "." + outputExt(s.Format)
+}
+
+func jobOptions(j queue.Job) converter.Options {
+	return converter.Options{Quality: j.Quality, Start: j.StartTime, End: j.EndTime, SampleRate: j.SampleRate, Channels: j.Channels, Precise: j.Precise, Format: j.Format, Normalize: j.Normalize}
+}
+
 func newID() string {
 	return fmt.Sprintf("conv_%d_%d", time.Now().Unix(), rand.Int63())
 }
@@ -0,0 +1,32 @@
+package handlers
+
+// ErrorCode is the stable, machine-readable "code" field of an error
+// response. Messages may change; codes don't, so clients should branch on
+// these.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest     ErrorCode = "INVALID_REQUEST"
+	CodeValidation         ErrorCode = "VALIDATION_FAILED"
+	CodeInvalidTime        ErrorCode = "INVALID_TIME"
+	CodeUnsupported        ErrorCode = "UNSUPPORTED_OPTION"
+	CodeVideoTooLong       ErrorCode = "VIDEO_TOO_LONG"
+	CodeClipTooLong        ErrorCode = "CLIP_TOO_LONG"
+	CodeDurationUnknown    ErrorCode = "DURATION_UNKNOWN"
+	CodeNoChapters         ErrorCode = "NO_CHAPTERS"
+	CodeTooManyChapters    ErrorCode = "TOO_MANY_CHAPTERS"
+	CodeNotAudio           ErrorCode = "NOT_AUDIO"
+	CodeBadContentType     ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodePayloadTooLarge    ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeNotFound           ErrorCode = "NOT_FOUND"
+	CodeSourceExpired      ErrorCode = "SOURCE_EXPIRED"
+	CodeFileNotReady       ErrorCode = "FILE_NOT_READY"
+	CodeSessionFailed      ErrorCode = "SESSION_FAILED"
+	CodeQueueFull          ErrorCode = "QUEUE_FULL"
+	CodeOverloaded         ErrorCode = "OVERLOADED"
+	CodeDraining           ErrorCode = "DRAINING"
+	CodeUpstreamError      ErrorCode = "UPSTREAM_ERROR"
+	CodeInternal           ErrorCode = "INTERNAL_ERROR"
+	CodeIdempotencyReused  ErrorCode = "IDEMPOTENCY_KEY_REUSED"
+	CodeIdempotencyPending ErrorCode = "IDEMPOTENCY_KEY_IN_USE"
+)
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"ytmp3api/internal/converter"
+	"ytmp3api/internal/downloader"
+	"ytmp3api/internal/models"
+	"ytmp3api/internal/queue"
+	"ytmp3api/internal/util"
+)
+
+// Failure kinds reported in the "kind" attribute of terminal job failure
+// logs, so failures can be grouped without parsing messages.
+const (
+	failDeadline    = "deadline"
+	failQueueWait   = "queue_wait"
+	failSource      = "source_failed"
+	failSourceWait  = "source_timeout"
+	failCanceled    = "canceled"
+	failCircuitOpen = "circuit_open"
+	failInvalidPath = "invalid_path"
+	failUnavailable = "unavailable"
+	failUnknown     = "unknown"
+)
+
+// failureKind classifies a download or convert error for logging.
+func failureKind(err error) string {
+	var fe *converter.FFmpegError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return failDeadline
+	case errors.Is(err, context.Canceled):
+		return failCanceled
+	case errors.Is(err, downloader.ErrCircuitOpen):
+		return failCircuitOpen
+	case errors.Is(err, downloader.ErrUnavailable):
+		return failUnavailable
+	case errors.Is(err, converter.ErrNoAudioStream):
+		return "no_audio_stream"
+	case errors.Is(err, converter.ErrInvalidDuration):
+		return "invalid_duration"
+	case errors.Is(err, converter.ErrCorruptSource):
+		return "corrupt_source"
+	case errors.Is(err, converter.ErrUnsupportedCodec):
+		return "unsupported_codec"
+	case errors.Is(err, converter.ErrDiskFull):
+		return "disk_full"
+	case errors.As(err, &fe):
+		return "ffmpeg"
+	}
+	return failUnknown
+}
+
+// permanentFailures are the failure kinds that retrying with the same
+// source and options cannot fix.
+var permanentFailures = map[string]bool{
+	failUnavailable:     true,
+	failInvalidPath:     true,
+	"no_audio_stream":   true,
+	"invalid_duration":  true,
+	"corrupt_source":    true,
+	"unsupported_codec": true,
+}
+
+// jobLogger returns a logger carrying the identifiers of job and its session,
+// including the caller's client_ref when set.
+func jobLogger(job queue.Job, s *models.ConversionSession) *slog.Logger {
+	l := slog.With("job", job.ID, "type", job.Type.String(), "session", s.ID, "asset", s.AssetHash, "request_id", job.RequestID)
+	if s.ClientRef != "" {
+		l = l.With("client_ref", s.ClientRef)
+	}
+	return l
+}
+
+// maxJobEvents bounds a session's event log, dropping the oldest entries, and
+// maxJobEventBytes truncates long messages such as tool stderr.
+const (
+	maxJobEvents     = 50
+	maxJobEventBytes = 500
+)
+
+// appendEvent returns events plus a redacted entry for state and msg, keeping
+// the newest maxJobEvents. It always copies: sessions read from the memory
+// store share their slices with the stored copy.
+func appendEvent(events []models.JobEvent, state models.ConversionState, msg string) []models.JobEvent {
+	msg = util.RedactURLs(msg)
+	if len(msg) > maxJobEventBytes {
+		msg = strings.ToValidUTF8(msg[:maxJobEventBytes], "") + "..."
+	}
+	start := 0
+	if len(events) >= maxJobEvents {
+		start = len(events) - maxJobEvents + 1
+	}
+	out := make([]models.JobEvent, 0, len(events)-start+1)
+	out = append(out, events[start:]...)
+	return append(out, models.JobEvent{Time: time.Now(), State: state, Message: msg})
+}
+
+// recordEvent appends msg to the stored session's event log under its
+// current state, leaving the rest of the session untouched.
+func (a *API) recordEvent(ctx context.Context, s *models.ConversionSession, msg string) {
+	cur, err := a.sessions.GetSession(ctx, s.ID)
+	if err != nil {
+		return
+	}
+	cur.Events = appendEvent(cur.Events, cur.State, msg)
+	_ = a.sessions.UpdateSession(ctx, cur)
+	s.Events = cur.Events
+}
+
+// handleJobLogs returns a session's event log so users can see why a
+// conversion failed or is being retried.
+func (a *API) handleJobLogs(w http.ResponseWriter, r *http.Request) {
+	s, err := a.sessions.GetSession(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeErr(w, http.StatusNotFound, CodeNotFound, "session not found")
+		return
+	}
+	events := s.Events
+	if events == nil {
+		events = []models.JobEvent{}
+	}
+	writeJSON(w, http.StatusOK, models.JobLogsResponse{ConversionID: s.ID, Status: string(s.State), Error: util.RedactURLs(s.Error), Events: events})
+}
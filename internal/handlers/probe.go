@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ytmp3api/internal/store"
+	"ytmp3api/internal/util"
+)
+
+// depCheck is a named dependency probe run periodically in the background.
+type depCheck struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// depStatus caches the latest result of each dependency probe so readiness
+// checks don't exec tools or hit the network per request.
+type depStatus struct {
+	mu      sync.RWMutex
+	errs    map[string]string
+	checked time.Time
+	// versionWarning is the last yt-dlp version warning logged, so it is
+	// logged again only when it changes.
+	versionWarning string
+}
+
+// failing returns the names of dependencies whose last probe failed, with
+// their errors, in name order.
+func (d *depStatus) failing() []map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	names := make([]string, 0, len(d.errs))
+	for n, e := range d.errs {
+		if e != "" {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	out := make([]map[string]string, 0, len(names))
+	for _, n := range names {
+		out = append(out, map[string]string{"dependency": n, "error": d.errs[n]})
+	}
+	return out
+}
+
+// snapshot returns each dependency's last result: "ok" or the error text.
+func (d *depStatus) snapshot() map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := make(map[string]string, len(d.errs))
+	for n, e := range d.errs {
+		if e == "" {
+			e = "ok"
+		}
+		out[n] = e
+	}
+	return out
+}
+
+func (d *depStatus) lastChecked() time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.checked
+}
+
+func (a *API) depChecks() []depCheck {
+	checks := []depCheck{
+		{name: "conversions_dir", fn: func(ctx context.Context) error {
+			return probeWritable(a.cfg.ConversionsDir)
+		}},
+	}
+	if a.cfg.MinFreeDiskBytes > 0 {
+		checks = append(checks, depCheck{name: "disk_space", fn: func(ctx context.Context) error {
+			return checkFreeSpace(a.cfg.ConversionsDir, a.cfg.MinFreeDiskBytes)
+		}})
+	}
+	if a.rdb != nil {
+		checks = append(checks, depCheck{name: "redis", fn: func(ctx context.Context) error {
+			return a.rdb.Ping(ctx).Err()
+		}})
+	}
+	if rs, ok := a.sessions.(*store.ResilientStore); ok {
+		// Fails while session reads/writes keep failing after retries,
+		// even if a bare ping succeeds
+		checks = append(checks, depCheck{name: "session_store", fn: func(ctx context.Context) error {
+			return rs.Degraded()
+		}})
+	}
+	return checks
+}
+
+// prepareConversionsDir creates dir with its streams/ and outputs/ subdirs
+// and checks that each is writable and that the filesystem has at least
+// minFree bytes available, so a bad CONVERSIONS_DIR fails at startup rather
+// than on the first job.
+func prepareConversionsDir(dir string, minFree int64) error {
+	for _, d := range []string{dir, filepath.Join(dir, "streams"), filepath.Join(dir, "outputs")} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return fmt.Errorf("CONVERSIONS_DIR: %w", err)
+		}
+		if err := probeWritable(d); err != nil {
+			return fmt.Errorf("CONVERSIONS_DIR: %s is not writable: %w", d, err)
+		}
+	}
+	if err := checkFreeSpace(dir, minFree); err != nil {
+		return fmt.Errorf("CONVERSIONS_DIR: %w", err)
+	}
+	return nil
+}
+
+// probeWritable creates and removes a temporary file in dir.
+func probeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// checkFreeSpace fails when the filesystem holding dir has less than min
+// bytes available. Platforms without free-space reporting always pass.
+func checkFreeSpace(dir string, min int64) error {
+	if min <= 0 {
+		return nil
+	}
+	free, err := util.FreeBytes(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if free < min {
+		return fmt.Errorf("%d MiB free on %s, below MIN_FREE_DISK_BYTES (%d MiB)", free>>20, dir, min>>20)
+	}
+	return nil
+}
+
+// toolInfo is the result of probing one required external tool. Warning
+// is set when the tool runs but is older than required.
+type toolInfo struct {
+	Name, Version, Error string
+	Warning              string `json:",omitempty"`
+}
+
+// requiredTools are the external tools every job depends on, with the
+// arguments that make each print its version.
+var requiredTools = []struct {
+	name string
+	args []string
+}{
+	{"ffmpeg", []string{"-version"}},
+	{"yt-dlp", []string{"--version"}},
+}
+
+// probeTools runs each required tool's version command and reports the
+// first line of its output, or the error if it couldn't be run. yt-dlp is
+// checked against YtDLPMinVersion when one is configured.
+func (a *API) probeTools(ctx context.Context) []toolInfo {
+	tools := make([]toolInfo, 0, len(requiredTools))
+	for _, t := range requiredTools {
+		tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		out, err := exec.CommandContext(tctx, t.name, t.args...).Output()
+		cancel()
+		if err != nil {
+			tools = append(tools, toolInfo{Name: t.name, Error: err.Error()})
+			continue
+		}
+		line, _, _ := strings.Cut(string(out), "\n")
+		info := toolInfo{Name: t.name, Version: strings.TrimSpace(line)}
+		if t.name == "yt-dlp" && a.cfg.YtDLPMinVersion != "" && versionBelow(info.Version, a.cfg.YtDLPMinVersion) {
+			info.Warning = fmt.Sprintf("yt-dlp %s is below required %s", info.Version, a.cfg.YtDLPMinVersion)
+		}
+		tools = append(tools, info)
+	}
+	return tools
+}
+
+// versionBelow reports whether have is older than want, comparing their
+// dot-separated numeric parts in order (yt-dlp uses YYYY.MM.DD, with an
+// extra build number on nightlies). A missing part counts as 0 and a
+// non-numeric one stops the comparison.
+func versionBelow(have, want string) bool {
+	hp, wp := strings.Split(have, "."), strings.Split(want, ".")
+	for i := 0; i < len(hp) || i < len(wp); i++ {
+		var h, w int
+		if i < len(hp) {
+			n, err := strconv.Atoi(hp[i])
+			if err != nil {
+				return false
+			}
+			h = n
+		}
+		if i < len(wp) {
+			n, err := strconv.Atoi(wp[i])
+			if err != nil {
+				return false
+			}
+			w = n
+		}
+		if h != w {
+			return h < w
+		}
+	}
+	return false
+}
+
+// probeOnce runs every dependency check and records the results. Tool
+// availability is also kept in the metrics registry for /metrics.
+func (a *API) probeOnce() {
+	res := map[string]string{}
+	warning := ""
+	for _, t := range a.probeTools(context.Background()) {
+		res[t.Name] = t.Error
+		a.metrics.SetToolAvailable(t.Name, t.Error == "")
+		if t.Warning != "" {
+			warning = t.Warning
+		}
+	}
+	if a.cfg.YtDLPMinVersionEnforce && a.cfg.YtDLPMinVersion != "" {
+		res["yt-dlp_version"] = warning
+	}
+	for _, c := range a.depChecks() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := c.fn(ctx); err != nil {
+			res[c.name] = err.Error()
+		} else {
+			res[c.name] = ""
+		}
+		cancel()
+	}
+	a.deps.mu.Lock()
+	a.deps.errs = res
+	a.deps.checked = time.Now()
+	if warning != a.deps.versionWarning {
+		if warning != "" {
+			slog.Warn(warning+"; upgrade yt-dlp", "min_version", a.cfg.YtDLPMinVersion)
+		} else if a.deps.versionWarning != "" {
+			slog.Info("yt-dlp version now meets the minimum", "min_version", a.cfg.YtDLPMinVersion)
+		}
+		a.deps.versionWarning = warning
+	}
+	a.deps.mu.Unlock()
+}
+
+// startProbes runs the dependency probes once synchronously, so readiness is
+// accurate from the start, then every ReadyProbeInterval until Close.
+func (a *API) startProbes() {
+	a.probeOnce()
+	go func() {
+		ticker := time.NewTicker(a.cfg.ReadyProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.stopCh:
+				return
+			case <-ticker.C:
+				a.probeOnce()
+			}
+		}
+	}()
+}
+
+// probeEndpoints checks once that the configured metadata endpoints answer
+// and logs the outcome, so operators can tell at startup whether the fast
+// metadata path works. Any HTTP response counts as reachable.
+func (a *API) probeEndpoints() {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for name, endpoint := range map[string]string{"oembed": a.cfg.OEmbedEndpoint, "duration_api": a.cfg.DurationAPIEndpoint} {
+		if endpoint == "" {
+			log.Printf("%s endpoint not configured; metadata falls back to yt-dlp", name)
+			continue
+		}
+		resp, err := client.Head(endpoint)
+		if err != nil {
+			log.Printf("warning: %s endpoint %s unreachable: %v", name, endpoint, err)
+			continue
+		}
+		resp.Body.Close()
+		log.Printf("%s endpoint %s reachable (HTTP %d)", name, endpoint, resp.StatusCode)
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"ytmp3api/internal/converter"
+	"ytmp3api/internal/models"
+)
+
+// progressThrottle picks which progress reports of one job are persisted:
+// one once interval has passed or progress has advanced by step percent
+// since the last write, and always 100. Reports that don't advance progress
+// are dropped, except heartbeats (converter.ProgressUnknown), which are
+// persisted once per interval.
+type progressThrottle struct {
+	interval time.Duration
+	step     int
+
+	mu     sync.Mutex
+	last   int
+	lastAt time.Time
+}
+
+// due reports whether pct, reported at now, should be written, and records
+// it as the last write if so.
+func (t *progressThrottle) due(pct int, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if pct == converter.ProgressUnknown {
+		if now.Sub(t.lastAt) < t.interval {
+			return false
+		}
+		t.lastAt = now
+		return true
+	}
+	if pct <= t.last {
+		return false
+	}
+	if pct < 100 && pct-t.last < t.step && now.Sub(t.lastAt) < t.interval {
+		return false
+	}
+	t.last, t.lastAt = pct, now
+	return true
+}
+
+// progressWriter returns a progress callback that persists the throttled
+// reports on session id. set applies a report to the stored session and
+// returns false if it no longer applies (the session moved on); only the
+// progress fields change, so a worker's own writes are never overwritten.
+// Warm-up downloads (empty id) persist nothing.
+func (a *API) progressWriter(id string, set func(cur *models.ConversionSession, pct int) bool) func(int) {
+	t := &progressThrottle{interval: a.cfg.ProgressUpdateInterval, step: a.cfg.ProgressUpdateStep}
+	return func(pct int) {
+		now := time.Now()
+		if id == "" || !t.due(pct, now) {
+			return
+		}
+		ctx, cancel := a.storeCtx()
+		defer cancel()
+		cur, err := a.sessions.GetSession(ctx, id)
+		if err != nil || !set(cur, pct) {
+			return
+		}
+		cur.LastProgressAt = now
+		_ = a.sessions.UpdateSession(ctx, cur)
+	}
+}
+
+// downloadProgress persists the source download progress of session id.
+func (a *API) downloadProgress(id string) func(int) {
+	return a.progressWriter(id, func(cur *models.ConversionSession, pct int) bool {
+		if cur.State != models.StateDownloading || pct <= cur.DownloadProgress {
+			return false
+		}
+		cur.DownloadProgress = pct
+		return true
+	})
+}
+
+// conversionProgress persists the progress of converting variant on session
+// id. Heartbeats only refresh LastProgressAt.
+func (a *API) conversionProgress(id, variant string) func(int) {
+	return a.progressWriter(id, func(cur *models.ConversionSession, pct int) bool {
+		if cur.State != models.StateConverting || cur.VariantHash != variant {
+			return false
+		}
+		if pct == converter.ProgressUnknown {
+			return true
+		}
+		if pct <= cur.ConversionProgress {
+			return false
+		}
+		cur.ConversionProgress = pct
+		return true
+	})
+}
+
+// sessionProgress returns the download and conversion progress to report
+// for s. Sessions that reused a source or an output never ran those stages,
+// so a stage that is over reports 100 whatever was persisted.
+func sessionProgress(s *models.ConversionSession) (download, conversion int) {
+	download, conversion = s.DownloadProgress, s.ConversionProgress
+	if s.SourcePath != "" || s.State != models.StateFailed && stateRank[s.State] >= stateRank[models.StateDownloaded] {
+		download = 100
+	}
+	if s.State == models.StateCompleted {
+		conversion = 100
+	}
+	return download, conversion
+}
+
+// lastProgressAt returns s.LastProgressAt for /status, or nil if progress
+// was never persisted or the session is no longer running.
+func lastProgressAt(s *models.ConversionSession) *time.Time {
+	if s.LastProgressAt.IsZero() || s.State == models.StateCompleted || s.State == models.StateFailed {
+		return nil
+	}
+	t := s.LastProgressAt
+	return &t
+}
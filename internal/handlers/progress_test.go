@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"ytmp3api/internal/config"
+	"ytmp3api/internal/converter"
+	"ytmp3api/internal/models"
+)
+
+func TestProgressThrottle(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name    string
+		reports []int
+		gaps    time.Duration
+		written []int
+	}{
+		{name: "every percent quickly", reports: []int{1, 2, 3, 4, 5, 6, 9, 10, 11, 100}, written: []int{1, 6, 11, 100}},
+		{name: "slow progress", reports: []int{1, 2, 3}, gaps: time.Second, written: []int{1, 2, 3}},
+		{name: "final always written", reports: []int{97, 98, 99, 100}, written: []int{97, 100}},
+		{name: "no regressions or repeats", reports: []int{10, 10, 4, 15, 100, 100}, written: []int{10, 15, 100}},
+		{name: "heartbeats once per interval", reports: []int{-1, -1, -1}, written: []int{-1}},
+		{name: "slow heartbeats", reports: []int{-1, -1, -1}, gaps: time.Second, written: []int{-1, -1, -1}},
+		{name: "heartbeat then progress", reports: []int{-1, 10}, written: []int{-1, 10}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &progressThrottle{interval: time.Second, step: 5}
+			var written []int
+			now := start
+			for _, pct := range tt.reports {
+				now = now.Add(tt.gaps)
+				if th.due(pct, now) {
+					written = append(written, pct)
+				}
+			}
+			if len(written) != len(tt.written) {
+				t.Fatalf("written %v, want %v", written, tt.written)
+			}
+			for i := range written {
+				if written[i] != tt.written[i] {
+					t.Fatalf("written %v, want %v", written, tt.written)
+				}
+			}
+		})
+	}
+}
+
+func TestConversionProgressPersists(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   models.ConversionState
+		variant string
+		want    int
+	}{
+		{name: "converting", state: models.StateConverting, variant: "v1", want: 100},
+		{name: "other variant", state: models.StateConverting, variant: "v2", want: 0},
+		{name: "already completed", state: models.StateCompleted, variant: "v1", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAPI(t, &config.Config{ProgressUpdateInterval: time.Hour, ProgressUpdateStep: 50})
+			ctx := context.Background()
+			_ = a.sessions.CreateSession(ctx, &models.ConversionSession{ID: "s1", State: tt.state, VariantHash: tt.variant})
+			report := a.conversionProgress("s1", "v1")
+			for _, pct := range []int{10, 20, 100} {
+				report(pct)
+			}
+			got, _ := a.sessions.GetSession(ctx, "s1")
+			if got.ConversionProgress != tt.want {
+				t.Errorf("conversion_progress = %d, want %d", got.ConversionProgress, tt.want)
+			}
+		})
+	}
+}
+
+func TestConversionHeartbeatPersists(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   models.ConversionState
+		variant string
+		want    bool
+	}{
+		{name: "converting", state: models.StateConverting, variant: "v1", want: true},
+		{name: "other variant", state: models.StateConverting, variant: "v2", want: false},
+		{name: "already completed", state: models.StateCompleted, variant: "v1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAPI(t, &config.Config{ProgressUpdateInterval: time.Hour, ProgressUpdateStep: 50})
+			ctx := context.Background()
+			_ = a.sessions.CreateSession(ctx, &models.ConversionSession{ID: "s1", State: tt.state, VariantHash: tt.variant})
+			a.conversionProgress("s1", "v1")(converter.ProgressUnknown)
+			got, _ := a.sessions.GetSession(ctx, "s1")
+			if got.ConversionProgress != 0 {
+				t.Errorf("conversion_progress = %d, want 0", got.ConversionProgress)
+			}
+			if at := lastProgressAt(got); (at != nil) != tt.want {
+				t.Errorf("last_progress_at = %v, want set %v", at, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveSessionOutOfOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		stored       models.ConversionSession
+		stale        models.ConversionSession
+		wantState    models.ConversionState
+		wantDownload int
+		wantConvert  int
+	}{
+		{
+			name:      "queued over converting",
+			stored:    models.ConversionSession{State: models.StateConverting, VariantHash: "v1", ConversionProgress: 40},
+			stale:     models.ConversionSession{State: models.StateQueued, VariantHash: "v1"},
+			wantState: models.StateConverting, wantConvert: 40,
+		},
+		{
+			name:      "downloading over converting",
+			stored:    models.ConversionSession{State: models.StateConverting, VariantHash: "v1", DownloadProgress: 100},
+			stale:     models.ConversionSession{State: models.StateDownloading, DownloadProgress: 30},
+			wantState: models.StateConverting, wantDownload: 100,
+		},
+		{
+			name:      "converting over completed",
+			stored:    models.ConversionSession{State: models.StateCompleted, VariantHash: "v1", ConversionProgress: 100},
+			stale:     models.ConversionSession{State: models.StateConverting, VariantHash: "v1", ConversionProgress: 60},
+			wantState: models.StateCompleted, wantConvert: 100,
+		},
+		{
+			name:      "same state with older progress",
+			stored:    models.ConversionSession{State: models.StateConverting, VariantHash: "v1", DownloadProgress: 100, ConversionProgress: 70},
+			stale:     models.ConversionSession{State: models.StateConverting, VariantHash: "v1", DownloadProgress: 50, ConversionProgress: 20},
+			wantState: models.StateConverting, wantDownload: 100, wantConvert: 70,
+		},
+		{
+			name:      "new variant restarts conversion progress",
+			stored:    models.ConversionSession{State: models.StateCompleted, VariantHash: "v1", DownloadProgress: 100, ConversionProgress: 100},
+			stale:     models.ConversionSession{State: models.StateQueued, VariantHash: "v2"},
+			wantState: models.StateQueued, wantDownload: 100, wantConvert: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAPI(t, &config.Config{})
+			ctx := context.Background()
+			stored, stale := tt.stored, tt.stale
+			stored.ID, stale.ID = "s1", "s1"
+			_ = a.sessions.CreateSession(ctx, &stored)
+			a.saveSession(ctx, &stale)
+			got, _ := a.sessions.GetSession(ctx, "s1")
+			if got.State != tt.wantState || got.DownloadProgress != tt.wantDownload || got.ConversionProgress != tt.wantConvert {
+				t.Errorf("stored %s download=%d conversion=%d, want %s download=%d conversion=%d",
+					got.State, got.DownloadProgress, got.ConversionProgress, tt.wantState, tt.wantDownload, tt.wantConvert)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ytmp3api/internal/metrics"
+)
+
+// handleMetricsProm writes the job counters and per-route request metrics in
+// the Prometheus text exposition format.
+func (a *API) handleMetricsProm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	gauge := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	gauge("ytmp3_active_jobs", "Jobs currently being processed.", a.metrics.ActiveJobs.Load())
+	gauge("ytmp3_queued_jobs", "Jobs waiting in the download and convert queues.", a.metrics.QueuedJobs.Load())
+	counter("ytmp3_completed_jobs_total", "Jobs completed successfully.", a.metrics.CompletedJobs.Load())
+	counter("ytmp3_failed_jobs_total", "Jobs that failed terminally.", a.metrics.FailedJobs.Load())
+	counter("ytmp3_queue_wait_exceeded_total", "Jobs failed for waiting longer than MAX_QUEUE_WAIT.", a.metrics.QueueWaitExceeded.Load())
+	counter("ytmp3_asset_cache_hits_total", "Prepares and reconverts that reused an existing or in-flight download.", a.metrics.AssetCacheHits.Load())
+	counter("ytmp3_asset_cache_misses_total", "Prepares and reconverts that found no usable download.", a.metrics.AssetCacheMisses.Load())
+	counter("ytmp3_variant_cache_hits_total", "Conversions answered with an existing output.", a.metrics.VariantCacheHits.Load())
+	counter("ytmp3_variant_cache_misses_total", "Conversions that had to be encoded.", a.metrics.VariantCacheMisses.Load())
+	writeRouteMetrics(w, a.metrics.RouteStats())
+	writeMetadataMetrics(w, a.metrics.MetadataStats())
+	writeToolMetrics(w, a.metrics.ToolAvailability())
+}
+
+// writeToolMetrics renders one 0/1 gauge per external tool from the latest
+// background probe.
+func writeToolMetrics(w io.Writer, tools map[string]bool) {
+	names := make([]string, 0, len(tools))
+	for n := range tools {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	io.WriteString(w, "# HELP ytmp3_tool_available Whether the external tool was found by the last probe (1) or not (0).\n# TYPE ytmp3_tool_available gauge\n")
+	for _, n := range names {
+		v := 0
+		if tools[n] {
+			v = 1
+		}
+		fmt.Fprintf(w, "ytmp3_tool_available{tool=\"%s\"} %d\n", promEscape(n), v)
+	}
+}
+
+// writeMetadataMetrics renders the metadata fetch latency histogram and the
+// count of failed fetches.
+func writeMetadataMetrics(w io.Writer, st metrics.RouteSnapshot) {
+	fmt.Fprintf(w, "# HELP ytmp3_metadata_fetch_errors_total Metadata fetches that failed.\n# TYPE ytmp3_metadata_fetch_errors_total counter\nytmp3_metadata_fetch_errors_total %d\n", st.Errors)
+	io.WriteString(w, "# HELP ytmp3_metadata_fetch_duration_seconds Metadata fetch latency, including the wait for a permit.\n# TYPE ytmp3_metadata_fetch_duration_seconds histogram\n")
+	var cum int64
+	for i, le := range metrics.RouteBuckets {
+		cum += st.Buckets[i]
+		fmt.Fprintf(w, "ytmp3_metadata_fetch_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cum)
+	}
+	fmt.Fprintf(w, "ytmp3_metadata_fetch_duration_seconds_bucket{le=\"+Inf\"} %d\n", st.Count)
+	fmt.Fprintf(w, "ytmp3_metadata_fetch_duration_seconds_sum %g\n", st.SumSeconds)
+	fmt.Fprintf(w, "ytmp3_metadata_fetch_duration_seconds_count %d\n", st.Count)
+}
+
+// writeRouteMetrics renders per-route request counts, 5xx counts and a
+// cumulative latency histogram, labelled by method and route pattern.
+func writeRouteMetrics(w io.Writer, stats map[string]metrics.RouteSnapshot) {
+	routes := make([]string, 0, len(stats))
+	for route := range stats {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	labels := func(route string) string {
+		method, pattern, _ := strings.Cut(route, " ")
+		return `method="` + promEscape(method) + `",route="` + promEscape(pattern) + `"`
+	}
+	io.WriteString(w, "# HELP ytmp3_http_requests_total HTTP requests by route.\n# TYPE ytmp3_http_requests_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "ytmp3_http_requests_total{%s} %d\n", labels(route), stats[route].Count)
+	}
+	io.WriteString(w, "# HELP ytmp3_http_request_errors_total HTTP 5xx responses by route.\n# TYPE ytmp3_http_request_errors_total counter\n")
+	for _, route := range routes {
+		fmt.Fprintf(w, "ytmp3_http_request_errors_total{%s} %d\n", labels(route), stats[route].Errors)
+	}
+	io.WriteString(w, "# HELP ytmp3_http_request_duration_seconds HTTP request latency by route.\n# TYPE ytmp3_http_request_duration_seconds histogram\n")
+	for _, route := range routes {
+		st := stats[route]
+		l := labels(route)
+		var cum int64
+		for i, le := range metrics.RouteBuckets {
+			cum += st.Buckets[i]
+			fmt.Fprintf(w, "ytmp3_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", l, strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "ytmp3_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, st.Count)
+		fmt.Fprintf(w, "ytmp3_http_request_duration_seconds_sum{%s} %g\n", l, st.SumSeconds)
+		fmt.Fprintf(w, "ytmp3_http_request_duration_seconds_count{%s} %d\n", l, st.Count)
+	}
+}
+
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
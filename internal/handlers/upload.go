@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"ytmp3api/internal/converter"
+	"ytmp3api/internal/models"
+)
+
+// maxUploadFieldBytes bounds each non-file form field of an upload.
+const maxUploadFieldBytes = 1 << 10
+
+// handleUpload converts an audio file supplied by the client instead of a
+// URL. The multipart body carries the file in the "file" part plus the usual
+// convert fields (quality, start_time, end_time, sample_rate, channels,
+// precise, format, preset, client_ref). The file is stored as a source keyed by its content hash,
+// checked with ffprobe, and then goes through the normal convert path.
+func (a *API) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if a.sessionsFull(w) {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, a.cfg.MaxUploadBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeBadContentType, "Content-Type must be multipart/form-data")
+		return
+	}
+	fields := map[string]string{}
+	var tmpPath, filename, assetHash string
+	defer func() {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadErr(w, err)
+			return
+		}
+		if part.FormName() != "file" {
+			b, err := io.ReadAll(io.LimitReader(part, maxUploadFieldBytes))
+			if err != nil {
+				writeUploadErr(w, err)
+				return
+			}
+			fields[part.FormName()] = strings.TrimSpace(string(b))
+			continue
+		}
+		if tmpPath != "" {
+			writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "only one file may be uploaded")
+			return
+		}
+		f, err := os.CreateTemp(filepath.Join(a.cfg.ConversionsDir, "streams"), ".upload-*")
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to store upload")
+			return
+		}
+		tmpPath = f.Name()
+		h := sha1.New()
+		_, err = io.Copy(f, io.TeeReader(part, h))
+		f.Close()
+		if err != nil {
+			writeUploadErr(w, err)
+			return
+		}
+		filename = part.FileName()
+		assetHash = hex.EncodeToString(h.Sum(nil))
+	}
+	if tmpPath == "" {
+		writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "missing file")
+		return
+	}
+	dur, err := converter.ProbeAudio(r.Context(), tmpPath)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, CodeNotAudio, "uploaded file is not audio: "+err.Error())
+		return
+	}
+	req := models.ConvertRequest{
+		Quality:   models.ConversionQuality(fields["quality"]),
+		StartTime: fields["start_time"],
+		EndTime:   fields["end_time"],
+		Precise:   fields["precise"] == "true",
+		Format:    fields["format"],
+		Preset:    fields["preset"],
+		ClientRef: fields["client_ref"],
+	}
+	for name, dst := range map[string]*int{"sample_rate": &req.SampleRate, "channels": &req.Channels} {
+		if v := fields[name]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "invalid "+name)
+				return
+			}
+			*dst = n
+		}
+	}
+	if errs := req.ValidateOptions(a.validationRules()); len(errs) > 0 {
+		writeFieldErrs(w, errs)
+		return
+	}
+	a.applyDefaults(&req)
+
+	// Identical uploads share one source file
+	src := filepath.Join(a.cfg.ConversionsDir, "streams", assetHash+".source")
+	if _, err := os.Stat(src); err != nil {
+		if err := os.Rename(tmpPath, src); err != nil {
+			writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to store upload")
+			return
+		}
+		tmpPath = ""
+	}
+	a.touchSource(src)
+	_ = a.sessions.SetAsset(r.Context(), assetHash, src, string(models.StateDownloaded))
+
+	title := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	s := &models.ConversionSession{ID: newID(), AssetHash: assetHash, SourcePath: src, State: models.StateDownloaded, Meta: models.MetaLite{Title: title, Duration: dur}}
+	if err := a.createSession(r.Context(), s); err != nil {
+		writeErr(w, http.StatusInternalServerError, CodeInternal, "failed to create session")
+		return
+	}
+	a.submitConvert(w, r, s, req)
+}
+
+// writeUploadErr maps errors reading the multipart body to 413 or 400.
+func writeUploadErr(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeErr(w, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "upload too large")
+		return
+	}
+	writeErr(w, http.StatusBadRequest, CodeInvalidRequest, "invalid upload")
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -17,14 +18,96 @@ type Registry struct {
 	SuccessCount   atomic.Int64
 	ErrorCount     atomic.Int64
 	SessionsActive atomic.Int64
+	// QueueWaitExceeded counts jobs failed because they sat in the queue
+	// longer than MaxQueueWait.
+	QueueWaitExceeded atomic.Int64
+	// Asset and variant cache lookups: a hit reuses an existing or in-flight
+	// download (asset) or converted output (variant) instead of running
+	// yt-dlp or ffmpeg again.
+	AssetCacheHits     atomic.Int64
+	AssetCacheMisses   atomic.Int64
+	VariantCacheHits   atomic.Int64
+	VariantCacheMisses atomic.Int64
 
     // simple histograms (fixed buckets)
     ConvertLatencyBuckets [10]atomic.Int64
     DownloadLatencyBuckets [10]atomic.Int64
+
+	// running totals for averages; sums are kept in microseconds so they
+	// can be accumulated atomically
+	convertDurationSumUs  atomic.Int64
+	convertDurationCount  atomic.Int64
+	downloadDurationSumUs atomic.Int64
+	downloadDurationCount atomic.Int64
+
+	routesMu sync.Mutex
+	routes   map[string]*routeStat
+
+	// metadata tracks FetchMetadata latency, including the wait for a
+	// metadata permit, on the RouteBuckets scale.
+	metadata routeStat
+
+	// history is a ring of the most recent samples; historyHead indexes the
+	// oldest once it is full.
+	historyMu   sync.Mutex
+	history     []Sample
+	historySize int
+	historyHead int
+
+	// tools holds the latest availability of each external tool, as
+	// reported by the background prober.
+	toolsMu sync.RWMutex
+	tools   map[string]bool
+}
+
+// Sample is one point of the stats time series. Succeeded and Failed count
+// download and convert jobs finished since the previous sample, and
+// SuccessRate is their ratio (1 when none finished).
+type Sample struct {
+	Time             time.Time `json:"time"`
+	QueueDownloadLen int       `json:"queue_download_len"`
+	QueueConvertLen  int       `json:"queue_convert_len"`
+	ActiveJobs       int64     `json:"active_jobs"`
+	Succeeded        int64     `json:"succeeded"`
+	Failed           int64     `json:"failed"`
+	SuccessRate      float64   `json:"success_rate"`
+}
+
+// SetHistorySize sets how many samples RecordSample keeps, discarding any
+// already recorded.
+func (r *Registry) SetHistorySize(n int) {
+	r.historyMu.Lock()
+	r.history, r.historySize, r.historyHead = nil, n, 0
+	r.historyMu.Unlock()
+}
+
+// RecordSample appends s to the history, overwriting the oldest sample once
+// the history is full.
+func (r *Registry) RecordSample(s Sample) {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+	if r.historySize <= 0 {
+		return
+	}
+	if len(r.history) < r.historySize {
+		r.history = append(r.history, s)
+		return
+	}
+	r.history[r.historyHead] = s
+	r.historyHead = (r.historyHead + 1) % len(r.history)
+}
+
+// History returns the recorded samples, oldest first.
+func (r *Registry) History() []Sample {
+	r.historyMu.Lock()
+	defer r.historyMu.Unlock()
+	out := make([]Sample, 0, len(r.history))
+	out = append(out, r.history[r.historyHead:]...)
+	return append(out, r.history[:r.historyHead]...)
 }
 
 func NewRegistry() *Registry {
-	r := &Registry{UptimeStart: time.Now()}
+	r := &Registry{UptimeStart: time.Now(), routes: make(map[string]*routeStat)}
 	return r
 }
 
@@ -38,13 +121,56 @@ func (r *Registry) ObserveDuration(seconds float64, isConvert bool) {
             break
         }
     }
+    us := int64(seconds * 1e6)
     if isConvert {
         r.ConvertLatencyBuckets[idx].Add(1)
+        r.convertDurationSumUs.Add(us)
+        r.convertDurationCount.Add(1)
     } else {
         r.DownloadLatencyBuckets[idx].Add(1)
+        r.downloadDurationSumUs.Add(us)
+        r.downloadDurationCount.Add(1)
     }
 }
 
+// AvgDurationSeconds returns the mean observed duration for conversions or
+// downloads, or 0 when nothing has been observed yet.
+func (r *Registry) AvgDurationSeconds(isConvert bool) float64 {
+	if isConvert {
+		return avgSeconds(r.convertDurationSumUs.Load(), r.convertDurationCount.Load())
+	}
+	return avgSeconds(r.downloadDurationSumUs.Load(), r.downloadDurationCount.Load())
+}
+
+// AvgProcessingSeconds returns the mean duration across all observed
+// downloads and conversions combined.
+func (r *Registry) AvgProcessingSeconds() float64 {
+	sum := r.convertDurationSumUs.Load() + r.downloadDurationSumUs.Load()
+	n := r.convertDurationCount.Load() + r.downloadDurationCount.Load()
+	return avgSeconds(sum, n)
+}
+
+func avgSeconds(sumUs, n int64) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(sumUs) / float64(n) / 1e6
+}
+
+// LatencyBuckets returns a point-in-time copy of the convert or download
+// histogram counts in bucket order.
+func (r *Registry) LatencyBuckets(isConvert bool) []int64 {
+	src := &r.DownloadLatencyBuckets
+	if isConvert {
+		src = &r.ConvertLatencyBuckets
+	}
+	out := make([]int64, len(src))
+	for i := range src {
+		out[i] = src[i].Load()
+	}
+	return out
+}
+
 func (r *Registry) SuccessRate() float64 {
 	s := r.SuccessCount.Load()
 	e := r.ErrorCount.Load()
@@ -55,6 +181,146 @@ func (r *Registry) SuccessRate() float64 {
 	return float64(s) / float64(t)
 }
 
+// HitRatePercent returns hits as a percentage of all lookups, or 0 when
+// there were none.
+func HitRatePercent(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) * 100 / float64(hits+misses)
+}
+
 func (r *Registry) UptimeSeconds() int64 {
 	return int64(time.Since(r.UptimeStart).Seconds())
 }
+
+// RouteBuckets are the upper bounds, in seconds, of the per-route request
+// latency histogram. Requests slower than the last bound land in a final
+// overflow bucket.
+var RouteBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type routeStat struct {
+	count   atomic.Int64
+	errors  atomic.Int64
+	sumUs   atomic.Int64
+	buckets [12]atomic.Int64
+}
+
+// RouteSnapshot is a point-in-time copy of one route's request stats.
+// Buckets follow RouteBuckets plus the overflow bucket and are not
+// cumulative. Errors counts 5xx responses.
+type RouteSnapshot struct {
+	Count      int64   `json:"count"`
+	Errors     int64   `json:"errors"`
+	SumSeconds float64 `json:"sum_seconds"`
+	Buckets    []int64 `json:"latency_buckets"`
+}
+
+// ObserveRoute records one request for route (a method and route pattern,
+// never a raw path) with its response status and latency.
+func (r *Registry) ObserveRoute(route string, status int, seconds float64) {
+	r.routesMu.Lock()
+	st, ok := r.routes[route]
+	if !ok {
+		st = &routeStat{}
+		r.routes[route] = st
+	}
+	r.routesMu.Unlock()
+	st.observe(seconds, status >= 500)
+}
+
+func (st *routeStat) observe(seconds float64, failed bool) {
+	idx := len(RouteBuckets)
+	for i, b := range RouteBuckets {
+		if seconds <= b {
+			idx = i
+			break
+		}
+	}
+	st.buckets[idx].Add(1)
+	st.count.Add(1)
+	st.sumUs.Add(int64(seconds * 1e6))
+	if failed {
+		st.errors.Add(1)
+	}
+}
+
+func (st *routeStat) snapshot() RouteSnapshot {
+	b := make([]int64, len(st.buckets))
+	for i := range st.buckets {
+		b[i] = st.buckets[i].Load()
+	}
+	return RouteSnapshot{Count: st.count.Load(), Errors: st.errors.Load(), SumSeconds: float64(st.sumUs.Load()) / 1e6, Buckets: b}
+}
+
+// ObserveMetadata records one metadata fetch and whether it failed.
+func (r *Registry) ObserveMetadata(seconds float64, failed bool) {
+	r.metadata.observe(seconds, failed)
+}
+
+// MetadataStats returns a snapshot of metadata fetch latency. Errors counts
+// failed fetches.
+func (r *Registry) MetadataStats() RouteSnapshot {
+	return r.metadata.snapshot()
+}
+
+// SetToolAvailable records whether the named external tool was found by the
+// latest probe.
+func (r *Registry) SetToolAvailable(name string, ok bool) {
+	r.toolsMu.Lock()
+	defer r.toolsMu.Unlock()
+	if r.tools == nil {
+		r.tools = make(map[string]bool)
+	}
+	r.tools[name] = ok
+}
+
+// ToolAvailability returns the latest probe result for each external tool.
+func (r *Registry) ToolAvailability() map[string]bool {
+	r.toolsMu.RLock()
+	defer r.toolsMu.RUnlock()
+	out := make(map[string]bool, len(r.tools))
+	for n, ok := range r.tools {
+		out[n] = ok
+	}
+	return out
+}
+
+// RouteStats returns a snapshot of all observed routes.
+func (r *Registry) RouteStats() map[string]RouteSnapshot {
+	r.routesMu.Lock()
+	defer r.routesMu.Unlock()
+	out := make(map[string]RouteSnapshot, len(r.routes))
+	for route, st := range r.routes {
+		out[route] = st.snapshot()
+	}
+	return out
+}
+
+// Reset zeroes the counters, histograms, averages, route and metadata stats. Gauges
+// that mirror live state (active/queued jobs, workers, capacity, rate limit,
+// sessions) are kept, since zeroing them would desync them from the queues.
+// Each value is reset atomically, so concurrent updates are never lost to a
+// torn write, though one racing the reset may land on either side of it.
+func (r *Registry) Reset() {
+	for _, c := range []*atomic.Int64{
+		&r.CompletedJobs, &r.FailedJobs, &r.SuccessCount, &r.ErrorCount, &r.QueueWaitExceeded,
+		&r.AssetCacheHits, &r.AssetCacheMisses, &r.VariantCacheHits, &r.VariantCacheMisses,
+		&r.convertDurationSumUs, &r.convertDurationCount, &r.downloadDurationSumUs, &r.downloadDurationCount,
+		&r.metadata.count, &r.metadata.errors, &r.metadata.sumUs,
+	} {
+		c.Store(0)
+	}
+	for i := range r.ConvertLatencyBuckets {
+		r.ConvertLatencyBuckets[i].Store(0)
+	}
+	for i := range r.DownloadLatencyBuckets {
+		r.DownloadLatencyBuckets[i].Store(0)
+	}
+	for i := range r.metadata.buckets {
+		r.metadata.buckets[i].Store(0)
+	}
+	r.routesMu.Lock()
+	r.routes = make(map[string]*routeStat)
+	r.routesMu.Unlock()
+}
@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the JWT claims the API understands. Tier selects the priority
+// tier ("free" or "premium"); RateLimit and RateBurst, when set, replace the
+// per-IP rate limit for the token's subject.
+type Claims struct {
+	Tier      string  `json:"tier"`
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+	jwt.RegisteredClaims
+}
+
+type claimsKey struct{}
+
+// ClaimsFrom returns the verified JWT claims for the request, if any.
+func ClaimsFrom(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+// JWTVerifier validates bearer tokens signed with an HS256 secret and/or RS256
+// keys published at a JWKS URL.
+type JWTVerifier struct {
+	secret   []byte
+	jwksURL  string
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// jwksRefreshInterval bounds how often an unknown key id triggers a refetch.
+const jwksRefreshInterval = time.Minute
+
+// NewJWTVerifier returns nil when neither a secret nor a JWKS URL is
+// configured, meaning JWT auth is disabled. Issuer and audience are checked
+// only when non-empty.
+func NewJWTVerifier(secret, jwksURL, issuer, audience string) *JWTVerifier {
+	if secret == "" && jwksURL == "" {
+		return nil
+	}
+	return &JWTVerifier{
+		secret:   []byte(secret),
+		jwksURL:  jwksURL,
+		issuer:   issuer,
+		audience: audience,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		keys:     map[string]*rsa.PublicKey{},
+	}
+}
+
+// Verify parses and validates token, returning its claims.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	var opts []jwt.ParserOption
+	opts = append(opts, jwt.WithValidMethods(v.methods()), jwt.WithExpirationRequired())
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		switch t.Method.Alg() {
+		case "HS256":
+			return v.secret, nil
+		case "RS256":
+			kid, _ := t.Header["kid"].(string)
+			return v.rsaKey(ctx, kid)
+		}
+		return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) methods() []string {
+	var m []string
+	if len(v.secret) > 0 {
+		m = append(m, "HS256")
+	}
+	if v.jwksURL != "" {
+		m = append(m, "RS256")
+	}
+	return m
+}
+
+// rsaKey returns the JWKS key for kid, refetching the key set when kid is
+// unknown and the cached set is older than jwksRefreshInterval.
+func (v *JWTVerifier) rsaKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(v.fetchedAt) < jwksRefreshInterval {
+		return nil, errors.New("unknown key id")
+	}
+	keys, err := v.fetchJWKS(ctx)
+	v.fetchedAt = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	if k, ok := v.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errors.New("unknown key id")
+}
+
+func (v *JWTVerifier) fetchJWKS(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks: status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return "", false
+	}
+	t := strings.TrimSpace(h[7:])
+	return t, t != ""
+}
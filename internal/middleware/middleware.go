@@ -1,15 +1,42 @@
 package middleware
 
 import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/go-chi/chi/v5"
+	chimw "github.com/go-chi/chi/v5/middleware"
+)
+
+// Error codes of the requests the middlewares reject. They use the same
+// {"error", "code"} body as the handlers' errors.
+const (
+	CodeRateLimited  = "RATE_LIMITED"
+	CodeUnauthorized = "UNAUTHORIZED"
+	CodeForbidden    = "FORBIDDEN"
 )
 
+// writeError writes a JSON error body with a stable code.
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": code})
+}
+
+// LimitFunc returns the current rate (tokens per second) and burst for a
+// limiter. It is consulted on every request so limits can be changed at
+// runtime.
+type LimitFunc func() (rps float64, burst int)
+
 type ipLimiter struct {
-	rate    float64
-	burst   int
+	limit   LimitFunc
 	mu      sync.Mutex
 	buckets map[string]*tokenBucket
 }
@@ -21,19 +48,11 @@ type tokenBucket struct {
 	last     time.Time
 }
 
-func newIPLimiter(rate float64, burst int) *ipLimiter {
-	return &ipLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
-}
-
-func (l *ipLimiter) allow(ip string) bool {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	b, ok := l.buckets[ip]
-	if !ok {
-		b = &tokenBucket{capacity: l.burst, tokens: float64(l.burst), rate: l.rate, last: time.Now()}
-		l.buckets[ip] = b
-	}
-	now := time.Now()
+// take refills the bucket for the elapsed time using the given rate and
+// capacity, then consumes a token if one is available.
+func (b *tokenBucket) take(now time.Time, rate float64, capacity int) bool {
+	b.rate = rate
+	b.capacity = capacity
 	delta := now.Sub(b.last).Seconds()
 	b.tokens += delta * b.rate
 	if b.tokens > float64(b.capacity) {
@@ -47,27 +66,33 @@ func (l *ipLimiter) allow(ip string) bool {
 	return false
 }
 
-func GlobalRateLimiter(rps float64, burst int) func(http.Handler) http.Handler {
+func newIPLimiter(limit LimitFunc) *ipLimiter {
+	return &ipLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *ipLimiter) allow(ip string, rate float64, burst int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{capacity: burst, tokens: float64(burst), rate: rate, last: time.Now()}
+		l.buckets[ip] = b
+	}
+	return b.take(time.Now(), rate, burst)
+}
+
+func GlobalRateLimiter(limit LimitFunc) func(http.Handler) http.Handler {
+	rps, burst := limit()
 	bucket := &tokenBucket{capacity: burst, tokens: float64(burst), rate: rps, last: time.Now()}
 	var mu sync.Mutex
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rps, burst := limit()
 			mu.Lock()
-			now := time.Now()
-			delta := now.Sub(bucket.last).Seconds()
-			bucket.tokens += delta * bucket.rate
-			if bucket.tokens > float64(bucket.capacity) {
-				bucket.tokens = float64(bucket.capacity)
-			}
-			bucket.last = now
-			allowed := bucket.tokens >= 1
-			if allowed {
-				bucket.tokens -= 1
-			}
+			allowed := bucket.take(time.Now(), rps, burst)
 			mu.Unlock()
 			if !allowed {
-				w.WriteHeader(http.StatusTooManyRequests)
-				_, _ = w.Write([]byte("rate limit exceeded"))
+				writeError(w, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -75,17 +100,49 @@ func GlobalRateLimiter(rps float64, burst int) func(http.Handler) http.Handler {
 	}
 }
 
-func PerIPRateLimiter(rps float64, burst int) func(http.Handler) http.Handler {
-	lim := newIPLimiter(rps, burst)
+// ClientIP returns the client address for r. When trustedHeader is set (e.g.
+// "X-Forwarded-For" or "X-Real-IP") and present on the request, the last
+// address it lists is used: that is the one our proxy appended, while any
+// earlier entries come from the client and can be forged. Otherwise the host
+// part of RemoteAddr is used. Only configure a trusted header when a proxy in
+// front of us sets it.
+func ClientIP(r *http.Request, trustedHeader string) string {
+	if trustedHeader != "" {
+		if vals := r.Header.Values(trustedHeader); len(vals) > 0 {
+			v := vals[len(vals)-1]
+			if idx := strings.LastIndexByte(v, ','); idx != -1 {
+				v = v[idx+1:]
+			}
+			if ip := strings.TrimSpace(v); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func PerIPRateLimiter(limit LimitFunc, trustedHeader string) func(http.Handler) http.Handler {
+	lim := newIPLimiter(limit)
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := r.RemoteAddr
-			if idx := strings.LastIndex(ip, ":"); idx != -1 {
-				ip = ip[:idx]
+			key := ClientIP(r, trustedHeader)
+			rate, burst := lim.limit()
+			// JWT callers are limited per subject, at their own rate if set
+			if c, ok := ClaimsFrom(r.Context()); ok && c.Subject != "" {
+				key = "sub:" + c.Subject
+				if c.RateLimit > 0 {
+					rate, burst = c.RateLimit, c.RateBurst
+					if burst <= 0 {
+						burst = int(c.RateLimit*2) + 1
+					}
+				}
 			}
-			if !lim.allow(ip) {
-				w.WriteHeader(http.StatusTooManyRequests)
-				_, _ = w.Write([]byte("per-ip rate limit exceeded"))
+			if !lim.allow(key, rate, burst) {
+				writeError(w, http.StatusTooManyRequests, CodeRateLimited, "per-ip rate limit exceeded")
 				return
 			}
 			next.ServeHTTP(w, r)
@@ -93,26 +150,56 @@ func PerIPRateLimiter(rps float64, burst int) func(http.Handler) http.Handler {
 	}
 }
 
-func APIKey(required bool, keys map[string]struct{}) func(http.Handler) http.Handler {
+// APIKey authenticates requests by X-API-Key or, when verifier is non-nil, by
+// a JWT bearer token; either grants access. A verified token's claims are
+// stored in the request context (see ClaimsFrom). Invalid bearer tokens are
+// rejected even when auth is not required.
+func APIKey(required bool, keys map[string]struct{}, verifier *JWTVerifier) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tok, ok := bearerToken(r); ok && verifier != nil {
+				claims, err := verifier.Verify(r.Context(), tok)
+				if err != nil {
+					writeError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid token")
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+				return
+			}
 			if !required {
 				next.ServeHTTP(w, r)
 				return
 			}
 			k := r.Header.Get("X-API-Key")
 			if _, ok := keys[k]; !ok {
-				w.WriteHeader(http.StatusUnauthorized)
-				_, _ = w.Write([]byte("invalid api key"))
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid api key")
 				return
 			}
-			// Optionally, priority per API key via header (used by queues if implemented)
-			// r.Header.Set("X-API-Priority", keyPriority(k))
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// Compress gzip/deflate-encodes text and JSON responses for clients that
+// send Accept-Encoding. Requests whose path starts with one of skipPrefixes
+// bypass compression entirely (e.g. audio downloads, which are already
+// compressed and rely on exact Content-Length and Range handling).
+func Compress(level int, skipPrefixes ...string) func(http.Handler) http.Handler {
+	compress := chimw.Compress(level)
+	return func(next http.Handler) http.Handler {
+		compressed := compress(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range skipPrefixes {
+				if strings.HasPrefix(r.URL.Path, p) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			compressed.ServeHTTP(w, r)
+		})
+	}
+}
+
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -123,31 +210,119 @@ func SecurityHeaders(next http.Handler) http.Handler {
 }
 
 // IPAllowlistMiddleware blocks requests not in the allowlist when the list is non-empty.
-func IPAllowlistMiddleware(allow []string) func(http.Handler) http.Handler {
-    // Normalize allowlist
-    allowed := map[string]struct{}{}
-    for _, ip := range allow {
-        ip = strings.TrimSpace(ip)
-        if ip != "" {
-            allowed[ip] = struct{}{}
+// Entries may be single IPs or CIDR blocks such as "10.0.0.0/8". allow is
+// consulted on every request so the list can be changed at runtime; it is
+// only re-parsed when it changes.
+func IPAllowlistMiddleware(allow func() []string, trustedHeader string) func(http.Handler) http.Handler {
+    var (
+        mu      sync.Mutex
+        last    []string
+        allowed map[string]struct{}
+        nets    []*net.IPNet
+    )
+    parsed := func() (map[string]struct{}, []*net.IPNet) {
+        list := allow()
+        mu.Lock()
+        defer mu.Unlock()
+        if allowed == nil || !slices.Equal(list, last) {
+            last = list
+            allowed, nets = parseAllowlist(list)
         }
+        return allowed, nets
     }
     return func(next http.Handler) http.Handler {
-        // If no allowlist configured, pass-through
-        if len(allowed) == 0 {
-            return next
-        }
         return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-            ip := r.RemoteAddr
-            if idx := strings.LastIndex(ip, ":"); idx != -1 {
-                ip = ip[:idx]
+            allowed, nets := parsed()
+            // If no allowlist configured, pass-through
+            if len(allowed) == 0 && len(nets) == 0 {
+                next.ServeHTTP(w, r)
+                return
             }
-            if _, ok := allowed[ip]; !ok {
-                w.WriteHeader(http.StatusForbidden)
-                _, _ = w.Write([]byte("ip not allowed"))
+            ip := ClientIP(r, trustedHeader)
+            if !ipAllowed(ip, allowed, nets) {
+                writeError(w, http.StatusForbidden, CodeForbidden, "ip not allowed")
                 return
             }
             next.ServeHTTP(w, r)
         })
     }
 }
+
+// parseAllowlist splits allowlist entries into exact addresses and CIDR
+// blocks.
+func parseAllowlist(allow []string) (map[string]struct{}, []*net.IPNet) {
+    allowed := map[string]struct{}{}
+    var nets []*net.IPNet
+    for _, ip := range allow {
+        ip = strings.TrimSpace(ip)
+        if ip == "" {
+            continue
+        }
+        if strings.Contains(ip, "/") {
+            if _, n, err := net.ParseCIDR(ip); err == nil {
+                nets = append(nets, n)
+                continue
+            }
+        }
+        allowed[ip] = struct{}{}
+    }
+    return allowed, nets
+}
+
+func ipAllowed(ip string, exact map[string]struct{}, nets []*net.IPNet) bool {
+	if _, ok := exact[ip]; ok {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuth guards admin endpoints with HTTP basic auth against the
+// credentials creds returns, consulted on every request so they can be
+// changed at runtime. An empty password disables the endpoints entirely.
+func AdminAuth(creds func() (user, pass string)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass := creds()
+			u, p, ok := r.BasicAuth()
+			if pass == "" || !ok ||
+				subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+				subtle.ConstantTimeCompare([]byte(p), []byte(pass)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RouteMetrics reports each request's route as "METHOD pattern" using chi's
+// matched route pattern, so path parameters don't create new series.
+// Requests that match no route are reported as "METHOD unmatched".
+func RouteMetrics(observe func(route string, status int, seconds float64)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := chimw.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			pattern := "unmatched"
+			if rc := chi.RouteContext(r.Context()); rc != nil && rc.RoutePattern() != "" {
+				pattern = rc.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			observe(r.Method+" "+pattern, status, time.Since(start).Seconds())
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		values     []string
+		want       string
+	}{
+		{name: "ipv4 remote addr", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "ipv6 remote addr", remoteAddr: "[::1]:8080", want: "::1"},
+		{name: "ipv6 full remote addr", remoteAddr: "[2001:db8::7]:443", want: "2001:db8::7"},
+		{name: "remote addr without port", remoteAddr: "10.0.0.1", want: "10.0.0.1"},
+		{name: "header ignored when not trusted", remoteAddr: "10.0.0.1:1234", values: []string{"1.2.3.4"}, want: "10.0.0.1"},
+		{name: "forwarded single", remoteAddr: "10.0.0.1:1234", header: "X-Forwarded-For", values: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "forwarded spoofed leftmost", remoteAddr: "10.0.0.1:1234", header: "X-Forwarded-For", values: []string{"1.2.3.4, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "forwarded repeated header", remoteAddr: "10.0.0.1:1234", header: "X-Forwarded-For", values: []string{"1.2.3.4", "203.0.113.9"}, want: "203.0.113.9"},
+		{name: "forwarded ipv6", remoteAddr: "10.0.0.1:1234", header: "X-Forwarded-For", values: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "real ip", remoteAddr: "10.0.0.1:1234", header: "X-Real-IP", values: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "trusted header missing", remoteAddr: "[::1]:8080", header: "X-Real-IP", want: "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			name := tt.header
+			if name == "" {
+				name = "X-Forwarded-For"
+			}
+			for _, v := range tt.values {
+				r.Header.Add(name, v)
+			}
+			if got := ClientIP(r, tt.header); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPerIPRateLimiterIgnoresSpoofedForwardedFor(t *testing.T) {
+	limit := func() (float64, int) { return 0.001, 1 }
+	h := PerIPRateLimiter(limit, "X-Forwarded-For")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i, spoof := range []string{"1.1.1.1", "2.2.2.2"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Forwarded-For", spoof+", 203.0.113.9")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		want := http.StatusOK
+		if i > 0 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("request %d with spoofed %s: status %d, want %d", i, spoof, w.Code, want)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	tests := []struct {
+		name       string
+		user, pass string
+		reqUser    string
+		reqPass    string
+		noAuth     bool
+		want       int
+	}{
+		{name: "no password configured refuses", user: "admin", pass: "", reqUser: "admin", reqPass: "", want: http.StatusUnauthorized},
+		{name: "no password configured refuses without auth", user: "admin", pass: "", noAuth: true, want: http.StatusUnauthorized},
+		{name: "correct credentials", user: "admin", pass: "s3cret", reqUser: "admin", reqPass: "s3cret", want: http.StatusOK},
+		{name: "wrong password", user: "admin", pass: "s3cret", reqUser: "admin", reqPass: "password", want: http.StatusUnauthorized},
+		{name: "wrong user", user: "admin", pass: "s3cret", reqUser: "root", reqPass: "s3cret", want: http.StatusUnauthorized},
+		{name: "missing auth", user: "admin", pass: "s3cret", noAuth: true, want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := AdminAuth(func() (string, string) { return tt.user, tt.pass })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/queue", nil)
+			if !tt.noAuth {
+				r.SetBasicAuth(tt.reqUser, tt.reqPass)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectionsUseJSONErrors(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tight := func() (float64, int) { return 0.001, 1 }
+	tests := []struct {
+		name    string
+		handler http.Handler
+		prime   bool
+		setup   func(r *http.Request)
+		status  int
+		code    string
+	}{
+		{name: "global rate limit", handler: GlobalRateLimiter(tight)(ok), prime: true, status: http.StatusTooManyRequests, code: CodeRateLimited},
+		{name: "per-ip rate limit", handler: PerIPRateLimiter(tight, "")(ok), prime: true, status: http.StatusTooManyRequests, code: CodeRateLimited},
+		{name: "missing api key", handler: APIKey(true, map[string]struct{}{"k": {}}, nil)(ok), status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "invalid token", handler: APIKey(false, nil, NewJWTVerifier("secret", "", "", ""))(ok), setup: func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "admin", handler: AdminAuth(func() (string, string) { return "admin", "s3cret" })(ok), status: http.StatusUnauthorized, code: CodeUnauthorized},
+		{name: "ip allowlist", handler: IPAllowlistMiddleware(func() []string { return []string{"10.0.0.1"} }, "")(ok), status: http.StatusForbidden, code: CodeForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				if tt.setup != nil {
+					tt.setup(r)
+				}
+				return r
+			}
+			if tt.prime {
+				tt.handler.ServeHTTP(httptest.NewRecorder(), req())
+			}
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, req())
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			var body struct{ Error, Code string }
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+			}
+			if body.Code != tt.code || body.Error == "" {
+				t.Errorf("body = %+v, want code %s with a message", body, tt.code)
+			}
+		})
+	}
+}
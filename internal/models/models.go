@@ -2,6 +2,8 @@ package models
 
 import "time"
 
+// ConversionQuality is a quality label of QUALITY_BITRATE_MAP. The constants
+// are the default labels, each named after its bitrate.
 type ConversionQuality string
 
 const (
@@ -12,6 +14,38 @@ const (
 	Quality320 ConversionQuality = "320"
 )
 
+// SupportedSampleRates and SupportedChannels are the accepted values for the
+// optional sample_rate and channels convert fields.
+var (
+	SupportedSampleRates = []int{22050, 44100, 48000}
+	SupportedChannels    = []int{1, 2}
+)
+
+// Output container formats. MP3 is the default; M4A holds AAC audio.
+const (
+	FormatMP3 = "mp3"
+	FormatM4A = "m4a"
+)
+
+// SupportedFormats lists the format values accepted by /convert.
+var SupportedFormats = []string{FormatMP3, FormatM4A}
+
+// Preset is a named bundle of convert settings. Normalize applies EBU R128
+// loudness normalization.
+type Preset struct {
+	Quality    ConversionQuality `json:"quality"`
+	Channels   int               `json:"channels,omitempty"`
+	SampleRate int               `json:"sample_rate,omitempty"`
+	Normalize  bool              `json:"normalize,omitempty"`
+}
+
+// Presets are the values accepted for a convert request's preset field.
+var Presets = map[string]Preset{
+	"voice":   {Quality: Quality64, Channels: 1, Normalize: true},
+	"podcast": {Quality: Quality128, Channels: 1, Normalize: true},
+	"music":   {Quality: Quality320, Channels: 2},
+}
+
 type ConversionState string
 
 const (
@@ -30,21 +64,86 @@ type MetaLite struct {
 	Title     string `json:"title"`
 	Duration  int    `json:"duration"`
 	Thumbnail string `json:"thumbnail"`
+	Uploader  string `json:"uploader,omitempty"`
+}
+
+// Encoding reports the settings a completed conversion was encoded with.
+// BitrateKbps is the constant bitrate in CBR mode and the measured average in
+// VBR mode, where VBRQuality holds the LAME quality level.
+type Encoding struct {
+	Mode        string `json:"mode"`
+	BitrateKbps int    `json:"bitrate_kbps"`
+	VBRQuality  *int   `json:"vbr_quality,omitempty"`
+	SampleRate  int    `json:"sample_rate,omitempty"`
+	Channels    int    `json:"channels,omitempty"`
 }
 
 type ConversionSession struct {
-	ID                 string            `json:"conversion_id"`
-	URL                string            `json:"url"`
-	AssetHash          string            `json:"asset_hash"`
-	VariantHash        string            `json:"variant_hash"`
-	State              ConversionState   `json:"status"`
-	CreatedAt          time.Time         `json:"created_at"`
-	UpdatedAt          time.Time         `json:"updated_at"`
-	SourcePath         string            `json:"source_path"`
-	OutputPath         string            `json:"output_path"`
-	Quality            ConversionQuality `json:"quality"`
-	Error              string            `json:"error"`
-	Meta               MetaLite          `json:"metadata"`
+	ID          string          `json:"conversion_id"`
+	URL         string          `json:"url"`
+	AssetHash   string          `json:"asset_hash"`
+	VariantHash string          `json:"variant_hash"`
+	State       ConversionState `json:"status"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	SourcePath  string          `json:"source_path"`
+	OutputPath  string          `json:"output_path"`
+	// TempOutputPath is the file the running conversion writes before it
+	// is renamed to OutputPath.
+	TempOutputPath string            `json:"temp_output_path,omitempty"`
+	Quality        ConversionQuality `json:"quality"`
+	// Format is the output container; empty means mp3.
+	Format string `json:"format,omitempty"`
+	Error  string `json:"error"`
+	// FailureKind classifies Error (see the handlers' failure kinds), so a
+	// retry can tell transient failures from permanent ones.
+	FailureKind string   `json:"failure_kind,omitempty"`
+	Meta        MetaLite `json:"metadata"`
+	// Cached is set when the latest stage was served from cache: an existing
+	// source at prepare, an existing output at convert.
+	Cached bool `json:"cached"`
+	// ParentID and Children link the sessions of a multi-quality convert:
+	// each child converts one quality of the parent's source.
+	ParentID string   `json:"parent_id,omitempty"`
+	Children []string `json:"children,omitempty"`
+	// Encoding is recorded once the output exists.
+	Encoding *Encoding `json:"encoding,omitempty"`
+	// RequestID is the X-Request-ID of the request that last started work
+	// on the session (prepare or convert), for correlating failures with
+	// logs.
+	RequestID string `json:"request_id,omitempty"`
+	// ClientRef is the caller's reference from the latest convert request.
+	ClientRef string `json:"client_ref,omitempty"`
+	// StartOffset is the "t" timestamp of the prepared URL in seconds; it
+	// is the default start_time of converts.
+	StartOffset int `json:"start_offset,omitempty"`
+	// Events is a bounded diagnostic log of state changes and retries,
+	// served by GET /jobs/{id}/logs.
+	Events []JobEvent `json:"events,omitempty"`
+	// DownloadProgress and ConversionProgress are the latest persisted
+	// percentages of the source download and of the current variant's
+	// conversion.
+	DownloadProgress   int `json:"download_progress"`
+	ConversionProgress int `json:"conversion_progress"`
+	// LastProgressAt is when progress, or a heartbeat of a conversion whose
+	// duration is unknown, was last persisted.
+	LastProgressAt time.Time `json:"last_progress_at"`
+}
+
+// JobEvent is one entry of a session's diagnostic log. URLs in Message are
+// redacted to scheme, host and path.
+type JobEvent struct {
+	Time    time.Time       `json:"time"`
+	State   ConversionState `json:"status"`
+	Message string          `json:"message,omitempty"`
+}
+
+// JobLogsResponse is returned by GET /jobs/{id}/logs, oldest event first.
+type JobLogsResponse struct {
+	ConversionID string     `json:"conversion_id"`
+	Status       string     `json:"status"`
+	Error        string     `json:"error,omitempty"`
+	Events       []JobEvent `json:"events"`
 }
 
 type PrepareRequest struct {
@@ -56,6 +155,10 @@ type PrepareResponse struct {
 	Status       string   `json:"status"`
 	Metadata     MetaLite `json:"metadata"`
 	Message      string   `json:"message"`
+	AssetHash    string   `json:"asset_hash,omitempty"`
+	Cached       bool     `json:"cached"`
+	// StartOffset is the URL's "t" timestamp, used as the default start.
+	StartOffset int `json:"start_offset,omitempty"`
 }
 
 type ConvertRequest struct {
@@ -63,6 +166,35 @@ type ConvertRequest struct {
 	Quality      ConversionQuality `json:"quality"`
 	StartTime    string            `json:"start_time"`
 	EndTime      string            `json:"end_time"`
+	// SampleRate (Hz) and Channels are optional; when omitted the source's
+	// native values are kept.
+	SampleRate int `json:"sample_rate,omitempty"`
+	Channels   int `json:"channels,omitempty"`
+	// Priority is optional and clamped to the range allowed for the caller's
+	// API key tier; 0 uses the tier default.
+	Priority int `json:"priority,omitempty"`
+	// Precise cuts start_time/end_time sample-accurately at the cost of a
+	// slower conversion.
+	Precise bool `json:"precise,omitempty"`
+	// Qualities, when set, converts each listed quality as its own child
+	// conversion instead of the single Quality.
+	Qualities []ConversionQuality `json:"qualities,omitempty"`
+	// SplitChapters converts each chapter of the video as its own child
+	// conversion.
+	SplitChapters bool `json:"split_chapters,omitempty"`
+	// Format selects the output container ("mp3" or "m4a"); empty is mp3.
+	Format string `json:"format,omitempty"`
+	// Formats, when set, converts each listed format as its own child
+	// conversion from the same source.
+	Formats []string `json:"formats,omitempty"`
+	// Preset names an entry of Presets supplying quality, channels, sample
+	// rate and normalization; it can't be combined with those fields.
+	Preset string `json:"preset,omitempty"`
+	// ClientRef is the caller's own reference for the conversion. It is
+	// added to the download filename and logs but not to the variant hash.
+	ClientRef string `json:"client_ref,omitempty"`
+	// Normalize is set from the preset, not by clients.
+	Normalize bool `json:"-"`
 }
 
 type ConvertResponse struct {
@@ -77,13 +209,141 @@ type ConvertAcceptedResponse struct {
 	ConversionID  string `json:"conversion_id"`
 	Status        string `json:"status"`
 	QueuePosition int    `json:"queue_position"`
-	Message       string `json:"message"`
+	// EstimatedWaitSeconds is a rough ETA derived from queue position and the
+	// recent average conversion time.
+	EstimatedWaitSeconds int    `json:"estimated_wait_seconds"`
+	Message              string `json:"message"`
+	AssetHash            string `json:"asset_hash,omitempty"`
+	VariantHash          string `json:"variant_hash,omitempty"`
+	Cached               bool   `json:"cached"`
 }
 
 type StatusResponse struct {
 	ConversionID       string `json:"conversion_id"`
 	Status             string `json:"status"`
-	DownloadURL        string `json:"download_url"`
-	QueuePosition      int    `json:"queue_position,omitempty"`
-	Error              string `json:"error,omitempty"`
+	DownloadProgress   int    `json:"download_progress"`
+	ConversionProgress int    `json:"conversion_progress"`
+	// LastProgressAt is when the running stage last reported progress; it
+	// keeps moving while a conversion of unknown duration stays at 0%.
+	LastProgressAt       *time.Time `json:"last_progress_at,omitempty"`
+	DownloadURL          string     `json:"download_url"`
+	QueuePosition        int        `json:"queue_position,omitempty"`
+	EstimatedWaitSeconds int        `json:"estimated_wait_seconds,omitempty"`
+	Error                string     `json:"error,omitempty"`
+	AssetHash            string     `json:"asset_hash,omitempty"`
+	VariantHash          string     `json:"variant_hash,omitempty"`
+	Cached               bool       `json:"cached"`
+	// Quality and Format are reported for the children of a fanned-out
+	// convert.
+	Quality ConversionQuality `json:"quality,omitempty"`
+	Format  string            `json:"format,omitempty"`
+	// Group is set on the parent of a multi-quality convert.
+	Group *GroupStatus `json:"group,omitempty"`
+	// Encoding is set once the conversion has completed.
+	Encoding *Encoding `json:"encoding,omitempty"`
+	// RequestID is reported for failed conversions so users can quote it.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// ConvertGroupResponse is returned for a convert request with several
+// qualities; each child has its own conversion_id to poll and download.
+type ConvertGroupResponse struct {
+	ConversionID string                    `json:"conversion_id"`
+	Status       string                    `json:"status"`
+	Children     []ConvertAcceptedResponse `json:"children"`
+	Message      string                    `json:"message"`
+	// DownloadURLs maps each format to its child's download URL for a
+	// multi-format convert. The URLs serve the file once that child
+	// completes.
+	DownloadURLs map[string]string `json:"download_urls,omitempty"`
+	// ChapterDownloadURLs lists each chapter's download URL, in chapter
+	// order, for a split_chapters convert.
+	ChapterDownloadURLs []string `json:"chapter_download_urls,omitempty"`
+}
+
+// GroupStatus aggregates the children of a multi-quality convert. Done is
+// true once every child has completed or failed.
+type GroupStatus struct {
+	Total     int              `json:"total"`
+	Completed int              `json:"completed"`
+	Failed    int              `json:"failed"`
+	Done      bool             `json:"done"`
+	Children  []StatusResponse `json:"children"`
+}
+
+// EstimateRequest asks for the expected output of a conversion without
+// running it. It takes the body /convert would, so the estimate and its
+// cache lookup see the same options.
+type EstimateRequest struct {
+	ConvertRequest
+}
+
+type EstimateResponse struct {
+	ConversionID    string `json:"conversion_id"`
+	DurationSeconds int    `json:"duration_seconds"`
+	BitrateKbps     int    `json:"bitrate_kbps"`
+	EstimatedBytes  int64  `json:"estimated_bytes"`
+	Cached          bool   `json:"cached"`
+}
+
+// FormatsResponse describes the qualities, formats and limits the server
+// accepts so clients can build their UI dynamically.
+type FormatsResponse struct {
+	Qualities               []ConversionQuality `json:"qualities"`
+	Formats                 []string            `json:"formats"`
+	EncodingMode            string              `json:"encoding_mode"`
+	CBRBitrate              string              `json:"cbr_bitrate,omitempty"`
+	VBRQuality              *int                `json:"vbr_quality,omitempty"`
+	MaxVideoDurationSeconds int                 `json:"max_video_duration_seconds"`
+	SampleRates             []int               `json:"sample_rates"`
+	Channels                []int               `json:"channels"`
+	// DefaultQuality and DefaultFormat are used when a convert request
+	// omits quality or format. In VBR mode DefaultQuality is only reported
+	// when configured, since mp3 quality is then set by vbr_quality.
+	DefaultQuality ConversionQuality `json:"default_quality,omitempty"`
+	DefaultFormat  string            `json:"default_format"`
+	Presets        map[string]Preset `json:"presets"`
+	// QualityBitrates maps each quality label to its bitrate in kbps.
+	QualityBitrates map[string]int `json:"quality_bitrates"`
+}
+
+// WarmRequest lists URLs whose sources should be downloaded ahead of demand.
+type WarmRequest struct {
+	URLs []string `json:"urls"`
+}
+
+// WarmResponse counts URLs newly enqueued for download versus already cached
+// (downloaded or downloading). Rejected lists URLs outside the allowed domains.
+type WarmResponse struct {
+	Enqueued int      `json:"enqueued"`
+	Cached   int      `json:"cached"`
+	Rejected []string `json:"rejected,omitempty"`
+}
+
+// PurgeRequest names a URL whose cached source and outputs should be dropped.
+type PurgeRequest struct {
+	URL string `json:"url"`
+}
+
+type PurgeResponse struct {
+	AssetHash      string `json:"asset_hash"`
+	VariantsPurged int    `json:"variants_purged"`
+	FilesRemoved   int    `json:"files_removed"`
+}
+
+// QueuedJob describes a job waiting in a queue, for the admin queue view.
+type QueuedJob struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	SessionID  string    `json:"conversion_id"`
+	Priority   int       `json:"priority"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	Attempts   int       `json:"attempts"`
+}
+
+type QueueSnapshotResponse struct {
+	Download    []QueuedJob `json:"download"`
+	Convert     []QueuedJob `json:"convert"`
+	DownloadLen int         `json:"download_len"`
+	ConvertLen  int         `json:"convert_len"`
 }
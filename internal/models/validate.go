@@ -0,0 +1,158 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"ytmp3api/internal/util"
+)
+
+// FieldError reports one invalid request field. Code, when set, is a stable
+// code for the problem that clients can branch on instead of the message.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// CodeInvalidURL marks a url field outside the allowed domains.
+const CodeInvalidURL = "INVALID_URL"
+
+// ValidationRules holds the server settings request validation depends on.
+type ValidationRules struct {
+	AllowedDomains []string
+	// Qualities are the configured quality labels and Formats the output
+	// formats this server's ffmpeg can encode.
+	Qualities []ConversionQuality
+	Formats   []string
+}
+
+// MaxClientRefLen bounds client_ref, which is restricted to characters that
+// are safe in filenames and log lines as-is.
+const MaxClientRefLen = 64
+
+// Validate checks a prepare request's fields, returning every problem found.
+func (r PrepareRequest) Validate(rules ValidationRules) []FieldError {
+	switch {
+	case strings.TrimSpace(r.URL) == "":
+		return []FieldError{{Field: "url", Message: "is required"}}
+	case !util.IsAllowedDomain(r.URL, rules.AllowedDomains):
+		return []FieldError{{Field: "url", Message: "domain is not supported", Code: CodeInvalidURL}}
+	}
+	return nil
+}
+
+// Validate checks a convert request's fields, returning every problem found.
+func (r ConvertRequest) Validate(rules ValidationRules) []FieldError {
+	var errs []FieldError
+	if r.ConversionID == "" {
+		errs = append(errs, FieldError{Field: "conversion_id", Message: "is required"})
+	}
+	return append(errs, r.ValidateOptions(rules)...)
+}
+
+// ValidateOptions checks every field of r except conversion_id, for requests
+// such as uploads that create their session instead of naming one. Checks
+// that depend on the source (duration and clip length limits) are left to
+// the handler.
+func (r ConvertRequest) ValidateOptions(rules ValidationRules) []FieldError {
+	var errs []FieldError
+	add := func(field, format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	if r.Preset != "" {
+		if _, ok := Presets[r.Preset]; !ok {
+			add("preset", "unknown preset %q", r.Preset)
+		}
+		if r.Quality != "" || len(r.Qualities) > 0 || r.SampleRate != 0 || r.Channels != 0 {
+			add("preset", "cannot be combined with quality, qualities, sample_rate or channels")
+		}
+	}
+	if r.Quality != "" && !slices.Contains(rules.Qualities, r.Quality) {
+		add("quality", "must be one of %s", joinQualities(rules.Qualities))
+	}
+	seenQ := map[ConversionQuality]bool{}
+	for i, q := range r.Qualities {
+		switch {
+		case !slices.Contains(rules.Qualities, q):
+			add(fmt.Sprintf("qualities[%d]", i), "must be one of %s", joinQualities(rules.Qualities))
+		case seenQ[q]:
+			add(fmt.Sprintf("qualities[%d]", i), "duplicate quality %q", q)
+		}
+		seenQ[q] = true
+	}
+	if r.Format != "" && !slices.Contains(rules.Formats, r.Format) {
+		add("format", "must be one of %s", strings.Join(rules.Formats, ", "))
+	}
+	if r.Format != "" && len(r.Formats) > 0 {
+		add("formats", "cannot be combined with format")
+	}
+	if len(r.Qualities) > 0 && len(r.Formats) > 0 {
+		add("formats", "cannot be combined with qualities")
+	}
+	seenF := map[string]bool{}
+	for i, f := range r.Formats {
+		switch {
+		case !slices.Contains(rules.Formats, f):
+			add(fmt.Sprintf("formats[%d]", i), "must be one of %s", strings.Join(rules.Formats, ", "))
+		case seenF[f]:
+			add(fmt.Sprintf("formats[%d]", i), "duplicate format %q", f)
+		}
+		seenF[f] = true
+	}
+	if r.SampleRate != 0 && !slices.Contains(SupportedSampleRates, r.SampleRate) {
+		add("sample_rate", "must be one of %s", joinInts(SupportedSampleRates))
+	}
+	if r.Channels != 0 && !slices.Contains(SupportedChannels, r.Channels) {
+		add("channels", "must be one of %s", joinInts(SupportedChannels))
+	}
+	if r.SplitChapters && (len(r.Qualities) > 0 || r.StartTime != "" || r.EndTime != "") {
+		add("split_chapters", "cannot be combined with qualities or start/end times")
+	}
+	_, _, startOK := util.ParseClipBounds(r.StartTime, "", 0, 0)
+	_, _, endOK := util.ParseClipBounds("", r.EndTime, 0, 0)
+	if !startOK {
+		add("start_time", "must be seconds or [hh:]mm:ss[.fff]")
+	}
+	if !endOK {
+		add("end_time", "must be seconds or [hh:]mm:ss[.fff]")
+	}
+	if startOK && endOK {
+		if _, _, ok := util.ParseClipBounds(r.StartTime, r.EndTime, 0, 0); !ok {
+			add("end_time", "must be after start_time")
+		}
+	}
+	if !validClientRef(r.ClientRef) {
+		add("client_ref", "must be at most %d letters, digits, '.', '_' or '-'", MaxClientRefLen)
+	}
+	return errs
+}
+
+func validClientRef(ref string) bool {
+	if len(ref) > MaxClientRefLen {
+		return false
+	}
+	for _, c := range ref {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func joinQualities(qs []ConversionQuality) string {
+	s := make([]string, len(qs))
+	for i, q := range qs {
+		s[i] = string(q)
+	}
+	return strings.Join(s, ", ")
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = fmt.Sprint(n)
+	}
+	return strings.Join(s, ", ")
+}
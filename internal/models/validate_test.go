@@ -0,0 +1,62 @@
+package models
+
+import (
+	"slices"
+	"testing"
+)
+
+var testRules = ValidationRules{
+	AllowedDomains: []string{"youtube.com", "youtu.be"},
+	Qualities:      []ConversionQuality{"64", "128", "192"},
+	Formats:        []string{FormatMP3, FormatM4A},
+}
+
+func TestPrepareRequestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		wantCode string
+		wantErr  bool
+	}{
+		{name: "allowed", url: "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{name: "missing", url: " ", wantErr: true},
+		{name: "disallowed domain", url: "https://example.com/a.mp4", wantCode: CodeInvalidURL, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := PrepareRequest{URL: tt.url}.Validate(testRules)
+			if (len(errs) > 0) != tt.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", errs, tt.wantErr)
+			}
+			if tt.wantErr && (errs[0].Field != "url" || errs[0].Code != tt.wantCode) {
+				t.Fatalf("Validate() = %+v, want url error with code %q", errs[0], tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestConvertRequestValidateCombinations(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        ConvertRequest
+		wantFields []string
+	}{
+		{name: "qualities", req: ConvertRequest{Qualities: []ConversionQuality{"64", "128"}}},
+		{name: "formats", req: ConvertRequest{Formats: []string{FormatMP3, FormatM4A}}},
+		{name: "qualities with format", req: ConvertRequest{Qualities: []ConversionQuality{"64", "128"}, Format: FormatM4A}},
+		{name: "qualities with formats", req: ConvertRequest{Qualities: []ConversionQuality{"64"}, Formats: []string{FormatMP3}}, wantFields: []string{"formats"}},
+		{name: "format with formats", req: ConvertRequest{Format: FormatMP3, Formats: []string{FormatM4A}}, wantFields: []string{"formats"}},
+		{name: "preset with quality", req: ConvertRequest{Preset: "voice", Quality: "64"}, wantFields: []string{"preset"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			for _, e := range tt.req.ValidateOptions(testRules) {
+				fields = append(fields, e.Field)
+			}
+			if !slices.Equal(fields, tt.wantFields) {
+				t.Fatalf("ValidateOptions() fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package queue
 
 import (
 	"container/heap"
+	"context"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,17 +16,111 @@ const (
 	JobConvert
 )
 
+func (t JobType) String() string {
+	switch t {
+	case JobDownload:
+		return "download"
+	case JobConvert:
+		return "convert"
+	}
+	return "unknown"
+}
+
 type Job struct {
 	ID         string
 	Type       JobType
 	SessionID  string
+	// URL is set instead of SessionID for warm-up downloads, which only
+	// populate the asset cache.
+	URL        string
 	Quality    string
 	StartTime  string
 	EndTime    string
+	// SampleRate and Channels override the source audio when non-zero
+	SampleRate int
+	Channels   int
+	// Precise requests sample-accurate clip seeking
+	Precise    bool
+	// Format is the output container ("m4a"); empty means mp3
+	Format     string
+	// Normalize applies loudness normalization (from a preset)
+	Normalize  bool
 	EnqueuedAt time.Time
 	Priority   int
 	ApiKey     string
+	// Principal identifies the tenant that submitted the job (API key or
+	// JWT subject) for per-tenant concurrency limits; empty if anonymous.
+	Principal  string
     Attempts   int
+	// SourceWaits counts how many times a convert job was re-enqueued while
+	// waiting for its source download to finish.
+	SourceWaits int
+	// TraceParent is the W3C traceparent of the request that created the
+	// job, linking worker spans to it.
+	TraceParent string
+	// RequestID is the X-Request-ID of the request that created the job,
+	// included in worker log lines.
+	RequestID string
+	// Deadline is the wall-clock budget for the whole job, including retries
+	// and re-enqueues. Zero means no deadline.
+	Deadline time.Time
+	// Done, when non-nil, is signalled once the job reaches a terminal state
+	// (completed or failed). It must be buffered so the worker never blocks.
+	Done chan struct{}
+}
+
+// Finish signals Done, if set, without blocking.
+func (j Job) Finish() {
+	if j.Done == nil {
+		return
+	}
+	select {
+	case j.Done <- struct{}{}:
+	default:
+	}
+}
+
+// Expired reports whether the job's deadline has passed.
+func (j Job) Expired(now time.Time) bool {
+	return !j.Deadline.IsZero() && now.After(j.Deadline)
+}
+
+// Stale reports whether the job has waited longer than maxWait since it was
+// enqueued. Only first pickups are considered; retried and re-enqueued jobs
+// have already been started by a worker. maxWait <= 0 disables the check.
+func (j Job) Stale(now time.Time, maxWait time.Duration) bool {
+	if maxWait <= 0 || j.Attempts > 0 || j.SourceWaits > 0 {
+		return false
+	}
+	return now.Sub(j.EnqueuedAt) > maxWait
+}
+
+// Context derives a context from parent that is cancelled at the job's
+// deadline, if it has one.
+func (j Job) Context(parent context.Context) (context.Context, context.CancelFunc) {
+	if j.Deadline.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithDeadline(parent, j.Deadline)
+}
+
+// Backoff returns a retry delay for the given attempt using exponential
+// backoff (2^attempt seconds, capped at max) with full jitter, so jobs that
+// fail together do not retry together.
+func Backoff(attempt int, max time.Duration) time.Duration {
+	if attempt < 0 {
+		attempt = 0
+	}
+	d := max
+	if attempt < 32 {
+		if exp := time.Duration(1<<attempt) * time.Second; exp < max {
+			d = exp
+		}
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
 }
 
 type priorityJob struct {
@@ -31,93 +128,244 @@ type priorityJob struct {
 	index int
 }
 
-type jobPQ []*priorityJob
+// Order reports whether job a should be dequeued before job b.
+type Order func(a, b Job) bool
+
+// ByPriority dequeues higher priority first and, for equal priority, earlier
+// EnqueuedAt first.
+func ByPriority(a, b Job) bool {
+	if a.Priority == b.Priority {
+		return a.EnqueuedAt.Before(b.EnqueuedAt)
+	}
+	return a.Priority > b.Priority
+}
+
+// FIFO dequeues strictly by EnqueuedAt, ignoring priority.
+func FIFO(a, b Job) bool {
+	return a.EnqueuedAt.Before(b.EnqueuedAt)
+}
 
-func (pq jobPQ) Len() int { return len(pq) }
-func (pq jobPQ) Less(i, j int) bool {
-	// Higher priority first; for equal priority, earlier EnqueuedAt first (FIFO)
-	if pq[i].job.Priority == pq[j].job.Priority {
-		return pq[i].job.EnqueuedAt.Before(pq[j].job.EnqueuedAt)
+// OrderFor returns the Order for a QUEUE_STRATEGY value: "fifo" or
+// "priority". It reports false for anything else.
+func OrderFor(strategy string) (Order, bool) {
+	switch strategy {
+	case "priority":
+		return ByPriority, true
+	case "fifo":
+		return FIFO, true
 	}
-	return pq[i].job.Priority > pq[j].job.Priority
+	return nil, false
+}
+
+type jobPQ struct {
+	items []*priorityJob
+	less  Order
+}
+
+func (pq *jobPQ) Len() int { return len(pq.items) }
+func (pq *jobPQ) Less(i, j int) bool {
+	return pq.less(pq.items[i].job, pq.items[j].job)
+}
+func (pq *jobPQ) Swap(i, j int) {
+	pq.items[i], pq.items[j] = pq.items[j], pq.items[i]
+	pq.items[i].index = i
+	pq.items[j].index = j
+}
+func (pq *jobPQ) Push(x interface{}) {
+	item := x.(*priorityJob)
+	item.index = len(pq.items)
+	pq.items = append(pq.items, item)
 }
-func (pq jobPQ) Swap(i, j int)       { pq[i], pq[j] = pq[j], pq[i]; pq[i].index = i; pq[j].index = j }
-func (pq *jobPQ) Push(x interface{}) { *pq = append(*pq, x.(*priorityJob)) }
 func (pq *jobPQ) Pop() interface{} {
-	old := *pq
+	old := pq.items
 	n := len(old)
 	item := old[n-1]
-	*pq = old[0 : n-1]
+	pq.items = old[0 : n-1]
 	return item
 }
 
+// sorted returns the queued jobs in dequeue order without modifying pq.
+func (pq *jobPQ) sorted() []*priorityJob {
+	order := make([]*priorityJob, len(pq.items))
+	copy(order, pq.items)
+	sort.Slice(order, func(i, j int) bool { return pq.less(order[i].job, order[j].job) })
+	return order
+}
+
 type Queue struct {
 	mu       sync.Mutex
 	notEmpty *sync.Cond
 	pq       jobPQ
 	capacity int
+	// bySession indexes queued jobs by type and session so status polling
+	// finds a session's job without scanning the heap.
+	bySession map[sessionKey][]*priorityJob
+	// positions caches PositionForSession results until the queue next
+	// changes, so repeated polling between changes costs a map lookup.
+	positions map[sessionKey]int
+}
+
+type sessionKey struct {
+	t  JobType
+	id string
 }
 
+// NewQueue returns a queue ordered ByPriority.
 func NewQueue(capacity int) *Queue {
-	q := &Queue{capacity: capacity}
+	return NewQueueWithOrder(capacity, ByPriority)
+}
+
+// NewQueueWithOrder returns a queue that dequeues jobs in the given order.
+func NewQueueWithOrder(capacity int, order Order) *Queue {
+	q := &Queue{capacity: capacity, pq: jobPQ{less: order}, bySession: map[sessionKey][]*priorityJob{}}
 	q.notEmpty = sync.NewCond(&q.mu)
 	heap.Init(&q.pq)
 	return q
 }
 
-func (q *Queue) Len() int { q.mu.Lock(); defer q.mu.Unlock(); return len(q.pq) }
+func (q *Queue) Len() int { q.mu.Lock(); defer q.mu.Unlock(); return q.pq.Len() }
 
 func (q *Queue) Enqueue(j Job) bool {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	if len(q.pq) >= q.capacity {
+	if q.pq.Len() >= q.capacity {
 		return false
 	}
-	heap.Push(&q.pq, &priorityJob{job: j})
-	q.notEmpty.Signal()
+	pj := &priorityJob{job: j}
+	heap.Push(&q.pq, pj)
+	k := sessionKey{j.Type, j.SessionID}
+	q.bySession[k] = append(q.bySession[k], pj)
+	q.positions = nil
+	// Broadcast rather than Signal: a DequeueClaim waiter may be unable to
+	// take this job while another waiter could
+	q.notEmpty.Broadcast()
 	return true
 }
 
 func (q *Queue) Dequeue() Job {
 	q.mu.Lock()
-	for len(q.pq) == 0 {
+	for q.pq.Len() == 0 {
 		q.notEmpty.Wait()
 	}
 	item := heap.Pop(&q.pq).(*priorityJob)
+	q.unindex(item)
 	q.mu.Unlock()
 	return item.job
 }
 
+// DequeueClaim blocks until claim accepts a queued job, then removes and
+// returns that job. Jobs are offered in dequeue order, so a job is skipped
+// only while claim rejects it. claim runs with the queue locked: it must be
+// quick and must not call back into the queue.
+func (q *Queue) DequeueClaim(claim func(Job) bool) Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if q.pq.Len() > 0 {
+			if top := q.pq.items[0]; claim(top.job) {
+				heap.Pop(&q.pq)
+				q.unindex(top)
+				return top.job
+			}
+			for _, pj := range q.pq.sorted()[1:] {
+				if claim(pj.job) {
+					heap.Remove(&q.pq, pj.index)
+					q.unindex(pj)
+					return pj.job
+				}
+			}
+		}
+		q.notEmpty.Wait()
+	}
+}
+
+// Remove drops the queued job with the given ID. It reports false if no such
+// job is queued, e.g. because a worker already took it.
+func (q *Queue) Remove(jobID string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, pj := range q.pq.items {
+		if pj.job.ID == jobID {
+			heap.Remove(&q.pq, pj.index)
+			q.unindex(pj)
+			return true
+		}
+	}
+	return false
+}
+
+// unindex drops a job removed from the heap from bySession. Callers hold mu.
+func (q *Queue) unindex(pj *priorityJob) {
+	q.positions = nil
+	k := sessionKey{pj.job.Type, pj.job.SessionID}
+	jobs := q.bySession[k]
+	for i, x := range jobs {
+		if x == pj {
+			jobs = append(jobs[:i], jobs[i+1:]...)
+			break
+		}
+	}
+	if len(jobs) == 0 {
+		delete(q.bySession, k)
+	} else {
+		q.bySession[k] = jobs
+	}
+}
+
+// Wake makes blocked DequeueClaim calls re-check the queue, e.g. after the
+// condition their claim function depends on has changed.
+func (q *Queue) Wake() {
+	q.mu.Lock()
+	q.notEmpty.Broadcast()
+	q.mu.Unlock()
+}
+
+// Snapshot returns copies of up to limit queued jobs in the order they will
+// be dequeued, without modifying the queue. limit <= 0 returns all jobs.
+func (q *Queue) Snapshot(limit int) []Job {
+	q.mu.Lock()
+	order := q.pq.sorted()
+	if limit > 0 && len(order) > limit {
+		order = order[:limit]
+	}
+	out := make([]Job, len(order))
+	for i, pj := range order {
+		out[i] = pj.job
+	}
+	q.mu.Unlock()
+	return out
+}
+
 // PositionForSession returns the 1-based position of the earliest enqueued job
 // that matches the given type and sessionID, relative to other jobs of the same
-// type in the priority queue. Returns 0 if no such job exists.
+// type in dequeue order. Returns 0 if no such job exists.
 func (q *Queue) PositionForSession(t JobType, sessionID string) int {
 	q.mu.Lock()
 	defer q.mu.Unlock()
+	k := sessionKey{t, sessionID}
+	if pos, ok := q.positions[k]; ok {
+		return pos
+	}
 	var found *Job
-	for _, pj := range q.pq {
-		if pj.job.Type == t && pj.job.SessionID == sessionID {
-			tmp := pj.job
-			// pick the earliest enqueued if multiple; we keep the first hit, then refine
-			if found == nil || pj.job.EnqueuedAt.Before(found.EnqueuedAt) {
-				found = &tmp
-			}
+	for _, pj := range q.bySession[k] {
+		// pick the earliest enqueued if multiple
+		if found == nil || pj.job.EnqueuedAt.Before(found.EnqueuedAt) {
+			found = &pj.job
 		}
 	}
 	if found == nil {
 		return 0
 	}
 	pos := 1
-	for _, pj := range q.pq {
-		if pj.job.Type != t {
-			continue
-		}
-		if pj.job.Priority > found.Priority {
-			pos++
-		} else if pj.job.Priority == found.Priority && pj.job.EnqueuedAt.Before(found.EnqueuedAt) {
+	for _, pj := range q.pq.items {
+		if pj.job.Type == t && q.pq.less(pj.job, *found) {
 			pos++
 		}
 	}
+	if q.positions == nil {
+		q.positions = map[sessionKey]int{}
+	}
+	q.positions[k] = pos
 	return pos
 }
 
@@ -127,6 +375,13 @@ type WorkerPool struct {
 	stopCh  chan struct{}
 	wg      sync.WaitGroup
 	handler func(Job)
+	claim   func(Job) bool
+}
+
+// SetClaim makes workers dequeue with DequeueClaim(claim) instead of taking
+// the next job unconditionally. Call it before Start.
+func (wp *WorkerPool) SetClaim(claim func(Job) bool) {
+	wp.claim = claim
 }
 
 func NewWorkerPool(workers int, queue *Queue, handler func(Job)) *WorkerPool {
@@ -143,7 +398,12 @@ func (wp *WorkerPool) Start() {
 				case <-wp.stopCh:
 					return
 				default:
-					job := wp.queue.Dequeue()
+					var job Job
+					if wp.claim != nil {
+						job = wp.queue.DequeueClaim(wp.claim)
+					} else {
+						job = wp.queue.Dequeue()
+					}
 					wp.handler(job)
 				}
 			}
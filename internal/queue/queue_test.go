@@ -0,0 +1,210 @@
+package queue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		attempt int
+		max     time.Duration
+		limit   time.Duration
+	}{
+		{name: "first attempt", attempt: 0, max: time.Minute, limit: time.Second},
+		{name: "grows exponentially", attempt: 3, max: time.Minute, limit: 8 * time.Second},
+		{name: "capped at max", attempt: 10, max: time.Minute, limit: time.Minute},
+		{name: "huge attempt does not overflow", attempt: 100, max: time.Minute, limit: time.Minute},
+		{name: "negative attempt", attempt: -2, max: time.Minute, limit: time.Second},
+		{name: "zero max", attempt: 4, max: 0, limit: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 200; i++ {
+				if d := Backoff(tt.attempt, tt.max); d < 0 || d > tt.limit {
+					t.Fatalf("Backoff(%d, %s) = %s, want within [0, %s]", tt.attempt, tt.max, d, tt.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffJitters(t *testing.T) {
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 50; i++ {
+		seen[Backoff(5, time.Minute)] = true
+	}
+	if len(seen) < 10 {
+		t.Errorf("50 backoffs produced only %d distinct delays; jitter missing", len(seen))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	q := NewQueue(10)
+	for _, id := range []string{"a", "b", "c"} {
+		q.Enqueue(Job{ID: id, Type: JobConvert, SessionID: "s-" + id, EnqueuedAt: time.Now()})
+	}
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "b", want: true},
+		{id: "b", want: false},
+		{id: "missing", want: false},
+	}
+	for _, tt := range tests {
+		if got := q.Remove(tt.id); got != tt.want {
+			t.Errorf("Remove(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+	if q.Len() != 2 {
+		t.Errorf("Len = %d, want 2", q.Len())
+	}
+	if pos := q.PositionForSession(JobConvert, "s-b"); pos != 0 {
+		t.Errorf("removed job still indexed at position %d", pos)
+	}
+}
+
+func TestDequeueOrder(t *testing.T) {
+	base := time.Now()
+	// Enqueued out of EnqueuedAt order so neither strategy can pass by
+	// preserving insertion order
+	jobs := []Job{
+		{ID: "low-late", Priority: 0, EnqueuedAt: base.Add(3 * time.Second)},
+		{ID: "high-late", Priority: 5, EnqueuedAt: base.Add(2 * time.Second)},
+		{ID: "low-early", Priority: 0, EnqueuedAt: base},
+		{ID: "high-early", Priority: 5, EnqueuedAt: base.Add(time.Second)},
+		{ID: "mid", Priority: 2, EnqueuedAt: base.Add(4 * time.Second)},
+	}
+	tests := []struct {
+		strategy string
+		want     []string
+	}{
+		{strategy: "priority", want: []string{"high-early", "high-late", "mid", "low-early", "low-late"}},
+		{strategy: "fifo", want: []string{"low-early", "high-early", "high-late", "low-late", "mid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			order, ok := OrderFor(tt.strategy)
+			if !ok {
+				t.Fatalf("OrderFor(%q) not ok", tt.strategy)
+			}
+			q := NewQueueWithOrder(len(jobs), order)
+			for _, j := range jobs {
+				j.Type = JobConvert
+				j.SessionID = "s-" + j.ID
+				q.Enqueue(j)
+			}
+			var got []string
+			for q.Len() > 0 {
+				got = append(got, q.Dequeue().ID)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("dequeue order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, ok := OrderFor("lifo"); ok {
+		t.Error(`OrderFor("lifo") ok, want unknown strategy`)
+	}
+}
+
+// scanPosition is PositionForSession without the session index: one scan to
+// find the session's job and another to count the jobs ahead of it.
+func scanPosition(q *Queue, t JobType, sessionID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var found *Job
+	for _, pj := range q.pq.items {
+		if pj.job.Type == t && pj.job.SessionID == sessionID {
+			if found == nil || pj.job.EnqueuedAt.Before(found.EnqueuedAt) {
+				found = &pj.job
+			}
+		}
+	}
+	if found == nil {
+		return 0
+	}
+	pos := 1
+	for _, pj := range q.pq.items {
+		if pj.job.Type == t && q.pq.less(pj.job, *found) {
+			pos++
+		}
+	}
+	return pos
+}
+
+// fullQueue returns a queue ordered by order holding n convert jobs of varied
+// priority, one per session "s<i>". Every third job shares its predecessor's
+// EnqueuedAt, so some jobs tie.
+func fullQueue(n int, order Order) *Queue {
+	q := NewQueueWithOrder(n+10, order)
+	at := time.Now()
+	for i := 0; i < n; i++ {
+		if i%3 != 0 {
+			at = at.Add(time.Millisecond)
+		}
+		q.Enqueue(Job{ID: fmt.Sprint(i), Type: JobConvert, SessionID: fmt.Sprintf("s%d", i), Priority: i % 7, EnqueuedAt: at})
+	}
+	return q
+}
+
+func TestPositionForSessionMatchesScan(t *testing.T) {
+	ids := []string{"s0", "s1", "s2", "s3", "s17", "s100", "s199", "other", "missing"}
+	tests := []struct {
+		name   string
+		order  Order
+		mutate func(q *Queue)
+	}{
+		{name: "priority", order: ByPriority, mutate: func(q *Queue) {}},
+		{name: "fifo", order: FIFO, mutate: func(q *Queue) {}},
+		{name: "after dequeue and remove", order: ByPriority, mutate: func(q *Queue) {
+			q.Dequeue()
+			q.Remove("17")
+		}},
+		{name: "after enqueue", order: ByPriority, mutate: func(q *Queue) {
+			q.Enqueue(Job{ID: "x", Type: JobConvert, SessionID: "other", Priority: 6, EnqueuedAt: time.Now()})
+			q.Enqueue(Job{ID: "y", Type: JobDownload, SessionID: "s3", Priority: 9, EnqueuedAt: time.Now()})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := fullQueue(200, tt.order)
+			// Populate the cache first so the mutation has to invalidate it
+			q.PositionForSession(JobConvert, "s0")
+			tt.mutate(q)
+			for _, id := range ids {
+				for _, jt := range []JobType{JobConvert, JobDownload} {
+					if got, want := q.PositionForSession(jt, id), scanPosition(q, jt, id); got != want {
+						t.Errorf("PositionForSession(%s, %s) = %d, want %d", jt, id, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPositionForSession(b *testing.B) {
+	q := fullQueue(1000, ByPriority)
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q.PositionForSession(JobConvert, fmt.Sprintf("s%d", i%1000))
+		}
+	})
+	b.Run("changing", func(b *testing.B) {
+		// A job arrives and one leaves before every lookup, so the cache
+		// never hits
+		for i := 0; i < b.N; i++ {
+			q.Enqueue(Job{ID: "x", Type: JobConvert, SessionID: "x", EnqueuedAt: time.Now()})
+			q.Remove("x")
+			q.PositionForSession(JobConvert, fmt.Sprintf("s%d", i%1000))
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanPosition(q, JobConvert, fmt.Sprintf("s%d", i%1000))
+		}
+	})
+}
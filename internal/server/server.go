@@ -4,20 +4,45 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"time"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
 	"ytmp3api/internal/config"
 	"ytmp3api/internal/handlers"
+	"ytmp3api/internal/tracing"
 )
 
 type Server struct {
-	api  *handlers.API
-	http *http.Server
+	api             *handlers.API
+	http            *http.Server
+	traceShutdown   func(context.Context) error
+	logLevel        *slog.LevelVar
+	shutdownTimeout time.Duration
 }
 
+// configFileEnv names the variable holding the optional env file that is
+// loaded at startup and re-read on SIGHUP.
+const configFileEnv = "CONFIG_FILE"
+
 func New() (*Server, error) {
+	if p := os.Getenv(configFileEnv); p != "" {
+		if err := config.LoadEnvFile(p); err != nil {
+			return nil, fmt.Errorf("%s: %w", configFileEnv, err)
+		}
+	}
 	cfg := config.Load()
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+	traceShutdown, err := tracing.Init(context.Background())
+	if err != nil {
+		return nil, err
+	}
 	api, err := handlers.NewAPI(cfg)
 	if err != nil {
 		return nil, err
@@ -26,8 +51,24 @@ func New() (*Server, error) {
 	mux := http.NewServeMux()
 	mux.Handle("/", api.Router())
 
-	h := &http.Server{Addr: ":8080", Handler: mux}
-	return &Server{api: api, http: h}, nil
+	h := newHTTPServer(cfg, mux)
+	return &Server{api: api, http: h, traceShutdown: traceShutdown, logLevel: logLevel, shutdownTimeout: cfg.ShutdownTimeout}, nil
+}
+
+// newHTTPServer returns the HTTP server for handler with cfg's timeouts,
+// accepting plaintext HTTP/2 when H2C is set.
+func newHTTPServer(cfg *config.Config, handler http.Handler) *http.Server {
+	if cfg.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	return &http.Server{
+		Addr:              ":8080",
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
 }
 
 func (s *Server) Start() error {
@@ -35,9 +76,42 @@ func (s *Server) Start() error {
 	return s.http.ListenAndServe()
 }
 
+// Reload re-reads CONFIG_FILE and applies the hot-reloadable subset of the
+// resulting configuration (see handlers.API.Reload) and the log level. The
+// process environment can't change while running, so without a config file
+// there is nothing to reload. A file that fails to load or validate leaves
+// the running configuration as it is.
+func (s *Server) Reload() {
+	p := os.Getenv(configFileEnv)
+	if p == "" {
+		log.Printf("config reload: %s is not set; nothing to reload", configFileEnv)
+		return
+	}
+	if err := config.LoadEnvFile(p); err != nil {
+		log.Printf("config reload: %v; keeping the current configuration", err)
+		return
+	}
+	cfg := config.Load()
+	if err := cfg.Validate(); err != nil {
+		log.Printf("config reload: %v; keeping the current configuration", err)
+		return
+	}
+	s.logLevel.Set(cfg.LogLevel)
+	s.api.Reload(cfg)
+}
+
+// Stop drains the API, waits (up to SHUTDOWN_TIMEOUT) for queued and running
+// jobs to finish while status and download requests are still served, then
+// shuts the HTTP server down.
 func (s *Server) Stop(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, s.shutdownTimeout)
 	defer cancel()
 	fmt.Println("shutting down")
+	defer s.api.Close()
+	defer s.traceShutdown(ctx)
+	s.api.Drain()
+	if err := s.api.WaitIdle(ctx); err != nil {
+		log.Printf("shutdown: jobs still pending after drain timeout: %v", err)
+	}
 	return s.http.Shutdown(ctx)
 }
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"ytmp3api/internal/config"
+)
+
+// serve starts newHTTPServer(cfg, h) on a loopback port and returns its
+// address.
+func serve(t *testing.T, cfg *config.Config, h http.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(cfg, h)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// closedWithin reports whether the server closes conn within d.
+func closedWithin(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := io.Copy(io.Discard, conn)
+	ne, isNet := err.(net.Error)
+	return err == nil || !(isNet && ne.Timeout())
+}
+
+func TestServerTimeoutsFire(t *testing.T) {
+	const short = 100 * time.Millisecond
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(3 * short)
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+	tests := []struct {
+		name string
+		cfg  config.Config
+		// run drives a connection and reports whether the server cut it off
+		run func(t *testing.T, conn net.Conn) bool
+		cut bool
+	}{
+		{
+			name: "read header timeout drops slowloris",
+			cfg:  config.Config{ReadHeaderTimeout: short},
+			run: func(t *testing.T, conn net.Conn) bool {
+				_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+				return closedWithin(conn, 2*time.Second)
+			},
+			cut: true,
+		},
+		{
+			name: "read timeout drops slow body",
+			cfg:  config.Config{ReadHeaderTimeout: time.Minute, ReadTimeout: short},
+			run: func(t *testing.T, conn net.Conn) bool {
+				_, _ = io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 100\r\n\r\npartial")
+				// The rest of the body never arrives; the server stops
+				// waiting for it at ReadTimeout and closes
+				return closedWithin(conn, 2*time.Second)
+			},
+			cut: true,
+		},
+		{
+			name: "idle timeout closes keep-alive connections",
+			cfg:  config.Config{ReadHeaderTimeout: time.Minute, IdleTimeout: short},
+			run: func(t *testing.T, conn net.Conn) bool {
+				_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				return closedWithin(conn, 2*time.Second)
+			},
+			cut: true,
+		},
+		{
+			name: "write timeout cuts slow responses",
+			cfg:  config.Config{ReadHeaderTimeout: time.Minute, WriteTimeout: short},
+			run: func(t *testing.T, conn net.Conn) bool {
+				_, _ = io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: x\r\n\r\n")
+				// The response is dropped, not delivered
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				b, _ := io.ReadAll(conn)
+				return !strings.Contains(string(b), "200 OK")
+			},
+			cut: true,
+		},
+		{
+			name: "no timeouts keeps an idle connection",
+			cfg:  config.Config{ReadHeaderTimeout: time.Minute},
+			run: func(t *testing.T, conn net.Conn) bool {
+				_, _ = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+				return closedWithin(conn, 3*short)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			conn, err := net.Dial("tcp", serve(t, &cfg, slow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := tt.run(t, conn); got != tt.cut {
+				t.Errorf("connection cut off = %v, want %v", got, tt.cut)
+			}
+		})
+	}
+}
+
+func TestServerH2C(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	})
+	tests := []struct {
+		name  string
+		h2c   bool
+		proto string
+	}{
+		{name: "h2c enabled", h2c: true, proto: "HTTP/2.0"},
+		{name: "h2c disabled", h2c: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := serve(t, &config.Config{ReadHeaderTimeout: time.Second, H2C: tt.h2c}, h)
+			// Prior-knowledge HTTP/2 over plaintext
+			client := &http.Client{Timeout: 2 * time.Second, Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, addr)
+				},
+			}}
+			resp, err := client.Get("http://" + addr + "/")
+			if !tt.h2c {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("plaintext HTTP/2 accepted without H2C")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			if string(b) != tt.proto {
+				t.Errorf("served over %q, want %q", b, tt.proto)
+			}
+		})
+	}
+}
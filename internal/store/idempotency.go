@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IdempotencyStore remembers the first response produced for an
+// Idempotency-Key so retried requests can be answered without repeating
+// side effects. A request claims its key with Begin before running; the key
+// then stays pending until SetResponse records the response or Release gives
+// it up, so concurrent retries cannot both run.
+type IdempotencyStore interface {
+	// Begin claims key for a request whose body hashes to bodyHash, holding
+	// it pending for at most ttl. If the key is already claimed or answered,
+	// claimed is false and rec describes the existing entry.
+	Begin(ctx context.Context, key, bodyHash string, ttl time.Duration) (rec IdempotencyRecord, claimed bool, err error)
+	SetResponse(ctx context.Context, key, bodyHash string, status int, body []byte, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+// IdempotencyRecord is the entry kept for a key: the hash of the body that
+// first used it and, unless Pending, the response to replay.
+type IdempotencyRecord struct {
+	BodyHash string `json:"body_hash"`
+	Pending  bool   `json:"pending,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Body     []byte `json:"body,omitempty"`
+}
+
+type storedResponse struct {
+	IdempotencyRecord
+	Expires time.Time
+}
+
+// MemoryIdempotencyStore keeps responses in memory; expired entries are
+// dropped lazily on lookup and on write.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]storedResponse
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{entries: make(map[string]storedResponse)}
+}
+
+func (m *MemoryIdempotencyStore) Begin(ctx context.Context, key, bodyHash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if e, ok := m.entries[key]; ok && now.Before(e.Expires) {
+		return e.IdempotencyRecord, false, nil
+	}
+	m.put(now, key, IdempotencyRecord{BodyHash: bodyHash, Pending: true}, ttl)
+	return IdempotencyRecord{}, true, nil
+}
+
+func (m *MemoryIdempotencyStore) SetResponse(ctx context.Context, key, bodyHash string, status int, body []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(time.Now(), key, IdempotencyRecord{BodyHash: bodyHash, Status: status, Body: body}, ttl)
+	return nil
+}
+
+func (m *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// put stores rec under key, dropping expired entries first. The caller
+// holds mu.
+func (m *MemoryIdempotencyStore) put(now time.Time, key string, rec IdempotencyRecord, ttl time.Duration) {
+	for k, e := range m.entries {
+		if now.After(e.Expires) {
+			delete(m.entries, k)
+		}
+	}
+	m.entries[key] = storedResponse{IdempotencyRecord: rec, Expires: now.Add(ttl)}
+}
+
+// RedisIdempotencyStore keeps responses in Redis with a key TTL.
+type RedisIdempotencyStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+func NewRedisIdempotencyStore(rdb *redis.Client, prefix string) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{rdb: rdb, prefix: prefix}
+}
+
+func (r *RedisIdempotencyStore) key(k string) string { return r.prefix + "idem:" + k }
+
+func (r *RedisIdempotencyStore) Begin(ctx context.Context, key, bodyHash string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	b, err := json.Marshal(IdempotencyRecord{BodyHash: bodyHash, Pending: true})
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	claimed, err := r.rdb.SetNX(ctx, r.key(key), b, ttl).Result()
+	if err != nil || claimed {
+		return IdempotencyRecord{}, claimed, err
+	}
+	cur, err := r.rdb.Get(ctx, r.key(key)).Bytes()
+	if err == redis.Nil {
+		// Expired or released between the two calls; try once more, and
+		// report a request that beat us to it as still pending
+		claimed, err = r.rdb.SetNX(ctx, r.key(key), b, ttl).Result()
+		return IdempotencyRecord{BodyHash: bodyHash, Pending: true}, claimed, err
+	}
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(cur, &rec); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	return rec, false, nil
+}
+
+func (r *RedisIdempotencyStore) SetResponse(ctx context.Context, key, bodyHash string, status int, body []byte, ttl time.Duration) error {
+	b, err := json.Marshal(IdempotencyRecord{BodyHash: bodyHash, Status: status, Body: body})
+	if err != nil {
+		return err
+	}
+	return r.rdb.Set(ctx, r.key(key), b, ttl).Err()
+}
+
+func (r *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return r.rdb.Del(ctx, r.key(key)).Err()
+}
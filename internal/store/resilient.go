@@ -0,0 +1,276 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"ytmp3api/internal/models"
+)
+
+// storeRetries is how many times a failing primary operation is attempted,
+// with exponential backoff starting at storeRetryBase.
+const (
+	storeRetries   = 3
+	storeRetryBase = 50 * time.Millisecond
+)
+
+// cacheTTL is how long an entry stays in the in-memory copy after it was
+// last written or read from the primary. Entries are swept at most every
+// cacheSweepInterval, so sessions deleted by other instances or expired in
+// Redis don't accumulate.
+const (
+	cacheTTL           = time.Hour
+	cacheSweepInterval = time.Minute
+)
+
+// cacheKind tells apart the maps of the in-memory copy in touched.
+type cacheKind int
+
+const (
+	cacheSession cacheKind = iota
+	cacheURL
+	cacheVariant
+	cacheAsset
+)
+
+type cacheKey struct {
+	kind cacheKind
+	key  string
+}
+
+// ResilientStore wraps a primary SessionStore (Redis) with retries and a
+// write-through in-memory copy. Writes always land in memory and are retried
+// against the primary, whose final error is returned; reads fall back to
+// memory when the primary keeps failing, so in-flight conversions survive a
+// Redis outage on this instance. Memory entries expire cacheTTL after their
+// last use.
+type ResilientStore struct {
+	primary SessionStore
+	cache   *MemoryStore
+
+	mu      sync.Mutex
+	lastErr error
+
+	// touched records when each cache entry was last used; guarded by
+	// cacheMu, which is taken before cache.mu
+	cacheMu   sync.Mutex
+	touched   map[cacheKey]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewResilientStore(primary SessionStore) *ResilientStore {
+	return &ResilientStore{primary: primary, cache: NewMemoryStore(), touched: map[cacheKey]time.Time{}, now: time.Now}
+}
+
+// Degraded returns the error of the last primary operation if it failed
+// after retries, or nil once an operation succeeds again.
+func (r *ResilientStore) Degraded() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastErr
+}
+
+// retry runs fn up to storeRetries times. ErrNotFound is an answer, not a
+// failure, and is returned immediately.
+func (r *ResilientStore) retry(ctx context.Context, op string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < storeRetries; attempt++ {
+		if err = fn(); err == nil || errors.Is(err, ErrNotFound) {
+			r.setErr(nil)
+			return err
+		}
+		if attempt == storeRetries-1 {
+			break
+		}
+		select {
+		case <-time.After(storeRetryBase << attempt):
+		case <-ctx.Done():
+			r.setErr(err)
+			return err
+		}
+	}
+	log.Printf("session store %s failed after %d attempts: %v", op, storeRetries, err)
+	r.setErr(err)
+	return err
+}
+
+func (r *ResilientStore) setErr(err error) {
+	r.mu.Lock()
+	r.lastErr = err
+	r.mu.Unlock()
+}
+
+// cacheSession stores a copy of s in memory, creating or replacing it.
+func (r *ResilientStore) cacheSession(s *models.ConversionSession) {
+	c := *s
+	r.cache.mu.Lock()
+	r.cache.sessions[c.ID] = &c
+	r.cache.mu.Unlock()
+	r.touch(cacheSession, c.ID)
+}
+
+// touch marks a cache entry as used now and sweeps expired entries if the
+// last sweep is older than cacheSweepInterval.
+func (r *ResilientStore) touch(kind cacheKind, key string) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	now := r.now()
+	r.touched[cacheKey{kind, key}] = now
+	if now.Sub(r.lastSweep) < cacheSweepInterval {
+		return
+	}
+	r.lastSweep = now
+	r.cache.mu.Lock()
+	defer r.cache.mu.Unlock()
+	for k, at := range r.touched {
+		if now.Sub(at) < cacheTTL {
+			continue
+		}
+		delete(r.touched, k)
+		switch k.kind {
+		case cacheSession:
+			delete(r.cache.sessions, k.key)
+		case cacheURL:
+			delete(r.cache.urlToID, k.key)
+		case cacheVariant:
+			delete(r.cache.variantToOut, k.key)
+		case cacheAsset:
+			delete(r.cache.assetMap, k.key)
+		}
+	}
+}
+
+// forget drops the record of a cache entry the caller deleted.
+func (r *ResilientStore) forget(kind cacheKind, key string) {
+	r.cacheMu.Lock()
+	delete(r.touched, cacheKey{kind, key})
+	r.cacheMu.Unlock()
+}
+
+func (r *ResilientStore) CreateSession(ctx context.Context, s *models.ConversionSession) error {
+	if err := r.cache.CreateSession(ctx, s); err != nil {
+		return err
+	}
+	r.touch(cacheSession, s.ID)
+	if err := r.retry(ctx, "create session", func() error { return r.primary.CreateSession(ctx, s) }); err != nil {
+		// The caller treats the session as not created
+		_ = r.cache.DeleteSession(ctx, s.ID)
+		r.forget(cacheSession, s.ID)
+		return err
+	}
+	return nil
+}
+
+// UpdateSession keeps s in memory even when the primary fails, so this
+// instance can still serve it, but reports the primary's error.
+func (r *ResilientStore) UpdateSession(ctx context.Context, s *models.ConversionSession) error {
+	r.cacheSession(s)
+	return r.retry(ctx, "update session", func() error { return r.primary.UpdateSession(ctx, s) })
+}
+
+func (r *ResilientStore) GetSession(ctx context.Context, id string) (*models.ConversionSession, error) {
+	var s *models.ConversionSession
+	err := r.retry(ctx, "get session", func() (err error) {
+		s, err = r.primary.GetSession(ctx, id)
+		return err
+	})
+	if err == nil {
+		r.cacheSession(s)
+		return s, nil
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return r.cache.GetSession(ctx, id)
+}
+
+func (r *ResilientStore) DeleteSession(ctx context.Context, id string) error {
+	_ = r.cache.DeleteSession(ctx, id)
+	r.forget(cacheSession, id)
+	return r.retry(ctx, "delete session", func() error { return r.primary.DeleteSession(ctx, id) })
+}
+
+func (r *ResilientStore) FindByURL(ctx context.Context, url string) (string, bool, error) {
+	var id string
+	var ok bool
+	err := r.retry(ctx, "find by url", func() (err error) {
+		id, ok, err = r.primary.FindByURL(ctx, url)
+		return err
+	})
+	if err != nil {
+		return r.cache.FindByURL(ctx, url)
+	}
+	return id, ok, nil
+}
+
+func (r *ResilientStore) SetURLMap(ctx context.Context, url, id string) error {
+	_ = r.cache.SetURLMap(ctx, url, id)
+	r.touch(cacheURL, url)
+	return r.retry(ctx, "set url map", func() error { return r.primary.SetURLMap(ctx, url, id) })
+}
+
+func (r *ResilientStore) SetVariant(ctx context.Context, variantHash, outputPath string) error {
+	_ = r.cache.SetVariant(ctx, variantHash, outputPath)
+	r.touch(cacheVariant, variantHash)
+	return r.retry(ctx, "set variant", func() error { return r.primary.SetVariant(ctx, variantHash, outputPath) })
+}
+
+func (r *ResilientStore) GetVariant(ctx context.Context, variantHash string) (string, bool, error) {
+	var out string
+	var ok bool
+	err := r.retry(ctx, "get variant", func() (err error) {
+		out, ok, err = r.primary.GetVariant(ctx, variantHash)
+		return err
+	})
+	if err != nil {
+		return r.cache.GetVariant(ctx, variantHash)
+	}
+	return out, ok, nil
+}
+
+func (r *ResilientStore) SetAsset(ctx context.Context, assetHash, sourcePath, state string) error {
+	_ = r.cache.SetAsset(ctx, assetHash, sourcePath, state)
+	r.touch(cacheAsset, assetHash)
+	return r.retry(ctx, "set asset", func() error { return r.primary.SetAsset(ctx, assetHash, sourcePath, state) })
+}
+
+func (r *ResilientStore) GetAsset(ctx context.Context, assetHash string) (string, string, bool, error) {
+	var src, state string
+	var ok bool
+	err := r.retry(ctx, "get asset", func() (err error) {
+		src, state, ok, err = r.primary.GetAsset(ctx, assetHash)
+		return err
+	})
+	if err != nil {
+		return r.cache.GetAsset(ctx, assetHash)
+	}
+	return src, state, ok, nil
+}
+
+func (r *ResilientStore) DeleteVariant(ctx context.Context, variantHash string) error {
+	_ = r.cache.DeleteVariant(ctx, variantHash)
+	r.forget(cacheVariant, variantHash)
+	return r.retry(ctx, "delete variant", func() error { return r.primary.DeleteVariant(ctx, variantHash) })
+}
+
+func (r *ResilientStore) DeleteAsset(ctx context.Context, assetHash string) error {
+	_ = r.cache.DeleteAsset(ctx, assetHash)
+	r.forget(cacheAsset, assetHash)
+	return r.retry(ctx, "delete asset", func() error { return r.primary.DeleteAsset(ctx, assetHash) })
+}
+
+func (r *ResilientStore) ListSessions(ctx context.Context) ([]*models.ConversionSession, error) {
+	var out []*models.ConversionSession
+	err := r.retry(ctx, "list sessions", func() (err error) {
+		out, err = r.primary.ListSessions(ctx)
+		return err
+	})
+	if err != nil {
+		return r.cache.ListSessions(ctx)
+	}
+	return out, nil
+}
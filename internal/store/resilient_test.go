@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"ytmp3api/internal/models"
+)
+
+var errDown = errors.New("primary down")
+
+// flakyStore is a MemoryStore whose session writes and reads fail while down
+// is set.
+type flakyStore struct {
+	*MemoryStore
+	down bool
+}
+
+func (f *flakyStore) CreateSession(ctx context.Context, s *models.ConversionSession) error {
+	if f.down {
+		return errDown
+	}
+	c := *s
+	return f.MemoryStore.CreateSession(ctx, &c)
+}
+
+func (f *flakyStore) UpdateSession(ctx context.Context, s *models.ConversionSession) error {
+	if f.down {
+		return errDown
+	}
+	c := *s
+	return f.MemoryStore.UpdateSession(ctx, &c)
+}
+
+func (f *flakyStore) GetSession(ctx context.Context, id string) (*models.ConversionSession, error) {
+	if f.down {
+		return nil, errDown
+	}
+	return f.MemoryStore.GetSession(ctx, id)
+}
+
+func (f *flakyStore) SetVariant(ctx context.Context, variantHash, outputPath string) error {
+	if f.down {
+		return errDown
+	}
+	return f.MemoryStore.SetVariant(ctx, variantHash, outputPath)
+}
+
+func TestResilientStoreSurfacesPrimaryErrors(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		down    bool
+		wantErr bool
+		cached  bool
+	}{
+		{name: "primary up", down: false, wantErr: false, cached: true},
+		{name: "primary down", down: true, wantErr: true, cached: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &flakyStore{MemoryStore: NewMemoryStore(), down: tt.down}
+			r := NewResilientStore(primary)
+			err := r.CreateSession(ctx, &models.ConversionSession{ID: "s1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateSession err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := r.cache.GetSession(ctx, "s1"); (err == nil) != tt.cached {
+				t.Errorf("cached after create = %v, want %v", err == nil, tt.cached)
+			}
+			// Updates are kept in memory either way, but report the failure
+			err = r.UpdateSession(ctx, &models.ConversionSession{ID: "s1", State: models.StateConverting})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("UpdateSession err = %v, wantErr %v", err, tt.wantErr)
+			}
+			got, err := r.GetSession(ctx, "s1")
+			if err != nil || got.State != models.StateConverting {
+				t.Errorf("GetSession = %+v, %v; want the updated session", got, err)
+			}
+			if err := r.SetVariant(ctx, "v", "/out.mp3"); (err != nil) != tt.wantErr {
+				t.Errorf("SetVariant err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResilientStoreCacheExpires(t *testing.T) {
+	ctx := context.Background()
+	primary := &flakyStore{MemoryStore: NewMemoryStore()}
+	r := NewResilientStore(primary)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	_ = r.CreateSession(ctx, &models.ConversionSession{ID: "old"})
+	_ = r.SetVariant(ctx, "old-variant", "/old.mp3")
+	now = now.Add(cacheTTL / 2)
+	_ = r.CreateSession(ctx, &models.ConversionSession{ID: "recent"})
+	now = now.Add(cacheTTL/2 + cacheSweepInterval)
+	// Any write sweeps once the interval has passed
+	_ = r.SetURLMap(ctx, "u", "recent")
+
+	tests := []struct {
+		id   string
+		kept bool
+	}{
+		{id: "old", kept: false},
+		{id: "recent", kept: true},
+	}
+	for _, tt := range tests {
+		if _, err := r.cache.GetSession(ctx, tt.id); (err == nil) != tt.kept {
+			t.Errorf("session %q cached = %v, want %v", tt.id, err == nil, tt.kept)
+		}
+	}
+	if _, ok, _ := r.cache.GetVariant(ctx, "old-variant"); ok {
+		t.Errorf("expired variant still cached")
+	}
+	if len(r.touched) != 2 {
+		t.Errorf("touched has %d entries, want 2", len(r.touched))
+	}
+}
@@ -25,6 +25,10 @@ type SessionStore interface {
 	GetVariant(ctx context.Context, variantHash string) (string, bool, error)
 	SetAsset(ctx context.Context, assetHash, sourcePath, state string) error
 	GetAsset(ctx context.Context, assetHash string) (sourcePath string, state string, ok bool, err error)
+	DeleteVariant(ctx context.Context, variantHash string) error
+	DeleteAsset(ctx context.Context, assetHash string) error
+	// ListSessions returns a snapshot of all stored sessions.
+	ListSessions(ctx context.Context) ([]*models.ConversionSession, error)
 }
 
 var ErrNotFound = errors.New("not found")
@@ -147,15 +151,46 @@ func (m *MemoryStore) GetAsset(ctx context.Context, assetHash string) (string, s
 	return a.SourcePath, a.State, true, nil
 }
 
-// RedisStore implements SessionStore on Redis.
+func (m *MemoryStore) DeleteVariant(ctx context.Context, variantHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.variantToOut, variantHash)
+	return nil
+}
+
+func (m *MemoryStore) DeleteAsset(ctx context.Context, assetHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.assetMap, assetHash)
+	return nil
+}
+
+func (m *MemoryStore) ListSessions(ctx context.Context) ([]*models.ConversionSession, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make([]*models.ConversionSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		copy := *s
+		out = append(out, &copy)
+	}
+	return out, nil
+}
+
+// RedisStore implements SessionStore on Redis. All keys start with prefix so
+// the database can be shared with other services.
 type RedisStore struct {
-	rdb *redis.Client
+	rdb    *redis.Client
+	prefix string
 }
 
-func NewRedisStore(rdb *redis.Client) *RedisStore { return &RedisStore{rdb: rdb} }
+func NewRedisStore(rdb *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{rdb: rdb, prefix: prefix}
+}
 
-func (r *RedisStore) sessionKey(id string) string { return "session:" + id }
-func (r *RedisStore) urlKey(url string) string    { return "url:" + url }
+func (r *RedisStore) sessionKey(id string) string   { return r.prefix + "session:" + id }
+func (r *RedisStore) urlKey(url string) string      { return r.prefix + "url:" + url }
+func (r *RedisStore) variantKey(hash string) string { return r.prefix + "variant:" + hash }
+func (r *RedisStore) assetKey(hash string) string   { return r.prefix + "asset:" + hash }
 
 func (r *RedisStore) CreateSession(ctx context.Context, s *models.ConversionSession) error {
 	b, err := json.Marshal(s)
@@ -204,12 +239,12 @@ func (r *RedisStore) SetURLMap(ctx context.Context, url, id string) error {
 }
 
 func (r *RedisStore) SetVariant(ctx context.Context, variantHash, outputPath string) error {
-	key := "variant:" + variantHash
+	key := r.variantKey(variantHash)
 	return r.rdb.Set(ctx, key, outputPath, 24*time.Hour).Err()
 }
 
 func (r *RedisStore) GetVariant(ctx context.Context, variantHash string) (string, bool, error) {
-	key := "variant:" + variantHash
+	key := r.variantKey(variantHash)
 	v, err := r.rdb.Get(ctx, key).Result()
 	if err != nil {
 		if err == redis.Nil {
@@ -221,14 +256,14 @@ func (r *RedisStore) GetVariant(ctx context.Context, variantHash string) (string
 }
 
 func (r *RedisStore) SetAsset(ctx context.Context, assetHash, sourcePath, state string) error {
-	key := "asset:" + assetHash
+	key := r.assetKey(assetHash)
 	payload := map[string]string{"source_path": sourcePath, "state": state}
 	b, _ := json.Marshal(payload)
 	return r.rdb.Set(ctx, key, b, 24*time.Hour).Err()
 }
 
 func (r *RedisStore) GetAsset(ctx context.Context, assetHash string) (string, string, bool, error) {
-	key := "asset:" + assetHash
+	key := r.assetKey(assetHash)
 	b, err := r.rdb.Get(ctx, key).Bytes()
 	if err != nil {
 		if err == redis.Nil {
@@ -245,3 +280,33 @@ func (r *RedisStore) GetAsset(ctx context.Context, assetHash string) (string, st
 	}
 	return p.SourcePath, p.State, true, nil
 }
+
+func (r *RedisStore) DeleteVariant(ctx context.Context, variantHash string) error {
+	return r.rdb.Del(ctx, r.variantKey(variantHash)).Err()
+}
+
+func (r *RedisStore) DeleteAsset(ctx context.Context, assetHash string) error {
+	return r.rdb.Del(ctx, r.assetKey(assetHash)).Err()
+}
+
+// ListSessions scans all session keys. It is O(n) in the keyspace and meant
+// for periodic maintenance, not request paths.
+func (r *RedisStore) ListSessions(ctx context.Context) ([]*models.ConversionSession, error) {
+	var out []*models.ConversionSession
+	iter := r.rdb.Scan(ctx, 0, r.sessionKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		b, err := r.rdb.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			if err == redis.Nil {
+				continue
+			}
+			return nil, err
+		}
+		var s models.ConversionSession
+		if err := json.Unmarshal(b, &s); err != nil {
+			continue
+		}
+		out = append(out, &s)
+	}
+	return out, iter.Err()
+}
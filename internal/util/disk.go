@@ -0,0 +1,39 @@
+package util
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// DirSize returns the total size in bytes of regular files under dir.
+// Unreadable entries are skipped.
+func DirSize(dir string) int64 {
+	var total int64
+	_ = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// WithinDir reports whether path, once made absolute and cleaned, lies
+// strictly inside root. Symlinks are not resolved.
+func WithinDir(root, path string) bool {
+	r, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(p, strings.TrimSuffix(r, string(filepath.Separator))+string(filepath.Separator))
+}
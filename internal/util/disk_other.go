@@ -0,0 +1,11 @@
+//go:build !unix
+
+package util
+
+import "errors"
+
+// FreeBytes is only implemented on unix; elsewhere free-space checks are
+// skipped.
+func FreeBytes(path string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,27 @@
+package util
+
+import "testing"
+
+func TestWithinDir(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{name: "file inside", path: "/data/conv/abc.mp3", want: true},
+		{name: "nested file", path: "/data/conv/outputs/abc.mp3", want: true},
+		{name: "root itself", path: "/data/conv", want: false},
+		{name: "parent traversal", path: "/data/conv/../secret.mp3", want: false},
+		{name: "deep traversal", path: "/data/conv/outputs/../../../etc/passwd", want: false},
+		{name: "traversal back inside", path: "/data/conv/outputs/../abc.mp3", want: true},
+		{name: "sibling with shared prefix", path: "/data/conv-other/abc.mp3", want: false},
+		{name: "relative traversal", path: "../../etc/passwd", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WithinDir("/data/conv", tt.path); got != tt.want {
+				t.Errorf("WithinDir(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package util
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// LoadPerCPU returns the 1-minute load average divided by the number of
+// CPUs. ok is false where /proc/loadavg is unavailable (non-Linux).
+func LoadPerCPU() (float64, bool) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	f := strings.Fields(string(b))
+	if len(f) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load / float64(runtime.NumCPU()), true
+}
+
+// MemoryUsedPercent returns the share of system memory not available to new
+// work (100 * (1 - MemAvailable/MemTotal)). ok is false where /proc/meminfo
+// is unavailable.
+func MemoryUsedPercent() (float64, bool) {
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	var total, avail float64
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			continue
+		}
+		switch f[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseFloat(f[1], 64)
+		case "MemAvailable:":
+			avail, _ = strconv.ParseFloat(f[1], 64)
+		}
+	}
+	if total <= 0 {
+		return 0, false
+	}
+	return 100 * (1 - avail/total), true
+}
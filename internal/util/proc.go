@@ -0,0 +1,50 @@
+package util
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// Priority lowers the CPU and I/O priority of external commands so heavy
+// downloads and conversions don't starve the HTTP server on shared hosts.
+// The zero value leaves commands unchanged.
+type Priority struct {
+	// Nice is the niceness increment (1-19); 0 disables.
+	Nice int
+	// IOClass is the ionice scheduling class: 2 (best-effort, at the lowest
+	// level) or 3 (idle); 0 disables.
+	IOClass int
+}
+
+var (
+	niceOnce, ioniceOnce sync.Once
+	nicePath, ionicePath string
+)
+
+// Command is exec.CommandContext run under nice/ionice as configured. Each
+// wrapper is skipped when its binary isn't on PATH (e.g. ionice outside
+// Linux). Both exec the target in place, so cancelling ctx still kills it.
+func (p Priority) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	var prefix []string
+	if p.Nice > 0 {
+		niceOnce.Do(func() { nicePath, _ = exec.LookPath("nice") })
+		if nicePath != "" {
+			prefix = append(prefix, nicePath, "-n", strconv.Itoa(p.Nice))
+		}
+	}
+	if p.IOClass == 2 || p.IOClass == 3 {
+		ioniceOnce.Do(func() { ionicePath, _ = exec.LookPath("ionice") })
+		if ionicePath != "" {
+			prefix = append(prefix, ionicePath, "-c", strconv.Itoa(p.IOClass))
+			if p.IOClass == 2 {
+				prefix = append(prefix, "-n", "7")
+			}
+		}
+	}
+	if len(prefix) == 0 {
+		return exec.CommandContext(ctx, name, args...)
+	}
+	return exec.CommandContext(ctx, prefix[0], append(append(prefix[1:], name), args...)...)
+}
@@ -5,6 +5,7 @@ import (
     "encoding/hex"
     "net/url"
     "path"
+    "regexp"
     "strconv"
     "strings"
 )
@@ -22,13 +23,19 @@ func CanonicalVideoID(raw string) string {
 	}
 	host := strings.ToLower(u.Host)
 	if strings.Contains(host, "youtube.com") {
+		// Covers www., m. and music.youtube.com, including /watch/... paths
+		// that carry extra segments alongside ?v=
 		q := u.Query()
 		if v := q.Get("v"); v != "" {
 			return "yt:" + v
 		}
-		// Shorts: /shorts/<id>
-		if strings.HasPrefix(strings.ToLower(u.Path), "/shorts/") {
-			return "yt:" + path.Base(u.Path)
+		// Path-based ids: /shorts/<id>, /embed/<id>, /live/<id>, /v/<id>
+		segs := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(segs) >= 2 && segs[1] != "" {
+			switch strings.ToLower(segs[0]) {
+			case "shorts", "embed", "live", "v":
+				return "yt:" + segs[1]
+			}
 		}
 	}
 	if strings.Contains(host, "youtu.be") {
@@ -37,12 +44,137 @@ func CanonicalVideoID(raw string) string {
 			return "yt:" + id
 		}
 	}
-	// Fallback to normalized scheme+host+path without query fragments
-	u.RawQuery = ""
+	// Fallback to normalized scheme+host+path without the fragment; the host
+	// is lowercased and loses a "www." or "m." prefix. The query keeps its
+	// identifying params (e.g. list= or a file id) minus tracking noise,
+	// encoded in sorted order; other hosts also lose signing params, so
+	// re-signed links to the same file share one asset.
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.TrimPrefix(strings.TrimPrefix(host, "www."), "m.")
+	q := stripNoiseParams(u.Query())
+	if !strings.Contains(host, "youtube.com") && !strings.Contains(host, "youtu.be") {
+		q = stripSigningParams(q)
+	}
+	u.RawQuery = q.Encode()
 	u.Fragment = ""
 	return u.String()
 }
 
+// noiseParams are YouTube query params that never change which video is
+// addressed: share/tracking markers and playback position.
+var noiseParams = map[string]struct{}{
+	"feature": {},
+	"si":      {},
+	"pp":      {},
+	"t":       {},
+	"index":   {},
+}
+
+func stripNoiseParams(q url.Values) url.Values {
+	for k := range q {
+		lk := strings.ToLower(k)
+		if _, ok := noiseParams[lk]; ok || strings.HasPrefix(lk, "utm_") {
+			q.Del(k)
+		}
+	}
+	return q
+}
+
+// signingParams are query params of presigned S3, CloudFront, GCS and Azure
+// URLs that carry a signature or an expiry rather than pick the file.
+var signingParams = map[string]struct{}{
+	"signature":      {},
+	"expires":        {},
+	"awsaccesskeyid": {},
+	"key-pair-id":    {},
+	"policy":         {},
+	"googleaccessid": {},
+	"sig":            {},
+	"se":             {},
+	"st":             {},
+	"sv":             {},
+	"sp":             {},
+	"sr":             {},
+	"spr":            {},
+	"token":          {},
+}
+
+func stripSigningParams(q url.Values) url.Values {
+	for k := range q {
+		lk := strings.ToLower(k)
+		if _, ok := signingParams[lk]; ok || strings.HasPrefix(lk, "x-amz-") || strings.HasPrefix(lk, "x-goog-") {
+			q.Del(k)
+		}
+	}
+	return q
+}
+
+// StartOffset returns the playback position in seconds carried by a URL's
+// "t" query parameter (or "#t=" fragment), as YouTube share links do. It
+// accepts bare seconds ("90"), a trailing "s" ("90s") and h/m/s units
+// ("1m30s", "1h2m3s"); anything else, and a zero offset, report false.
+func StartOffset(raw string) (int, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return 0, false
+	}
+	t := u.Query().Get("t")
+	if t == "" && strings.HasPrefix(u.Fragment, "t=") {
+		t = strings.TrimPrefix(u.Fragment, "t=")
+	}
+	secs, ok := parseTimestamp(strings.ToLower(strings.TrimSpace(t)))
+	return secs, ok && secs > 0
+}
+
+// parseTimestamp parses "90", "90s" or a sequence of h/m/s units in that
+// order, such as "1h2m3s".
+func parseTimestamp(t string) (int, bool) {
+	if t == "" {
+		return 0, false
+	}
+	if n, ok := atoiDigits(t); ok {
+		return n, true
+	}
+	total, last := 0, 0
+	for t != "" {
+		i := 0
+		for i < len(t) && t[i] >= '0' && t[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(t) {
+			return 0, false
+		}
+		n, ok := atoiDigits(t[:i])
+		if !ok {
+			return 0, false
+		}
+		unit := strings.IndexByte("hms", t[i]) + 1
+		// Units must be known and appear at most once, largest first
+		if unit == 0 || unit <= last {
+			return 0, false
+		}
+		last = unit
+		total += n * [...]int{3600, 60, 1}[unit-1]
+		t = t[i+1:]
+	}
+	return total, true
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// RedactURLs rewrites every http(s) URL in s to its scheme, host and path,
+// dropping credentials, query and fragment (signed media URLs in tool
+// output carry their tokens there).
+func RedactURLs(s string) string {
+	return urlPattern.ReplaceAllStringFunc(s, func(raw string) string {
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" {
+			return "[redacted-url]"
+		}
+		return u.Scheme + "://" + u.Host + u.EscapedPath()
+	})
+}
+
 func HashString(s string) string {
 	h := sha1.Sum([]byte(s))
 	return hex.EncodeToString(h[:])
@@ -71,40 +203,92 @@ func IsAllowedDomain(raw string, allowed []string) bool {
     return false
 }
 
-// ParseClipBounds validates HH:MM:SS or MM:SS and returns seconds.
+// ParseClipBounds validates clip bounds and returns whole seconds. Each bound
+// may be HH:MM:SS, MM:SS or a bare number of seconds ("90"), and the seconds
+// part may carry up to millisecond precision ("00:01:30.250"); the raw strings
+// are what ffmpeg receives, so fractions pass through unchanged.
 // Returns (start, end, ok). ok=false if invalid or exceeds maxSeconds.
+//
+// When maxSeconds is set, a clip running to the end of the video (empty end)
+// can only be checked against the limit if totalDuration is known; with an
+// unknown duration (0) such requests are rejected rather than let through
+// unbounded, so callers must supply an explicit end time.
 func ParseClipBounds(start, end string, maxSeconds int, totalDuration int) (int, int, bool) {
-    toSec := func(t string) (int, bool) {
-        t = strings.TrimSpace(t)
-        if t == "" {
-            return 0, true
+    ss, ok1 := clipMillis(start)
+    ee, ok2 := clipMillis(end)
+    if !ok1 || !ok2 { return 0, 0, false }
+    if ee > 0 && ee <= ss { return 0, 0, false }
+    total := int64(totalDuration) * 1000
+    if total > 0 {
+        if ss >= total { return 0, 0, false }
+        if ee > 0 && ee > total { return 0, 0, false }
+    }
+    var clipLen int64
+    if ee > 0 { clipLen = ee - ss } else if total > 0 { clipLen = total - ss } else if maxSeconds > 0 { return 0, 0, false }
+    if maxSeconds > 0 && clipLen > int64(maxSeconds)*1000 { return 0, 0, false }
+    return int(ss / 1000), int(ee / 1000), true
+}
+
+// clipMillis parses a single clip bound into milliseconds. Empty means 0.
+func clipMillis(t string) (int64, bool) {
+    t = strings.TrimSpace(t)
+    if t == "" {
+        return 0, true
+    }
+    parts := strings.Split(t, ":")
+    if len(parts) > 3 {
+        return 0, false
+    }
+    // The last component holds seconds, optionally with a fraction
+    secPart := parts[len(parts)-1]
+    var frac int64
+    if dot := strings.IndexByte(secPart, '.'); dot != -1 {
+        f := secPart[dot+1:]
+        if len(f) > 3 {
+            return 0, false
         }
-        parts := strings.Split(t, ":")
-        if len(parts) < 2 || len(parts) > 3 {
+        n, ok := atoiDigits(f)
+        if !ok {
             return 0, false
         }
-        var h, m, s int
-        var err error
-        if len(parts) == 3 {
-            if h, err = strconv.Atoi(parts[0]); err != nil || h < 0 { return 0, false }
-            if m, err = strconv.Atoi(parts[1]); err != nil || m < 0 || m > 59 { return 0, false }
-            if s, err = strconv.Atoi(parts[2]); err != nil || s < 0 || s > 59 { return 0, false }
-        } else {
-            if m, err = strconv.Atoi(parts[0]); err != nil || m < 0 { return 0, false }
-            if s, err = strconv.Atoi(parts[1]); err != nil || s < 0 || s > 59 { return 0, false }
+        for i := len(f); i < 3; i++ {
+            n *= 10
         }
-        return h*3600 + m*60 + s, true
+        frac = int64(n)
+        secPart = secPart[:dot]
     }
-    ss, ok1 := toSec(start)
-    ee, ok2 := toSec(end)
-    if !ok1 || !ok2 { return 0, 0, false }
-    if ee > 0 && ee <= ss { return 0, 0, false }
-    if totalDuration > 0 {
-        if ss >= totalDuration { return 0, 0, false }
-        if ee > 0 && ee > totalDuration { return 0, 0, false }
+    sec, ok := atoiDigits(secPart)
+    if !ok {
+        return 0, false
+    }
+    if len(parts) == 1 {
+        // Bare seconds: no upper bound on the value
+        return int64(sec)*1000 + frac, true
+    }
+    if sec > 59 {
+        return 0, false
+    }
+    var h, m int
+    if len(parts) == 3 {
+        if h, ok = atoiDigits(parts[0]); !ok { return 0, false }
+        if m, ok = atoiDigits(parts[1]); !ok || m > 59 { return 0, false }
+    } else {
+        if m, ok = atoiDigits(parts[0]); !ok { return 0, false }
+    }
+    return int64(h*3600+m*60+sec)*1000 + frac, true
+}
+
+// atoiDigits parses s when it is made of ASCII digits only; unlike
+// strconv.Atoi it rejects signs, which ffmpeg would otherwise receive as-is.
+func atoiDigits(s string) (int, bool) {
+    if s == "" {
+        return 0, false
+    }
+    for i := 0; i < len(s); i++ {
+        if s[i] < '0' || s[i] > '9' {
+            return 0, false
+        }
     }
-    clipLen := 0
-    if ee > 0 { clipLen = ee - ss } else if totalDuration > 0 { clipLen = totalDuration - ss }
-    if maxSeconds > 0 && clipLen > maxSeconds { return 0, 0, false }
-    return ss, ee, true
+    n, err := strconv.Atoi(s)
+    return n, err == nil
 }
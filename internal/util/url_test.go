@@ -0,0 +1,166 @@
+package util
+
+import "testing"
+
+func TestCanonicalVideoID(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "watch", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ", want: "yt:dQw4w9WgXcQ"},
+		{name: "watch with extra params", raw: "https://www.youtube.com/watch?list=PL1&v=dQw4w9WgXcQ&t=42", want: "yt:dQw4w9WgXcQ"},
+		{name: "mobile", raw: "https://m.youtube.com/watch?v=dQw4w9WgXcQ", want: "yt:dQw4w9WgXcQ"},
+		{name: "music", raw: "https://music.youtube.com/watch?v=dQw4w9WgXcQ&feature=share", want: "yt:dQw4w9WgXcQ"},
+		{name: "watch with extra path segment", raw: "https://www.youtube.com/watch/extra?v=dQw4w9WgXcQ", want: "yt:dQw4w9WgXcQ"},
+		{name: "shorts", raw: "https://www.youtube.com/shorts/dQw4w9WgXcQ", want: "yt:dQw4w9WgXcQ"},
+		{name: "embed", raw: "https://www.youtube.com/embed/dQw4w9WgXcQ?autoplay=1", want: "yt:dQw4w9WgXcQ"},
+		{name: "live", raw: "https://www.youtube.com/live/dQw4w9WgXcQ?si=abc", want: "yt:dQw4w9WgXcQ"},
+		{name: "legacy v path", raw: "https://www.youtube.com/v/dQw4w9WgXcQ", want: "yt:dQw4w9WgXcQ"},
+		{name: "short link", raw: "https://youtu.be/dQw4w9WgXcQ?t=10", want: "yt:dQw4w9WgXcQ"},
+		{name: "surrounding space", raw: "  https://youtu.be/dQw4w9WgXcQ  ", want: "yt:dQw4w9WgXcQ"},
+		{name: "direct host keeps query", raw: "https://cdn.example.com/get?id=1", want: "https://cdn.example.com/get?id=1"},
+		{name: "direct host distinct query", raw: "https://cdn.example.com/get?id=2", want: "https://cdn.example.com/get?id=2"},
+		{name: "presigned s3", raw: "https://bucket.s3.amazonaws.com/a.mp4?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Expires=900&X-Amz-Signature=abc&versionId=7", want: "https://bucket.s3.amazonaws.com/a.mp4?versionId=7"},
+		{name: "cloudfront signed", raw: "https://d1.cloudfront.net/a.mp4?Expires=1&Signature=x&Key-Pair-Id=k", want: "https://d1.cloudfront.net/a.mp4"},
+		{name: "empty", raw: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CanonicalVideoID(tt.raw); got != tt.want {
+				t.Errorf("CanonicalVideoID(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalVideoIDStripsNoise(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{name: "tracking params on watch", a: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&utm_source=x&si=abc", b: "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{name: "playlist without v", a: "https://www.youtube.com/playlist?list=PL1&feature=share&pp=ygU&utm_campaign=y", b: "https://YouTube.com/playlist?list=PL1"},
+		{name: "playlist position", a: "https://m.youtube.com/playlist?index=3&t=20&list=PL1", b: "https://www.youtube.com/playlist?list=PL1"},
+		{name: "case and fragment", a: "HTTPS://WWW.YOUTUBE.COM/playlist?list=PL1#frag", b: "https://youtube.com/playlist?list=PL1"},
+		{name: "other host www prefix", a: "https://www.example.com/a.mp3?utm_source=x", b: "https://example.com/a.mp3"},
+		{name: "other host mobile prefix", a: "https://M.Example.com/a.mp3", b: "https://example.com/a.mp3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ha, hb := HashString(CanonicalVideoID(tt.a)), HashString(CanonicalVideoID(tt.b))
+			if ha != hb {
+				t.Errorf("%q -> %q and %q -> %q hash differently", tt.a, CanonicalVideoID(tt.a), tt.b, CanonicalVideoID(tt.b))
+			}
+		})
+	}
+}
+
+func TestCanonicalVideoIDKeepsIdentity(t *testing.T) {
+	if a, b := CanonicalVideoID("https://www.youtube.com/playlist?list=PL1"), CanonicalVideoID("https://www.youtube.com/playlist?list=PL2"); a == b {
+		t.Errorf("different playlists both canonicalize to %q", a)
+	}
+}
+
+func TestParseClipBoundsForms(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		wantStart  int
+		wantEnd    int
+		ok         bool
+	}{
+		{name: "mm:ss", start: "01:30", end: "02:00", wantStart: 90, wantEnd: 120, ok: true},
+		{name: "hh:mm:ss", start: "00:01:30", end: "01:00:00", wantStart: 90, wantEnd: 3600, ok: true},
+		{name: "bare seconds", start: "90", end: "150", wantStart: 90, wantEnd: 150, ok: true},
+		{name: "bare seconds over a minute", start: "", end: "3599", wantEnd: 3599, ok: true},
+		{name: "fractional seconds", start: "00:01:30.250", end: "00:01:31.5", wantStart: 90, wantEnd: 91, ok: true},
+		{name: "fractional bare seconds", start: "1.25", end: "2", wantStart: 1, wantEnd: 2, ok: true},
+		{name: "sub-second clip", start: "1.25", end: "1.5", wantStart: 1, wantEnd: 1, ok: true},
+		{name: "plus sign", start: "+90", ok: false},
+		{name: "minus sign", start: "-5", ok: false},
+		{name: "plus in minutes", start: "+1:30", ok: false},
+		{name: "plus in fraction", start: "1.+5", ok: false},
+		{name: "empty fraction", start: "1.", ok: false},
+		{name: "fraction too precise", start: "1.2345", ok: false},
+		{name: "seconds over 59", start: "1:60", ok: false},
+		{name: "minutes over 59", start: "1:60:00", ok: false},
+		{name: "too many parts", start: "1:2:3:4", ok: false},
+		{name: "letters", start: "abc", ok: false},
+		{name: "end before start", start: "20", end: "10", ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, e, ok := ParseClipBounds(tt.start, tt.end, 0, 0)
+			if ok != tt.ok {
+				t.Fatalf("ParseClipBounds(%q, %q) ok = %v, want %v", tt.start, tt.end, ok, tt.ok)
+			}
+			if ok && (s != tt.wantStart || e != tt.wantEnd) {
+				t.Errorf("ParseClipBounds(%q, %q) = %d, %d, want %d, %d", tt.start, tt.end, s, e, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseClipBoundsLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		max, total int
+		ok         bool
+	}{
+		{name: "within max", start: "10", end: "70", max: 60, total: 600, ok: true},
+		{name: "over max", start: "0", end: "61", max: 60, total: 600, ok: false},
+		{name: "to end within max", start: "550", max: 60, total: 600, ok: true},
+		{name: "to end over max", start: "0", max: 60, total: 600, ok: false},
+		{name: "unknown duration without end", start: "0", max: 60, total: 0, ok: false},
+		{name: "unknown duration with end", start: "0", end: "30", max: 60, total: 0, ok: true},
+		{name: "unknown duration no max", start: "0", max: 0, total: 0, ok: true},
+		{name: "start past duration", start: "601", max: 0, total: 600, ok: false},
+		{name: "end past duration", start: "0", end: "601", max: 0, total: 600, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, ok := ParseClipBounds(tt.start, tt.end, tt.max, tt.total); ok != tt.ok {
+				t.Errorf("ParseClipBounds(%q, %q, %d, %d) ok = %v, want %v", tt.start, tt.end, tt.max, tt.total, ok, tt.ok)
+			}
+		})
+	}
+}
+
+func TestStartOffset(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		want   int
+		wantOK bool
+	}{
+		{name: "bare seconds", raw: "https://youtu.be/dQw4w9WgXcQ?t=90", want: 90, wantOK: true},
+		{name: "seconds suffix", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=90s", want: 90, wantOK: true},
+		{name: "minutes and seconds", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1m30s", want: 90, wantOK: true},
+		{name: "hours minutes seconds", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1h2m3s", want: 3723, wantOK: true},
+		{name: "hours only", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1h", want: 3600, wantOK: true},
+		{name: "uppercase units", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1M30S", want: 90, wantOK: true},
+		{name: "fragment", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ#t=45", want: 45, wantOK: true},
+		{name: "query wins over fragment", raw: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=10#t=45", want: 10, wantOK: true},
+		{name: "zero", raw: "https://youtu.be/dQw4w9WgXcQ?t=0", wantOK: false},
+		{name: "missing", raw: "https://youtu.be/dQw4w9WgXcQ", wantOK: false},
+		{name: "empty", raw: "https://youtu.be/dQw4w9WgXcQ?t=", wantOK: false},
+		{name: "plus sign", raw: "https://youtu.be/dQw4w9WgXcQ?t=%2B90", wantOK: false},
+		{name: "negative", raw: "https://youtu.be/dQw4w9WgXcQ?t=-90", wantOK: false},
+		{name: "signed unit", raw: "https://youtu.be/dQw4w9WgXcQ?t=1m-30s", wantOK: false},
+		{name: "units out of order", raw: "https://youtu.be/dQw4w9WgXcQ?t=30s1m", wantOK: false},
+		{name: "repeated unit", raw: "https://youtu.be/dQw4w9WgXcQ?t=1m1m", wantOK: false},
+		{name: "unknown unit", raw: "https://youtu.be/dQw4w9WgXcQ?t=90x", wantOK: false},
+		{name: "missing unit", raw: "https://youtu.be/dQw4w9WgXcQ?t=1m30", wantOK: false},
+		{name: "fraction", raw: "https://youtu.be/dQw4w9WgXcQ?t=1.5", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := StartOffset(tt.raw)
+			if ok != tt.wantOK || ok && got != tt.want {
+				t.Errorf("StartOffset(%q) = %d, %v, want %d, %v", tt.raw, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}